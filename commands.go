@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/egawata/dev-image-chat/imagechat"
+)
+
+// runCommand dispatches a CLI subcommand.
+func runCommand(name string, args []string) error {
+	switch name {
+	case "generate":
+		return runGenerateCommand(args)
+	case "replay":
+		return runReplayCommand(args)
+	case "characters":
+		return runCharactersCommand(args)
+	default:
+		return fmt.Errorf("unknown command %q (available: generate, replay, characters)", name)
+	}
+}
+
+// sampleConversation is used by "generate -character" when no session file
+// is given.
+var sampleConversation = []imagechat.Message{
+	{Role: "user", Content: "The login test keeps failing on CI. Can you take a look?"},
+	{Role: "assistant", Content: "Found it! The session cookie expired before the redirect finished. I extended its lifetime and the test passes now."},
+}
+
+// runGenerateCommand generates a single image from a slice of a saved session
+// file, without starting the watcher or the web server. It prints the
+// generated prompt and the path of the saved image.
+func runGenerateCommand(args []string) error {
+	fs := flag.NewFlagSet("generate", flag.ExitOnError)
+	index := fs.Int("index", -1, "index of the last message to include (0-based; default: last message)")
+	count := fs.Int("count", 0, "number of messages ending at -index to use (default: RECENT_MESSAGES)")
+	character := fs.String("character", "", "render this character (.md file or loaded character name) instead of the one the session would get; the session file is then optional")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s generate [flags] <session.jsonl>\n", filepath.Base(os.Args[0]))
+		fmt.Fprintf(fs.Output(), "       %s generate -character <name|file.md> [flags] [session.jsonl]\n", filepath.Base(os.Args[0]))
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() > 1 || (fs.NArg() == 0 && *character == "") {
+		fs.Usage()
+		return fmt.Errorf("expected exactly one session file")
+	}
+	sessionPath := fs.Arg(0)
+
+	cfg, err := imagechat.LoadConfig()
+	if err != nil {
+		return fmt.Errorf("config error: %w", err)
+	}
+	imagechat.InitLogger(cfg.LogLevel)
+
+	if *character != "" {
+		c, err := findCharacter(cfg, *character)
+		if err != nil {
+			return err
+		}
+		// With a single character, every session is assigned it.
+		cfg.Characters = []imagechat.Character{c}
+		fmt.Printf("Character: %s\n", c.Name)
+	}
+
+	messages := sampleConversation
+	if sessionPath != "" {
+		data, err := os.ReadFile(sessionPath)
+		if err != nil {
+			return err
+		}
+		messages = imagechat.ParseJSONLWithOptions(data, cfg.ParseOptions())
+		if len(messages) == 0 {
+			return fmt.Errorf("no conversation messages found in %s", sessionPath)
+		}
+	} else {
+		sessionPath = "sample.jsonl"
+	}
+
+	end := len(messages)
+	if *index >= 0 {
+		if *index >= len(messages) {
+			return fmt.Errorf("-index %d out of range (session has %d messages)", *index, len(messages))
+		}
+		end = *index + 1
+	}
+	n := *count
+	if n <= 0 {
+		n = cfg.RecentMessages
+	}
+	selected := imagechat.TailMessages(messages[:end], n)
+	fmt.Printf("Using messages %d-%d of %d\n", end-len(selected), end-1, len(messages))
+
+	promptGen, err := imagechat.NewPromptGeneratorFromConfig(cfg)
+	if err != nil {
+		return fmt.Errorf("prompt generator error: %w", err)
+	}
+	prompt, err := promptGen.Generate(context.Background(), imagechat.PromptRequest{
+		Messages:    selected,
+		SessionPath: sessionPath,
+		Title:       imagechat.ExtractTitle(messages, 30),
+	})
+	if err != nil {
+		return fmt.Errorf("prompt generation error: %w", err)
+	}
+	fmt.Printf("Prompt: %s\n", prompt)
+
+	imageDir := filepath.Join(".", imagechat.DefaultImageDir)
+	imageGenerators, err := imagechat.NewImageGeneratorsFromConfig(cfg, imageDir)
+	if err != nil {
+		return fmt.Errorf("image generator error: %w", err)
+	}
+	gen := imageGenerators[cfg.ImageGeneratorType]
+	var filename string
+	if og, ok := gen.(interface {
+		GenerateWithOptions(string, imagechat.ImageOptions) (string, error)
+	}); ok && *character != "" {
+		// Render with the image model the character declares, if any.
+		filename, err = og.GenerateWithOptions(prompt, imagechat.ImageOptions{Model: cfg.CharacterImageModel(0)})
+	} else {
+		filename, err = gen.Generate(prompt)
+	}
+	if err != nil {
+		return fmt.Errorf("image generation error: %w", err)
+	}
+	fmt.Printf("Image: %s\n", filepath.Join(imageDir, filename))
+	return nil
+}
+
+// findCharacter returns the loaded character named name, or else loads name
+// as a character file.
+func findCharacter(cfg *imagechat.Config, name string) (imagechat.Character, error) {
+	for _, c := range cfg.Characters {
+		if c.Name == name {
+			return c, nil
+		}
+	}
+	c, err := imagechat.LoadCharacterFile(name)
+	if err != nil {
+		return imagechat.Character{}, fmt.Errorf("character %q: %w", name, err)
+	}
+	return c, nil
+}
+
+// runCharactersCommand prints the characters that would be loaded. Which
+// sessions use them is only known to a running instance, at /api/characters.
+func runCharactersCommand(args []string) error {
+	fs := flag.NewFlagSet("characters", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s characters\n", filepath.Base(os.Args[0]))
+	}
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		fs.Usage()
+		return fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+
+	cfg, err := imagechat.LoadConfig()
+	if err != nil {
+		return fmt.Errorf("config error: %w", err)
+	}
+	if len(cfg.Characters) == 0 {
+		fmt.Printf("No characters loaded from %s\n", cfg.CharactersDir)
+		return nil
+	}
+	return imagechat.WriteCharacterTable(os.Stdout, imagechat.CharacterRoster(cfg, nil))
+}
+
+// runReplayCommand runs the full application, web UI included, but feeds it a
+// saved session file line by line instead of watching the Claude projects
+// directory. Useful for demos and screen recordings.
+func runReplayCommand(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	speed := fs.Float64("speed", 1, "playback speed relative to the original timestamps")
+	delay := fs.Duration("delay", 0, "fixed delay between lines instead of the original timing (e.g. 2s)")
+	maxGap := fs.Duration("max-gap", 10*time.Second, "longest pause between two lines (0 = no limit)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s replay [flags] <session.jsonl>\n", filepath.Base(os.Args[0]))
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("expected exactly one session file")
+	}
+	if *speed <= 0 {
+		return fmt.Errorf("-speed must be positive")
+	}
+	if _, err := os.Stat(fs.Arg(0)); err != nil {
+		return err
+	}
+
+	cfg, err := imagechat.LoadConfig()
+	if err != nil {
+		return fmt.Errorf("config error: %w", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	src := imagechat.NewReplaySource(imagechat.ReplayConfig{
+		Path:   fs.Arg(0),
+		Speed:  *speed,
+		Delay:  *delay,
+		MaxGap: *maxGap,
+		Clock:  cfg.Clock,
+	})
+	return imagechat.RunWithSource(ctx, cfg, src)
+}
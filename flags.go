@@ -0,0 +1,61 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// configFlags maps each command-line flag to the environment variable it
+// overrides. LoadConfig reads the environment, so a flag simply sets its
+// variable before LoadConfig runs.
+var configFlags = []struct {
+	name, env, usage string
+	isBool           bool
+}{
+	{name: "port", env: "SERVER_PORT", usage: "Web UI port"},
+	{name: "generate-interval", env: "GENERATE_INTERVAL", usage: "minimum seconds between image generations"},
+	{name: "prompt-generator", env: "PROMPT_GENERATOR", usage: `prompt generator backend ("gemini", "ollama" or "anthropic")`},
+	{name: "image-generator", env: "IMAGE_GENERATOR", usage: `image generator backend ("sd", "gemini" or "passthrough")`},
+	{name: "sd-url", env: "SD_BASE_URL", usage: "Stable Diffusion WebUI base URL"},
+	{name: "projects-dir", env: "CLAUDE_PROJECTS_DIR", usage: "Claude projects directory to watch"},
+	{name: "characters-dir", env: "CHARACTERS_DIR", usage: "character settings directory (several separated like PATH)"},
+	{name: "style", env: "IMGCHAT_STYLE", usage: "art style preset"},
+	{name: "tail-only", env: "IMGCHAT_TAIL_ONLY", usage: "skip the existing content of session files", isBool: true},
+	{name: "debug", env: "DEBUG", usage: "enable debug logging", isBool: true},
+}
+
+// applyFlags parses the command-line flags and sets the environment variable
+// of every flag that was given, so flags take precedence over the
+// environment and .env.
+func applyFlags(args []string) error {
+	fs := flag.NewFlagSet(filepath.Base(os.Args[0]), flag.ExitOnError)
+	envOf := make(map[string]string, len(configFlags))
+	for _, f := range configFlags {
+		usage := fmt.Sprintf("%s (overrides %s)", f.usage, f.env)
+		if f.isBool {
+			fs.Bool(f.name, false, usage)
+		} else {
+			fs.String(f.name, "", usage)
+		}
+		envOf[f.name] = f.env
+	}
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s [flags]\n       %s <generate|replay> [flags] <session.jsonl>\n       %s characters\n", fs.Name(), fs.Name(), fs.Name())
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		fs.Usage()
+		return fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+
+	var err error
+	fs.Visit(func(fl *flag.Flag) {
+		if setErr := os.Setenv(envOf[fl.Name], fl.Value.String()); setErr != nil && err == nil {
+			err = setErr
+		}
+	})
+	return err
+}
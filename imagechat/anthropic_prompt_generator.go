@@ -0,0 +1,132 @@
+package imagechat
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const (
+	anthropicMessagesURL = "https://api.anthropic.com/v1/messages"
+	anthropicAPIVersion  = "2023-06-01"
+	anthropicMaxTokens   = 1024
+	anthropicTemperature = 0.8
+)
+
+// AnthropicPromptGenerator generates prompts using the Anthropic Messages API.
+type AnthropicPromptGenerator struct {
+	promptGeneratorBase
+	apiKey string
+	model  string
+	cfg    *Config
+}
+
+type anthropicRequest struct {
+	Model       string             `json:"model"`
+	MaxTokens   int                `json:"max_tokens"`
+	System      string             `json:"system,omitempty"`
+	Messages    []anthropicMessage `json:"messages"`
+	Temperature float64            `json:"temperature"`
+}
+
+type anthropicMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type anthropicResponse struct {
+	Content []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	} `json:"content"`
+	StopReason string `json:"stop_reason"`
+}
+
+type anthropicErrorResponse struct {
+	Error struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func NewAnthropicPromptGenerator(apiKey, model string, cfg *Config, characters []Character) *AnthropicPromptGenerator {
+	return &AnthropicPromptGenerator{
+		promptGeneratorBase: newPromptGeneratorBase(cfg, characters),
+		apiKey:              apiKey,
+		model:               model,
+		cfg:                 cfg,
+	}
+}
+
+func (pg *AnthropicPromptGenerator) Generate(ctx context.Context, req PromptRequest) (string, error) {
+	return pg.generateWith(ctx, pg, req)
+}
+
+// complete sends a single system+user prompt pair to the Messages API and
+// returns the text reply.
+func (pg *AnthropicPromptGenerator) complete(ctx context.Context, systemPrompt, userPrompt string) (string, error) {
+	reqBody := anthropicRequest{
+		Model:       pg.model,
+		MaxTokens:   anthropicMaxTokens,
+		System:      systemPrompt,
+		Messages:    []anthropicMessage{{Role: "user", Content: userPrompt}},
+		Temperature: anthropicTemperature,
+	}
+	if pg.cfg != nil && pg.cfg.Reproducible {
+		reqBody.Temperature = 0
+	}
+
+	jsonData, err := json.Marshal(reqBody)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal anthropic request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, anthropicMessagesURL, bytes.NewReader(jsonData))
+	if err != nil {
+		return "", fmt.Errorf("failed to create anthropic request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("x-api-key", pg.apiKey)
+	req.Header.Set("anthropic-version", anthropicAPIVersion)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("anthropic API error: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read anthropic response: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var apiErr anthropicErrorResponse
+		if json.Unmarshal(body, &apiErr) == nil && apiErr.Error.Message != "" {
+			return "", fmt.Errorf("anthropic returned %d (%s): %s", resp.StatusCode, apiErr.Error.Type, apiErr.Error.Message)
+		}
+		return "", fmt.Errorf("anthropic returned %d: %s", resp.StatusCode, string(body))
+	}
+
+	var result anthropicResponse
+	if err := json.Unmarshal(body, &result); err != nil {
+		return "", fmt.Errorf("failed to decode anthropic response: %w", err)
+	}
+
+	var parts []string
+	for _, c := range result.Content {
+		if c.Type == "text" {
+			parts = append(parts, c.Text)
+		}
+	}
+	text := strings.TrimSpace(strings.Join(parts, ""))
+	if text == "" {
+		return "", fmt.Errorf("empty response from anthropic (stop reason: %s)", result.StopReason)
+	}
+
+	return text, nil
+}
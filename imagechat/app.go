@@ -0,0 +1,347 @@
+package imagechat
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Run starts the full application described by cfg — watcher, prompt and
+// image generators, pipeline and web server — and blocks until ctx is
+// cancelled and everything has shut down.
+func Run(ctx context.Context, cfg *Config) error {
+	return RunWithSource(ctx, cfg, nil)
+}
+
+// RunWithSource is like Run but takes session events from src instead of
+// watching cfg.ClaudeProjectDir (e.g. a ReplaySource). A nil src watches the
+// directory as Run does.
+func RunWithSource(ctx context.Context, cfg *Config, src EventSource) error {
+	// Before anything else logs, so the generators' setup respects the level.
+	InitLogger(cfg.LogLevel)
+
+	imageDir := filepath.Join(".", DefaultImageDir)
+
+	promptGen, err := NewPromptGeneratorFromConfig(cfg)
+	if err != nil {
+		return fmt.Errorf("prompt generator error: %w", err)
+	}
+
+	var summarizer *Summarizer
+	if cfg.UseSummary {
+		summarizer, err = NewSummarizer(promptGen)
+		if err != nil {
+			return fmt.Errorf("summarizer error: %w", err)
+		}
+		summarizer.SetMaxMessageChars(cfg.MaxMessageChars)
+	}
+
+	// Create both image generators upfront so we can switch at runtime.
+	imageGenerators, err := NewImageGeneratorsFromConfig(cfg, imageDir)
+	if err != nil {
+		return fmt.Errorf("image generator error: %w", err)
+	}
+
+	done := make(chan struct{})
+
+	srv := NewServer(cfg.ServerPort, imageDir, cfg, done)
+	for _, gen := range imageGenerators {
+		if c, ok := gen.(interface{ SetCleanupHandler(func([]string)) }); ok {
+			c.SetCleanupHandler(srv.ImagesRemoved)
+		}
+	}
+
+	// Wrap backends in circuit breakers so a failing backend is paused
+	// instead of being retried on every message.
+	if cfg.BreakerThreshold > 0 {
+		var breakers []*CircuitBreaker
+		newBreaker := func(name string) *CircuitBreaker {
+			cb := NewCircuitBreaker(name, cfg.BreakerThreshold, cfg.BreakerCooldown, func(name string, state breakerState) {
+				srv.BroadcastNotice(breakerNotice(name, state))
+			})
+			breakers = append(breakers, cb)
+			return cb
+		}
+		promptGen = &breakerPromptGenerator{PromptGenerator: promptGen, cb: newBreaker("prompt generator (" + cfg.PromptGeneratorType + ")")}
+		for name, gen := range imageGenerators {
+			imageGenerators[name] = &breakerImageGenerator{ImageGenerator: gen, cb: newBreaker("image generator (" + name + ")")}
+		}
+		srv.RegisterDebugInfo("breakers", func() any {
+			statuses := make([]BreakerStatus, len(breakers))
+			for i, cb := range breakers {
+				statuses[i] = cb.Status()
+			}
+			return statuses
+		})
+	}
+
+	// Pause generation instead of failing every time when the image
+	// directory is full or read-only.
+	diskGuard := NewDiskGuard(imageDir, cfg.MinFreeDiskMB, func(paused bool, reason string) {
+		srv.BroadcastNotice(diskNotice(paused, reason))
+	})
+	for name, gen := range imageGenerators {
+		imageGenerators[name] = diskGuard.Wrap(gen)
+	}
+
+	backends := NewImageBackendSelector(cfg, imageGenerators)
+	srv.SetImageBackends(backends)
+
+	source := "Watching: " + cfg.ClaudeProjectDir
+	if src == nil {
+		watcher := NewWatcher(WatcherConfig{
+			Dir:             cfg.ClaudeProjectDir,
+			Debounce:        cfg.DebounceInterval,
+			OffsetStatePath: cfg.OffsetStatePath,
+			Clock:           cfg.timerClock(),
+			TailOnly:        cfg.TailOnly,
+			EventBuffer:     cfg.WatcherEventBuffer,
+		})
+		srv.RegisterDebugInfo("watcher", func() any {
+			return watcher.DebugInfo()
+		})
+		src = watcher
+	} else if rs, ok := src.(*ReplaySource); ok {
+		source = "Replaying: " + rs.cfg.Path
+	}
+
+	var approvals *PromptApprovals
+	if cfg.PromptApproval {
+		approvals = NewPromptApprovals()
+		srv.SetPromptApprovals(approvals)
+	}
+
+	status := NewStatusTracker(cfg)
+	srv.SetStatus(status)
+	srv.SetCharacterRoster(func() []CharacterInfo {
+		return CharacterRoster(cfg, promptGen)
+	})
+	srv.SetCharacterLocker(func(sessionID, character string) (string, error) {
+		return LockCharacter(cfg, promptGen, sessionID, character)
+	})
+
+	hasClients := srv.HasClients
+	if !cfg.RequireClients {
+		hasClients = nil // generate even with no browser connected
+	}
+
+	broadcast := srv.BroadcastSessionImage
+	if webhook := NewWebhook(cfg); webhook != nil {
+		broadcast = func(si SessionImage) {
+			srv.BroadcastSessionImage(si)
+			webhook.Notify(si)
+		}
+	}
+
+	pipeline := NewPipeline(PipelineConfig{
+		Config:         cfg,
+		Events:         src.Events(),
+		PromptGen:      promptGen,
+		Summarizer:     summarizer,
+		Backends:       backends,
+		HasClients:     hasClients,
+		Broadcast:      broadcast,
+		Clock:          cfg.timerClock(),
+		Approvals:      approvals,
+		AnnouncePrompt: srv.BroadcastPromptApproval,
+		AnnounceIdle:   srv.BroadcastIdle,
+		Status:         status,
+	})
+	srv.SetRegenerator(pipeline.RegenerateLast)
+	if cfg.FocusMode {
+		srv.SetFocusPinner(pipeline.PinFocus)
+	}
+	srv.RegisterDebugInfo("queue", func() any {
+		return pipeline.QueueStats()
+	})
+
+	var wg sync.WaitGroup
+
+	// File watcher (or replay) goroutine
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := src.Run(done); err != nil {
+			Errorf("watcher error: %v", err)
+		}
+	}()
+
+	// Prompt → image → broadcast pipeline
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		pipeline.Run(ctx)
+	}()
+
+	// Periodic stats summary
+	if cfg.StatsInterval > 0 {
+		start := time.Now()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ticker := time.NewTicker(cfg.StatsInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					prompts, images, errs := status.Totals()
+					Infof("stats: uptime %s, %d image(s), %d prompt(s), %d error(s), %d active session(s), %d client(s)",
+						time.Since(start).Round(time.Second), images, prompts, errs,
+						pipeline.ActiveSessions(cfg.CharacterActiveWindow), srv.ClientCount())
+				}
+			}
+		}()
+	}
+
+	// Periodic contact sheet of the newest images
+	if cfg.ContactSheetInterval > 0 {
+		var announce func(string)
+		if cfg.ContactSheetBroadcast {
+			announce = func(filename string) {
+				srv.BroadcastNotice("Contact sheet saved: /images/" + filename)
+			}
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runContactSheets(cfg, imageDir, diskGuard, done, announce)
+		}()
+	}
+
+	// HTTP server goroutine
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := srv.Start(); err != nil {
+			Errorf("server error: %v", err)
+		}
+	}()
+
+	logBanner(cfg, source, imageDir)
+
+	<-ctx.Done()
+	Infof("shutting down...")
+	close(done)
+	wg.Wait()
+	return nil
+}
+
+// logBanner logs the startup banner: where sessions come from and the
+// settings that differ from a plain run.
+func logBanner(cfg *Config, source, imageDir string) {
+	Infof("Claude Code Image Chat started")
+	Infof("  Web UI: http://localhost:%s%s/", cfg.ServerPort, cfg.BasePath)
+	Infof("  %s", source)
+	Infof("  Generate interval: %s", cfg.GenerateInterval)
+	if cfg.PromptInterval > 0 {
+		Infof("  Prompt interval: %s", cfg.PromptInterval)
+	}
+	if cfg.ImageInterval > 0 {
+		Infof("  Image interval: %s", cfg.ImageInterval)
+	}
+	Infof("  Characters: %s", characterSummary(cfg))
+	if len(cfg.StyleModifiers) > 0 {
+		names := make([]string, len(cfg.StyleModifiers))
+		for i, m := range cfg.StyleModifiers {
+			names[i] = m.Name
+		}
+		Infof("  Style modifiers: %s", strings.Join(names, ", "))
+	}
+	if cfg.CharacterMode == CharacterModeRotate && len(cfg.Characters) > 1 {
+		Infof("  Character mode: rotate (next character on every image)")
+	}
+	if cfg.ContextRole == ContextRoleUser {
+		Infof("  Context: user messages only")
+	}
+	if cfg.UseSummary {
+		Infof("  Rolling summary: enabled")
+	}
+	if cfg.PromptDedupThreshold > 0 {
+		Infof("  Prompt dedup: regenerate at %.0f%% overlap with the last %d prompts", cfg.PromptDedupThreshold*100, cfg.PromptDedupWindow)
+	}
+	if cfg.IdleTimeout > 0 {
+		Infof("  Idle timeout: %s", cfg.IdleTimeout)
+	}
+	if cfg.WaitTurnComplete {
+		Infof("  Wait for turn end: on (quiet period %s)", cfg.TurnQuietPeriod)
+	}
+	if cfg.FocusMode {
+		Infof("  Focus mode: switch after %s without messages", cfg.FocusSwitchAfter)
+	}
+	if cfg.ScheduleInterval > 0 {
+		Infof("  Scheduled generation: every %s", cfg.ScheduleInterval)
+	}
+	if cfg.PromptApproval {
+		Infof("  Prompt approval: enabled (auto-approve after %s)", cfg.PromptApprovalTimeout)
+	}
+	if cfg.StyleName != "" {
+		Infof("  Style: %s", cfg.StyleName)
+	}
+	if cfg.StatsInterval > 0 {
+		Infof("  Stats log: every %s", cfg.StatsInterval)
+	}
+	if cfg.ContactSheetInterval > 0 {
+		Infof("  Contact sheet: %dx%d every %s", cfg.ContactSheetCols, cfg.ContactSheetRows, cfg.ContactSheetInterval)
+	}
+	if cfg.WebhookURL != "" {
+		Infof("  Webhook: enabled")
+	}
+	if !cfg.RequireClients {
+		Infof("  Require clients: off (generating with no browser connected)")
+	}
+	if cfg.KeepAllImages {
+		Infof("  Image cleanup: off (%s grows without limit)", imageDir)
+	}
+	if cfg.Reproducible {
+		Infof("  Reproducible mode: enabled (seed: %d)", cfg.Seed)
+	}
+
+	// Log prompt generator info
+	switch cfg.PromptGeneratorType {
+	case "ollama":
+		Infof("  Prompt generator: ollama (model: %s, url: %s)", cfg.OllamaModel, cfg.OllamaBaseURL)
+	case "anthropic":
+		Infof("  Prompt generator: anthropic (model: %s)", cfg.AnthropicModel)
+	default:
+		Infof("  Prompt generator: gemini (model: %s)", cfg.GeminiModel)
+	}
+
+	// Log image generator info
+	switch cfg.ImageGeneratorType {
+	case "gemini":
+		Infof("  Image generator: gemini (model: %s)", cfg.GeminiImageModel)
+	case "passthrough":
+		Infof("  Image generator: passthrough (copying from %s, %s)", cfg.PassthroughDir, cfg.PassthroughMode)
+	default:
+		Infof("  Image generator: sd (url: %s)", cfg.SDBaseURL)
+		if cfg.SDHiresEnabled {
+			Infof("  SD hires fix: scale %.2f, upscaler %s, denoising %.2f", cfg.SDHiresScale, cfg.SDHiresUpscaler, cfg.SDHiresDenoising)
+		}
+	}
+	for _, r := range cfg.BackendRoutes {
+		Infof("  Image generator route: %s* -> %s", r.Prefix, r.Backend)
+	}
+	if cfg.GeminiBackend == GeminiBackendVertex && (cfg.PromptGeneratorType == "gemini" || cfg.ImageGeneratorType == "gemini") {
+		Infof("  Gemini backend: Vertex AI (project: %s, location: %s)", cfg.GoogleCloudProject, cfg.GoogleCloudLocation)
+	}
+}
+
+// characterSummary describes how many characters were loaded and from where.
+func characterSummary(cfg *Config) string {
+	switch {
+	case len(cfg.Characters) == 0:
+		return fmt.Sprintf("none loaded from %s (using a generic character)", cfg.CharactersDir)
+	case cfg.CharacterFile != "":
+		return fmt.Sprintf("1 loaded from %s", cfg.CharacterFile)
+	}
+	names := make([]string, len(cfg.Characters))
+	for i, c := range cfg.Characters {
+		names[i] = c.Name
+	}
+	return fmt.Sprintf("%d loaded from %s (%s)", len(cfg.Characters), cfg.CharactersDir, strings.Join(names, ", "))
+}
@@ -0,0 +1,51 @@
+package imagechat
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+)
+
+// captureLog returns what fn logs.
+func captureLog(t *testing.T, fn func()) string {
+	t.Helper()
+	var buf bytes.Buffer
+	w, flags := log.Writer(), log.Flags()
+	log.SetOutput(&buf)
+	log.SetFlags(0)
+	t.Cleanup(func() {
+		log.SetOutput(w)
+		log.SetFlags(flags)
+	})
+	fn()
+	return buf.String()
+}
+
+func TestLogBannerContextRole(t *testing.T) {
+	tests := []struct {
+		role string
+		want bool
+	}{
+		{ContextRoleAll, false},
+		{ContextRoleUser, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.role, func(t *testing.T) {
+			cfg := &Config{ContextRole: tt.role}
+			out := captureLog(t, func() { logBanner(cfg, "Watching: /projects", "images") })
+
+			lines := strings.Split(strings.TrimSpace(out), "\n")
+			if lines[0] != "Claude Code Image Chat started" {
+				t.Fatalf("banner starts with %q", lines[0])
+			}
+			i := strings.Index(out, "  Context: user messages only\n")
+			if got := i >= 0; got != tt.want {
+				t.Fatalf("context line logged = %v, want %v:\n%s", got, tt.want, out)
+			}
+			if tt.want && i < strings.Index(out, "  Characters: ") {
+				t.Errorf("context line logged before the other settings:\n%s", out)
+			}
+		})
+	}
+}
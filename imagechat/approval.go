@@ -0,0 +1,75 @@
+package imagechat
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+)
+
+// Prompt approval states reported to clients.
+const (
+	approvalPending  = "pending"
+	approvalApproved = "approved"
+	approvalRejected = "rejected"
+	approvalExpired  = "auto-approved"
+)
+
+// PromptApproval describes a generated prompt awaiting (or resolved from)
+// user approval before its image is generated.
+type PromptApproval struct {
+	ID        string `json:"id"`
+	State     string `json:"state"`
+	Prompt    string `json:"prompt"`
+	SessionID string `json:"sessionId"`
+	Title     string `json:"title"`
+}
+
+// approvalDecision is a user's answer to a pending prompt. Prompt, if not
+// empty, replaces the generated prompt.
+type approvalDecision struct {
+	approved bool
+	prompt   string
+}
+
+// PromptApprovals tracks prompts waiting for user approval.
+type PromptApprovals struct {
+	mu      sync.Mutex
+	nextID  uint64
+	pending map[string]chan approvalDecision
+}
+
+func NewPromptApprovals() *PromptApprovals {
+	return &PromptApprovals{pending: make(map[string]chan approvalDecision)}
+}
+
+// add registers a new pending prompt and returns its ID and decision channel.
+func (a *PromptApprovals) add() (string, <-chan approvalDecision) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.nextID++
+	id := strconv.FormatUint(a.nextID, 10)
+	ch := make(chan approvalDecision, 1)
+	a.pending[id] = ch
+	return id, ch
+}
+
+// remove forgets a pending prompt once it is resolved.
+func (a *PromptApprovals) remove(id string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.pending, id)
+}
+
+// Decide resolves a pending prompt. editedPrompt, if not empty, replaces the
+// generated prompt.
+func (a *PromptApprovals) Decide(id string, approved bool, editedPrompt string) error {
+	a.mu.Lock()
+	ch, ok := a.pending[id]
+	delete(a.pending, id)
+	a.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("prompt %q is not awaiting approval", id)
+	}
+	ch <- approvalDecision{approved: approved, prompt: editedPrompt}
+	return nil
+}
@@ -0,0 +1,95 @@
+package imagechat
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ImageBackendSelector picks the image generator to use for each generation.
+// The global choice lives in Config (so /api/config reflects it); sessions
+// matching one of Config.BackendRoutes use that route's backend instead, and
+// individual sessions can override both at runtime.
+type ImageBackendSelector struct {
+	cfg        *Config
+	generators map[string]ImageGenerator
+
+	mu        sync.RWMutex
+	overrides map[string]string // sessionID -> backend
+}
+
+func NewImageBackendSelector(cfg *Config, generators map[string]ImageGenerator) *ImageBackendSelector {
+	return &ImageBackendSelector{
+		cfg:        cfg,
+		generators: generators,
+		overrides:  make(map[string]string),
+	}
+}
+
+// Available returns the names of the initialized backends, sorted.
+func (s *ImageBackendSelector) Available() []string {
+	names := make([]string, 0, len(s.generators))
+	for name := range s.generators {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Validate returns an error if the named backend was not initialized.
+func (s *ImageBackendSelector) Validate(backend string) error {
+	if _, ok := s.generators[backend]; !ok {
+		return fmt.Errorf("image generator %q is not available (available: %s)", backend, strings.Join(s.Available(), ", "))
+	}
+	return nil
+}
+
+// Set selects the backend for a session, or globally when sessionID is empty.
+// Setting a session to an empty backend clears its override.
+func (s *ImageBackendSelector) Set(sessionID, backend string) error {
+	if sessionID != "" && backend == "" {
+		s.mu.Lock()
+		delete(s.overrides, sessionID)
+		s.mu.Unlock()
+		return nil
+	}
+	if err := s.Validate(backend); err != nil {
+		return err
+	}
+	if sessionID == "" {
+		s.cfg.SetImageGeneratorType(backend)
+		return nil
+	}
+	s.mu.Lock()
+	s.overrides[sessionID] = backend
+	s.mu.Unlock()
+	return nil
+}
+
+// Select returns the backend name and generator to use for a session of the
+// given project.
+func (s *ImageBackendSelector) Select(sessionID, project string) (string, ImageGenerator, bool) {
+	s.mu.RLock()
+	name, ok := s.overrides[sessionID]
+	s.mu.RUnlock()
+	if !ok {
+		name, ok = routeBackend(s.cfg.BackendRoutes, sessionID, project)
+	}
+	if !ok {
+		name = s.cfg.GetImageGeneratorType()
+	}
+	gen, exists := s.generators[name]
+	return name, gen, exists
+}
+
+// routeBackend returns the backend of the first route whose prefix starts
+// the project name or the session ID.
+func routeBackend(routes []BackendRoute, sessionID, project string) (string, bool) {
+	for _, r := range routes {
+		if (project != "" && strings.HasPrefix(project, r.Prefix)) || strings.HasPrefix(sessionID, r.Prefix) {
+			return r.Backend, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,118 @@
+package imagechat
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// DefaultImageDir is the directory generated images are written to.
+const DefaultImageDir = "generated_images"
+
+// NewPromptGeneratorFromConfig constructs the prompt generator selected by cfg.
+func NewPromptGeneratorFromConfig(cfg *Config) (PromptGenerator, error) {
+	switch cfg.PromptGeneratorType {
+	case "ollama":
+		ollamaGen := NewOllamaPromptGenerator(cfg.OllamaBaseURL, cfg, cfg.Characters)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := ollamaGen.CheckConnection(ctx); err != nil {
+			Warnf("warning: Ollama connectivity check failed: %v", err)
+		}
+		return ollamaGen, nil
+	case "anthropic":
+		return NewAnthropicPromptGenerator(cfg.AnthropicAPIKey, cfg.AnthropicModel, cfg, cfg.Characters), nil
+	default:
+		return NewGeminiPromptGenerator(cfg.GeminiAPIKey, cfg.GeminiModel, cfg, cfg.Characters)
+	}
+}
+
+// NewImageGeneratorsFromConfig constructs every image generator that can be initialized
+// with the current configuration, keyed by generator type. It returns an error
+// only if the generator selected by cfg, or one IMGCHAT_BACKEND_ROUTES sends
+// sessions to, cannot be created.
+func NewImageGeneratorsFromConfig(cfg *Config, imageDir string) (map[string]ImageGenerator, error) {
+	imageGenerators := make(map[string]ImageGenerator)
+	required := func(name string) bool {
+		return cfg.ImageGeneratorType == name || slices.ContainsFunc(cfg.BackendRoutes, func(r BackendRoute) bool { return r.Backend == name })
+	}
+
+	sdGen, sdErr := NewSDImageGenerator(SDImageGeneratorConfig{
+		Cfg:            cfg,
+		OutputDir:      imageDir,
+		Steps:          cfg.SDSteps,
+		Width:          cfg.SDWidth,
+		Height:         cfg.SDHeight,
+		CfgScale:       cfg.SDCfgScale,
+		SamplerName:    cfg.SDSamplerName,
+		Scheduler:      cfg.SDScheduler,
+		ExtraPrompt:    joinPromptParts(cfg.StyleTags, cfg.SDExtraPrompt),
+		ExtraNegPrompt: cfg.SDExtraNegPrompt,
+		Hires: SDHiresConfig{
+			Enabled:   cfg.SDHiresEnabled,
+			Scale:     cfg.SDHiresScale,
+			Upscaler:  cfg.SDHiresUpscaler,
+			Denoising: cfg.SDHiresDenoising,
+		},
+		RestoreFaces:    cfg.SDRestoreFaces,
+		ADetailerModel:  cfg.SDADetailerModel,
+		MaxPromptTokens: cfg.SDMaxPromptTokens,
+	})
+	if sdErr != nil {
+		if required("sd") {
+			return nil, sdErr
+		}
+		Warnf("warning: could not initialize SD image generator: %v", sdErr)
+	} else {
+		imageGenerators["sd"] = sdGen
+		if cfg.SDInheritDefaults {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			sdGen.inheritServerDefaults(ctx)
+			cancel()
+		}
+		if required("sd") {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			if connErr := sdGen.CheckConnection(ctx); connErr != nil {
+				Warnf("warning: Stable Diffusion connectivity check failed: %v", connErr)
+			}
+			cancel()
+		}
+	}
+
+	geminiImgGen, geminiErr := NewGeminiImageGenerator(GeminiImageGeneratorConfig{
+		APIKey:    cfg.GeminiAPIKey,
+		Cfg:       cfg,
+		OutputDir: imageDir,
+	})
+	if geminiErr != nil {
+		if required("gemini") {
+			return nil, geminiErr
+		}
+		Warnf("warning: could not initialize Gemini image generator: %v", geminiErr)
+	} else {
+		imageGenerators["gemini"] = geminiImgGen
+	}
+
+	if cfg.PassthroughDir != "" {
+		passthroughGen, err := NewPassthroughImageGenerator(PassthroughImageGeneratorConfig{
+			Cfg:       cfg,
+			SourceDir: cfg.PassthroughDir,
+			OutputDir: imageDir,
+			Mode:      cfg.PassthroughMode,
+		})
+		if err != nil {
+			if required("passthrough") {
+				return nil, err
+			}
+			Warnf("warning: could not initialize passthrough image generator: %v", err)
+		} else {
+			imageGenerators["passthrough"] = passthroughGen
+		}
+	}
+
+	if _, ok := imageGenerators[cfg.ImageGeneratorType]; !ok {
+		return nil, fmt.Errorf("image generator %q is not available", cfg.ImageGeneratorType)
+	}
+	return imageGenerators, nil
+}
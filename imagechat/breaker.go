@@ -0,0 +1,194 @@
+package imagechat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// errBackendCoolingDown is returned by a breaker-wrapped backend while its
+// circuit is open. Callers should treat it as a skip rather than a failure.
+var errBackendCoolingDown = errors.New("backend is cooling down after repeated errors")
+
+type breakerState string
+
+const (
+	breakerClosed   breakerState = "closed"
+	breakerOpen     breakerState = "open"
+	breakerHalfOpen breakerState = "half-open"
+)
+
+// BreakerStatus is a snapshot of a CircuitBreaker for diagnostics.
+type BreakerStatus struct {
+	Name                string `json:"name"`
+	State               string `json:"state"`
+	ConsecutiveFailures int    `json:"consecutive_failures"`
+	OpenUntil           string `json:"open_until,omitempty"`
+}
+
+// CircuitBreaker pauses calls to a backend after a number of consecutive
+// failures. Once the cool-down elapses, a single probe call is let through;
+// success closes the circuit again, failure re-opens it.
+type CircuitBreaker struct {
+	name      string
+	threshold int
+	cooldown  time.Duration
+	// onChange is called (outside the lock) whenever the breaker opens or closes.
+	onChange func(name string, state breakerState)
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func NewCircuitBreaker(name string, threshold int, cooldown time.Duration, onChange func(string, breakerState)) *CircuitBreaker {
+	return &CircuitBreaker{
+		name:      name,
+		threshold: threshold,
+		cooldown:  cooldown,
+		onChange:  onChange,
+		state:     breakerClosed,
+	}
+}
+
+// Allow reports whether a call may proceed.
+func (cb *CircuitBreaker) Allow() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case breakerOpen:
+		if time.Since(cb.openedAt) < cb.cooldown {
+			return false
+		}
+		cb.state = breakerHalfOpen
+		cb.probing = true
+		Infof("%s: cool-down elapsed, probing backend", cb.name)
+		return true
+	case breakerHalfOpen:
+		// Only one probe at a time.
+		if cb.probing {
+			return false
+		}
+		cb.probing = true
+		return true
+	default:
+		return true
+	}
+}
+
+// Record reports the outcome of a call that Allow let through.
+func (cb *CircuitBreaker) Record(err error) {
+	cb.mu.Lock()
+	prev := cb.state
+	cb.probing = false
+	if err == nil {
+		cb.failures = 0
+		cb.state = breakerClosed
+	} else {
+		cb.failures++
+		if cb.state == breakerHalfOpen || cb.failures >= cb.threshold {
+			cb.state = breakerOpen
+			cb.openedAt = time.Now()
+		}
+	}
+	next := cb.state
+	failures := cb.failures
+	cb.mu.Unlock()
+
+	if next == breakerOpen && prev != breakerOpen {
+		Warnf("warning: %s: %d consecutive failure(s), pausing for %s", cb.name, failures, cb.cooldown)
+	}
+	if next == breakerClosed && prev != breakerClosed {
+		Infof("%s: backend recovered, resuming", cb.name)
+	}
+	if cb.onChange != nil && next != prev && next != breakerHalfOpen {
+		cb.onChange(cb.name, next)
+	}
+}
+
+// Status returns a snapshot of the breaker state.
+func (cb *CircuitBreaker) Status() BreakerStatus {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	st := BreakerStatus{
+		Name:                cb.name,
+		State:               string(cb.state),
+		ConsecutiveFailures: cb.failures,
+	}
+	if cb.state == breakerOpen {
+		st.OpenUntil = cb.openedAt.Add(cb.cooldown).Format(time.RFC3339)
+	}
+	return st
+}
+
+// breakerImageGenerator guards an ImageGenerator with a CircuitBreaker.
+type breakerImageGenerator struct {
+	ImageGenerator
+	cb *CircuitBreaker
+}
+
+func (g *breakerImageGenerator) Generate(prompt string) (string, error) {
+	return g.GenerateWithOptions(prompt, ImageOptions{})
+}
+
+func (g *breakerImageGenerator) GenerateWithOptions(prompt string, opts ImageOptions) (string, error) {
+	if !g.cb.Allow() {
+		return "", errBackendCoolingDown
+	}
+	filename, err := generateImage(g.ImageGenerator, prompt, opts)
+	if err == nil && filename == "" {
+		// Skipped because another generation was in flight; says nothing
+		// about backend health. Release the probe slot if we held it.
+		g.cb.mu.Lock()
+		g.cb.probing = false
+		g.cb.mu.Unlock()
+		return filename, nil
+	}
+	g.cb.Record(err)
+	return filename, err
+}
+
+// breakerPromptGenerator guards a PromptGenerator with a CircuitBreaker.
+type breakerPromptGenerator struct {
+	PromptGenerator
+	cb *CircuitBreaker
+}
+
+func (g *breakerPromptGenerator) Generate(ctx context.Context, req PromptRequest) (string, error) {
+	if !g.cb.Allow() {
+		return "", errBackendCoolingDown
+	}
+	prompt, err := g.PromptGenerator.Generate(ctx, req)
+	g.cb.Record(err)
+	return prompt, err
+}
+
+func (g *breakerPromptGenerator) characterIndexFor(sessionPath string) int {
+	return characterIndexFor(g.PromptGenerator, sessionPath)
+}
+
+func (g *breakerPromptGenerator) activeAssignments() map[int][]string {
+	if l, ok := g.PromptGenerator.(characterAssignmentLister); ok {
+		return l.activeAssignments()
+	}
+	return nil
+}
+
+func (g *breakerPromptGenerator) lockCharacter(sessionID string, idx int) {
+	if l, ok := g.PromptGenerator.(characterLocker); ok {
+		l.lockCharacter(sessionID, idx)
+	}
+}
+
+// breakerNotice returns the user-facing notice for a breaker state change.
+func breakerNotice(name string, state breakerState) string {
+	if state == breakerOpen {
+		return fmt.Sprintf("%s is failing repeatedly; pausing generation for a while", name)
+	}
+	return fmt.Sprintf("%s recovered; generation resumed", name)
+}
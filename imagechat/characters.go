@@ -0,0 +1,117 @@
+package imagechat
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+)
+
+// maxCharacterDescriptionLen caps the description shown for a character.
+const maxCharacterDescriptionLen = 60
+
+// CharacterInfo describes a loaded character, as listed at /api/characters
+// and by the "characters" command.
+type CharacterInfo struct {
+	Name string `json:"name"`
+	// File is the character file it was loaded from.
+	File string `json:"file,omitempty"`
+	// Description is the first line of the character setting.
+	Description string `json:"description"`
+	ImageModel  string `json:"imageModel,omitempty"`
+	// Sessions are the IDs of the active sessions assigned the character.
+	Sessions []string `json:"sessions"`
+}
+
+// characterAssignmentLister is implemented by prompt generators that assign
+// characters to sessions, and by wrappers around them.
+type characterAssignmentLister interface {
+	// activeAssignments returns the IDs of the sessions active within
+	// CharacterActiveWindow, keyed by character index.
+	activeAssignments() map[int][]string
+}
+
+// characterLocker is implemented by prompt generators that let the user lock
+// a character to a session, and by wrappers around them.
+type characterLocker interface {
+	lockCharacter(sessionID string, idx int)
+}
+
+// LockCharacter makes pg draw a session with the named character (matched
+// case-insensitively) for the rest of the run, or removes the session's lock
+// if name is empty. It returns the character's name as configured.
+func LockCharacter(cfg *Config, pg PromptGenerator, sessionID, name string) (string, error) {
+	l, ok := pg.(characterLocker)
+	if !ok || len(cfg.Characters) == 0 {
+		return "", errors.New("no characters are configured")
+	}
+	if sessionID == "" {
+		return "", errors.New("select a session to lock its character")
+	}
+	if name == "" {
+		l.lockCharacter(sessionID, -1)
+		return "", nil
+	}
+	for i, c := range cfg.Characters {
+		if strings.EqualFold(c.Name, name) {
+			l.lockCharacter(sessionID, i)
+			return c.Name, nil
+		}
+	}
+	return "", fmt.Errorf("unknown character %q", name)
+}
+
+// CharacterRoster lists cfg's characters with the sessions pg currently
+// assigns to each. pg may be nil, or a generator that does not assign
+// characters, to list the characters alone.
+func CharacterRoster(cfg *Config, pg PromptGenerator) []CharacterInfo {
+	var assigned map[int][]string
+	if l, ok := pg.(characterAssignmentLister); ok {
+		assigned = l.activeAssignments()
+	}
+	roster := make([]CharacterInfo, len(cfg.Characters))
+	for i, c := range cfg.Characters {
+		sessions := assigned[i]
+		if sessions == nil {
+			sessions = []string{}
+		}
+		roster[i] = CharacterInfo{
+			Name:        c.Name,
+			File:        c.Path,
+			Description: characterDescription(c.Setting),
+			ImageModel:  c.ImageModel,
+			Sessions:    sessions,
+		}
+	}
+	return roster
+}
+
+// characterDescription returns the first non-empty line of a character
+// setting, without list or heading markers.
+func characterDescription(setting string) string {
+	for _, line := range strings.Split(setting, "\n") {
+		line = strings.TrimSpace(strings.TrimLeft(strings.TrimSpace(line), "#-*"))
+		if line != "" {
+			return truncateRunes(line, maxCharacterDescriptionLen)
+		}
+	}
+	return ""
+}
+
+// WriteCharacterTable writes roster to w as an aligned text table.
+func WriteCharacterTable(w io.Writer, roster []CharacterInfo) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tFILE\tIMAGE MODEL\tSESSIONS\tDESCRIPTION")
+	for _, c := range roster {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", c.Name, orDash(c.File), orDash(c.ImageModel), orDash(strings.Join(c.Sessions, ",")), c.Description)
+	}
+	return tw.Flush()
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,54 @@
+package imagechat
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock abstracts the current time and timer scheduling so time-dependent
+// behavior (rate limiting, debouncing, filenames) can be made deterministic.
+type Clock interface {
+	Now() time.Time
+	// AfterFunc calls f in its own goroutine after d has elapsed.
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a pending AfterFunc call. *time.Timer satisfies it.
+type Timer interface {
+	Stop() bool
+}
+
+// realClock is the wall clock.
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer { return time.AfterFunc(d, f) }
+
+// steppingClock returns a fixed start time on the first call and advances by
+// step on every subsequent call, giving reproducible yet unique timestamps.
+type steppingClock struct {
+	mu   sync.Mutex
+	next time.Time
+	step time.Duration
+}
+
+func newSteppingClock(start time.Time, step time.Duration) *steppingClock {
+	return &steppingClock{next: start, step: step}
+}
+
+func (c *steppingClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := c.next
+	c.next = c.next.Add(c.step)
+	return t
+}
+
+// AfterFunc schedules f on the wall clock; only Now is made deterministic.
+func (c *steppingClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+// reproducibleEpoch is the start time of the clock used in reproducible mode.
+var reproducibleEpoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
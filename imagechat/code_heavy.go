@@ -0,0 +1,97 @@
+package imagechat
+
+import (
+	"strings"
+	"unicode"
+)
+
+// How to handle assistant messages that are essentially all code or diff.
+const (
+	CodeHeavyOff      = "off"      // generate as usual
+	CodeHeavySkip     = "skip"     // don't generate an image for them
+	CodeHeavyAbstract = "abstract" // ask for a more abstract illustration
+)
+
+// abstractSceneGuidance is added to the prompt request for code-heavy
+// messages in CodeHeavyAbstract mode.
+const abstractSceneGuidance = "The latest assistant message is mostly code, so don't try to depict its content literally. Show the character immersed in focused work, in an abstract or symbolic scene."
+
+// Thresholds for isCodeHeavy.
+const (
+	codeHeavyMaxSentences = 2   // at most this many prose sentences
+	codeHeavyMinRatio     = 0.7 // at least this share of the text is code
+)
+
+// isCodeHeavy reports whether text is essentially all code or diff: at least
+// codeHeavyMinRatio of its non-blank characters are in fenced code blocks or
+// on lines that look like code or diff, and it has no more than
+// codeHeavyMaxSentences prose sentences.
+func isCodeHeavy(text string) bool {
+	codeChars, proseChars, sentences := 0, 0, 0
+	inFence := false
+	for _, line := range strings.Split(text, "\n") {
+		t := strings.TrimSpace(line)
+		if strings.HasPrefix(t, "```") || strings.HasPrefix(t, "~~~") {
+			inFence = !inFence
+			continue
+		}
+		if t == "" {
+			continue
+		}
+		if inFence || looksLikeCode(line) {
+			codeChars += len(t)
+			continue
+		}
+		proseChars += len(t)
+		sentences += countSentences(t)
+	}
+	if codeChars == 0 || sentences > codeHeavyMaxSentences {
+		return false
+	}
+	return float64(codeChars) >= codeHeavyMinRatio*float64(codeChars+proseChars)
+}
+
+// looksLikeCode reports whether a line outside a code fence looks like code
+// or a unified diff rather than prose.
+func looksLikeCode(line string) bool {
+	if strings.HasPrefix(line, "\t") || strings.HasPrefix(line, "    ") {
+		return true
+	}
+	t := strings.TrimSpace(line)
+	for _, p := range []string{"diff --git ", "index ", "--- ", "+++ ", "@@ "} {
+		if strings.HasPrefix(t, p) {
+			return true
+		}
+	}
+	// Diff lines have no space after the marker, unlike "- " list items.
+	if len(t) > 1 && (t[0] == '+' || t[0] == '-') && t[1] != ' ' {
+		return true
+	}
+	switch t[len(t)-1] {
+	case '{', '}', ';', '(', ')', '[', ']', ',':
+		return true
+	}
+	return false
+}
+
+// countSentences roughly counts the sentences on a prose line: one per
+// sentence-ending punctuation mark followed by a space or the line end (so
+// "main.go" doesn't count), or one for an unpunctuated line of a few words.
+func countSentences(line string) int {
+	n := 0
+	runes := []rune(line)
+	for i, r := range runes {
+		switch r {
+		case '.', '!', '?':
+			if i == len(runes)-1 || unicode.IsSpace(runes[i+1]) {
+				n++
+			}
+		case '。', '！', '？':
+			n++
+		}
+	}
+	if n == 0 && len(strings.Fields(line)) >= 3 {
+		n = 1
+	}
+	return n
+}
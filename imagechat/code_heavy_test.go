@@ -0,0 +1,55 @@
+package imagechat
+
+import "testing"
+
+const (
+	fencedCodeFixture = "Here is the fix.\n\n```go\nfunc add(a, b int) int {\n\treturn a + b\n}\n\nfunc sub(a, b int) int {\n\treturn a - b\n}\n```\n"
+	diffFixture       = "diff --git a/main.go b/main.go\nindex 3b18e51..a9c4f2d 100644\n--- a/main.go\n+++ b/main.go\n@@ -1,3 +1,4 @@\n package main\n+import \"fmt\"\n-var x = 1\n+var x = 2\n"
+	indentedFixture   = "Updated:\n\n    if err != nil {\n        return err\n    }\n    defer f.Close()\n"
+	proseFixture      = "I looked into the failing test. The parser was skipping empty lines, so the offsets drifted. I changed it to count them and the test passes now."
+	proseWithSnippet  = "The bug was in the offset handling. Each empty line was skipped, so every later offset was off by one. I changed the loop to count them as well. Now the reader resumes exactly where it stopped.\n\n```go\noffset++\n```\n"
+	japaneseFixture   = "テストが失敗していた原因を調べました。空行をスキップしていたためオフセットがずれていました。修正してテストが通ることを確認しました。\n\n```go\noffset++\n```\n"
+	listFixture       = "Changes:\n- renamed the config field\n- updated the README\n- added a test"
+)
+
+func TestIsCodeHeavy(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want bool
+	}{
+		{"fenced code", fencedCodeFixture, true},
+		{"diff", diffFixture, true},
+		{"indented code", indentedFixture, true},
+		{"prose", proseFixture, false},
+		{"prose with snippet", proseWithSnippet, false},
+		{"japanese prose with snippet", japaneseFixture, false},
+		{"markdown list", listFixture, false},
+		{"empty", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isCodeHeavy(tt.text); got != tt.want {
+				t.Errorf("isCodeHeavy = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCountSentences(t *testing.T) {
+	tests := []struct {
+		line string
+		want int
+	}{
+		{"Fixed it. Tests pass!", 2},
+		{"See main.go for details", 1},
+		{"Done", 0},
+		{"修正しました。確認済みです。", 2},
+		{"Is it fixed? Yes.", 2},
+	}
+	for _, tt := range tests {
+		if got := countSentences(tt.line); got != tt.want {
+			t.Errorf("countSentences(%q) = %d, want %d", tt.line, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,1784 @@
+package imagechat
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+// How characters are chosen for prompts.
+const (
+	CharacterModeSession = "session" // each session keeps one character
+	CharacterModeRotate  = "rotate"  // advance to the next character on every prompt
+)
+
+// defaultCharacterActiveWindow is the default for Config.CharacterActiveWindow.
+const defaultCharacterActiveWindow = 30 * time.Minute
+
+// defaultSDMegapixels is the image size used with IMGCHAT_SD_ASPECT when no
+// IMGCHAT_SD_MEGAPIXELS is given; about the default 512x768.
+const defaultSDMegapixels = 0.39
+
+// defaultSDMaxPixels is the default ceiling on SD width x height (2048x2048),
+// well above normal sizes but below what exhausts a typical GPU.
+const defaultSDMaxPixels = 2048 * 2048
+
+// Built-in Stable Diffusion parameters, used for the IMGCHAT_SD_* values that
+// are not set (and, with IMGCHAT_SD_INHERIT_DEFAULTS, not reported by the
+// WebUI either).
+const (
+	defaultSDSteps       = 28
+	defaultSDWidth       = 512
+	defaultSDHeight      = 768
+	defaultSDCfgScale    = 5.0
+	defaultSDSamplerName = "Euler a"
+)
+
+// defaultTurnQuietPeriod is how long a session must go without writes before
+// a turn that logged no stop_reason counts as finished.
+const defaultTurnQuietPeriod = 3 * time.Second
+
+// maxPromptWorkers bounds Config.PromptWorkers.
+const maxPromptWorkers = 8
+
+// defaultPromptDedupWindow is the default Config.PromptDedupWindow, and
+// maxPromptDedupWindow bounds it.
+const (
+	defaultPromptDedupWindow = 20
+	maxPromptDedupWindow     = 200
+)
+
+// Gemini backends, selected by IMGCHAT_GEMINI_BACKEND.
+const (
+	GeminiBackendAPI    = "gemini" // Gemini Developer API with GEMINI_API_KEY
+	GeminiBackendVertex = "vertex" // Vertex AI with application default credentials
+)
+
+type Config struct {
+	GeminiAPIKey string
+	// GeminiBackend is GeminiBackendAPI or GeminiBackendVertex. Vertex AI
+	// uses GoogleCloudProject and GoogleCloudLocation instead of the API key.
+	GeminiBackend       string
+	GoogleCloudProject  string
+	GoogleCloudLocation string
+	GeminiModel         string
+	SDBaseURL           string
+	// SDHeaders are added to every request to the Stable Diffusion WebUI,
+	// e.g. for an auth proxy in front of it.
+	SDHeaders  http.Header
+	ServerPort string
+	// BasePath is the path prefix the web UI and API are served under, for
+	// running behind a reverse proxy at a subpath (e.g. "/imgchat"). Empty
+	// serves at the root.
+	BasePath         string
+	ClaudeProjectDir string
+	// DebounceInterval is how long the watcher waits after the last write to
+	// a session file before reading it, coalescing bursts of writes into one
+	// read. GenerateInterval then rate-limits the images themselves.
+	DebounceInterval time.Duration
+	// WatcherEventBuffer is the capacity of the watcher's event channel.
+	// While it is full, new data is merged per file instead of blocking.
+	WatcherEventBuffer int
+	GenerateInterval   time.Duration
+	// PromptInterval, if non-zero, replaces GenerateInterval as the minimum
+	// time between prompt generations.
+	PromptInterval time.Duration
+	// ImageInterval is the minimum time between image generations. Prompts
+	// arriving sooner are held and only the newest is rendered. 0 disables.
+	ImageInterval time.Duration
+
+	// Adaptive interval: when enabled, the effective generate interval is
+	// GenerateInterval * AdaptiveIntervalChars / (new text length), clamped
+	// to [AdaptiveIntervalMin, AdaptiveIntervalMax].
+	AdaptiveInterval      bool
+	AdaptiveIntervalMin   time.Duration
+	AdaptiveIntervalMax   time.Duration
+	AdaptiveIntervalChars int
+	RecentMessages        int
+	// RecentWindow and RecentStrategy select the prompt context by time
+	// instead of (or in addition to) RecentMessages; see SelectRecentMessages.
+	RecentWindow   time.Duration
+	RecentStrategy string
+	// ContextRole is ContextRoleAll or ContextRoleUser.
+	ContextRole   string
+	CharactersDir string
+	Characters    []Character
+	// CharacterFile is set when Characters came from CHARACTER_FILE instead
+	// of CharactersDir.
+	CharacterFile string
+	// StyleModifiers are loaded from the _style_*.md files next to the
+	// characters and added to every system prompt, whichever character is
+	// selected.
+	StyleModifiers []Character
+	// Debug exposes the diagnostic endpoints; so does a LogLevel of debug
+	// (see debugMode).
+	Debug bool
+	// LogLevel is the most detailed level logged. It is LogLevelDebug when
+	// Debug is set, unless IMGCHAT_LOG_LEVEL says otherwise.
+	LogLevel LogLevel
+
+	// CharacterMode is CharacterModeSession or CharacterModeRotate.
+	CharacterMode string
+
+	// CharacterActiveWindow is how long a session counts as active for the
+	// purpose of keeping its character exclusive to it.
+	CharacterActiveWindow time.Duration
+
+	// UseSummary enables a rolling conversation summary that is sent to the
+	// prompt generator alongside the recent messages.
+	UseSummary bool
+
+	// RequireClients skips generation while no browser is connected, to
+	// save backend cost. Disable it to generate headless.
+	RequireClients bool
+
+	// StatsInterval is how often a one-line summary of uptime and counters is
+	// logged. 0 disables it.
+	StatsInterval time.Duration
+
+	// ContactSheetInterval is how often the newest images are composited into
+	// a ContactSheetCols x ContactSheetRows grid PNG. 0 disables it.
+	ContactSheetInterval time.Duration
+	ContactSheetCols     int
+	ContactSheetRows     int
+	// ContactSheetBroadcast announces each contact sheet to the browsers.
+	ContactSheetBroadcast bool
+	// ContactSheetKeep is how many contact sheets are kept; older ones are
+	// removed after each new sheet. 0 keeps them all.
+	ContactSheetKeep int
+
+	// WebhookURL, when set, receives a POST of every new image's metadata.
+	// It often embeds a token, so it is treated as a secret.
+	WebhookURL string
+
+	// PromptTimeout bounds each prompt generation, including the summary
+	// update. 0 means no limit.
+	PromptTimeout time.Duration
+
+	// PromptWorkers is how many prompts for different sessions may be
+	// generated concurrently. Image generation stays serial.
+	PromptWorkers int
+
+	// PromptDedupThreshold is the token overlap (0-1) at which a new prompt
+	// counts as a near-duplicate of a recent prompt from another session and
+	// is regenerated once to be visually distinct. 0 disables the check.
+	PromptDedupThreshold float64
+	// PromptDedupWindow is how many recent prompts are compared against.
+	PromptDedupWindow int
+
+	// ToolUseScenes synthesizes a "working" message for assistant turns that
+	// only run tools, so active work periods still produce images.
+	ToolUseScenes bool
+	// IncludeThinking adds the assistant's visible reasoning ("thinking"
+	// blocks) to its messages.
+	IncludeThinking bool
+
+	// IncludeTypes are the session log entry types parsed into the
+	// conversation context. Nil means DefaultIncludeTypes.
+	IncludeTypes []string
+
+	// ForceRegenerate generates again for a message that already produced
+	// an image, e.g. when a session file is re-read after an offset reset.
+	ForceRegenerate bool
+	// WaitTurnComplete holds generation until the assistant's turn is
+	// finished: its stop_reason is logged, or TurnQuietPeriod passes
+	// without another write to the session.
+	WaitTurnComplete bool
+	TurnQuietPeriod  time.Duration
+
+	// MaxMessageChars caps each message sent to the prompt generator, in
+	// runes; longer ones keep their head and tail. 0 means no limit.
+	MaxMessageChars int
+
+	// ProjectHint tells the prompt generator the name of the project each
+	// session works on, so scenes can reflect what is being built.
+	ProjectHint bool
+	// OutcomeHints tells the prompt generator what the tool runs of the
+	// current turn reported, such as tests passing or a failed build.
+	OutcomeHints bool
+
+	// CodeHeavy is how assistant messages that are essentially all code or
+	// diff are handled: CodeHeavyOff, CodeHeavySkip or CodeHeavyAbstract.
+	CodeHeavy string
+
+	// OffsetStatePath is the file watcher read offsets are persisted to.
+	// Empty disables persistence.
+	OffsetStatePath string
+	// TailOnly makes the watcher skip the existing content of session files
+	// present at startup.
+	TailOnly bool
+
+	// Circuit breaker: after BreakerThreshold consecutive failures a backend is
+	// paused for BreakerCooldown. A threshold of 0 disables the breaker.
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+
+	// MinFreeDiskMB is the free space required in the image directory before
+	// each generation; 0 disables the check.
+	MinFreeDiskMB int
+
+	// Prompt generator selection: "gemini", "ollama" or "anthropic"
+	PromptGeneratorType string
+	OllamaBaseURL       string
+	OllamaModel         string
+	// OllamaHeaders are added to every request to Ollama.
+	OllamaHeaders   http.Header
+	AnthropicAPIKey string
+	AnthropicModel  string
+
+	// Image generator selection: "sd", "gemini" or "passthrough"
+	ImageGeneratorType string
+	GeminiImageModel   string
+	// BackendRoutes send matching sessions to another image generator than
+	// ImageGeneratorType; the first matching route wins.
+	BackendRoutes []BackendRoute
+
+	// PassthroughDir holds the images the passthrough generator copies
+	// instead of generating; "" leaves the passthrough generator off.
+	PassthroughDir string
+	// PassthroughMode is PassthroughRoundRobin or PassthroughHash.
+	PassthroughMode string
+
+	// Stable Diffusion image generation parameters
+	SDSteps  int
+	SDWidth  int
+	SDHeight int
+	// SDMaxPixels caps the size of the final image, SDWidth x SDHeight
+	// times SDHiresScale squared with the hires fix; larger sizes are scaled
+	// down, keeping the aspect ratio. 0 disables the cap.
+	SDMaxPixels   int
+	SDCfgScale    float64
+	SDSamplerName string
+	// SDScheduler is the noise schedule (e.g. "Karras"), sent separately
+	// from the sampler by newer WebUIs. Empty leaves it to the WebUI.
+	SDScheduler      string
+	SDExtraPrompt    string
+	SDExtraNegPrompt string
+	// SDInheritDefaults takes the SD parameters not set in the environment
+	// from the WebUI's options at startup. Until then they are zero.
+	SDInheritDefaults bool
+
+	// CatchupCount is how many recent images are replayed to a newly
+	// connected WebSocket client. 0 disables replay.
+	CatchupCount int
+	// PersistRecent saves the catch-up images to the image directory and
+	// restores them at startup, so browsers still catch up after a restart.
+	PersistRecent bool
+
+	// PromptApproval shows each generated prompt in the UI and only
+	// generates its image once approved, or after PromptApprovalTimeout
+	// (0 waits indefinitely).
+	PromptApproval        bool
+	PromptApprovalTimeout time.Duration
+
+	// MinDisplayInterval spaces out broadcasts so images arriving in quick
+	// succession don't flicker past; only the newest held image is shown.
+	// 0 disables.
+	MinDisplayInterval time.Duration
+
+	// IdleTimeout pauses generation once no session has logged a new message
+	// for this long; the next new message resumes it. 0 disables.
+	IdleTimeout time.Duration
+	// FocusMode generates only for the focused session: the most recently
+	// active one, or the one pinned from the web UI. Focus moves to another
+	// session once the focused one has had no new message for
+	// FocusSwitchAfter.
+	FocusMode        bool
+	FocusSwitchAfter time.Duration
+	// ScheduleInterval additionally generates an image from the most recently
+	// active session at this fixed cadence, whether or not it has new
+	// messages. 0 disables.
+	ScheduleInterval time.Duration
+
+	// WSInlineImages sends image bytes in binary WebSocket frames instead of
+	// only the filename, saving remote clients a second round-trip.
+	WSInlineImages bool
+	// WSWriteTimeout bounds each WebSocket write; a client that does not
+	// read within it is disconnected, so it cannot hold up broadcasts or
+	// shutdown.
+	WSWriteTimeout time.Duration
+
+	// AdminToken enables administrative API endpoints such as clearing all
+	// images; requests must send it as a bearer token. Empty disables them.
+	AdminToken string
+
+	// Reproducible mode: fixed SD seed, deterministic LLM sampling, hash-only
+	// character selection and a stepping clock for filenames/timestamps.
+	Reproducible bool
+	Seed         int64
+
+	// Clock is the time source for rate limiting, filenames and timestamps.
+	// In reproducible mode it only drives filenames and timestamps.
+	Clock Clock
+
+	// Caption draws a caption bar on saved images: CaptionOff, CaptionTitle,
+	// CaptionTime or CaptionBoth.
+	Caption string
+
+	// StripMetadata removes all text/EXIF metadata (including SD's embedded
+	// generation parameters) from saved images.
+	StripMetadata bool
+
+	// KeepAllImages disables the cleanup of old images, so the image
+	// directory grows without limit (IMGCHAT_IMAGE_CLEANUP=off).
+	KeepAllImages bool
+	// MaxImagesPerSession caps the images kept per session, below the global
+	// cap, so one busy session can't evict another's images. 0 disables.
+	MaxImagesPerSession int
+	// CleanupEvents tells WebSocket clients which images each cleanup
+	// removed, so they can drop them.
+	CleanupEvents bool
+
+	// Style preset selected via IMGCHAT_STYLE (empty when none)
+	StyleName     string
+	StyleTags     string
+	StyleGuidance string
+
+	// PromptGuidance is a fixed instruction added to every prompt request,
+	// steering what the prompt generator writes (empty when none).
+	PromptGuidance string
+
+	// UserPromptTemplate is the text/template the user prompt is built from,
+	// executed with UserPromptData ("" = the built-in prompt). LoadConfig
+	// validates it and keeps the parsed form in userPromptTmpl.
+	UserPromptTemplate string
+	userPromptTmpl     *template.Template
+
+	// Stable Diffusion hires fix (second upscaling pass)
+	SDHiresEnabled   bool
+	SDHiresScale     float64
+	SDHiresUpscaler  string
+	SDHiresDenoising float64
+
+	// Stable Diffusion face fixing: built-in face restoration and the
+	// ADetailer extension (model name; empty disables it).
+	SDRestoreFaces   bool
+	SDADetailerModel string
+
+	// SDMaxPromptTokens caps the estimated CLIP token count of SD prompts;
+	// longer prompts are trimmed keeping the character description (0 = off).
+	SDMaxPromptTokens int
+
+	// Mutex for dynamic fields
+	mu sync.RWMutex
+}
+
+// RuntimeConfig represents the dynamically configurable fields exposed via API.
+type RuntimeConfig struct {
+	OllamaModel        string `json:"ollama_model"`
+	ImageGeneratorType string `json:"image_generator"`
+	GeminiImageModel   string `json:"gemini_image_model"`
+	SDBaseURL          string `json:"sd_base_url"`
+	GenerateInterval   int    `json:"generate_interval"`
+}
+
+// GetRuntimeConfig returns the current dynamic configuration values.
+func (c *Config) GetRuntimeConfig() RuntimeConfig {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return RuntimeConfig{
+		OllamaModel:        c.OllamaModel,
+		ImageGeneratorType: c.ImageGeneratorType,
+		GeminiImageModel:   c.GeminiImageModel,
+		SDBaseURL:          c.SDBaseURL,
+		GenerateInterval:   int(c.GenerateInterval / time.Second),
+	}
+}
+
+// SetRuntimeConfig updates the dynamic configuration values.
+// Returns an error if validation fails.
+func (c *Config) SetRuntimeConfig(rc RuntimeConfig) error {
+	if rc.ImageGeneratorType != "sd" && rc.ImageGeneratorType != "gemini" && rc.ImageGeneratorType != "passthrough" {
+		return fmt.Errorf("image_generator must be \"sd\", \"gemini\" or \"passthrough\", got %q", rc.ImageGeneratorType)
+	}
+	if rc.GenerateInterval < 1 {
+		return fmt.Errorf("generate_interval must be a positive integer, got %d", rc.GenerateInterval)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.PromptGeneratorType == "ollama" && rc.OllamaModel == "" {
+		return fmt.Errorf("ollama_model must not be empty when prompt generator is \"ollama\"")
+	}
+	if rc.ImageGeneratorType == "gemini" && rc.GeminiImageModel == "" && c.GeminiImageModel == "" {
+		return fmt.Errorf("gemini_image_model must not be empty when image generator is \"gemini\"")
+	}
+	if rc.ImageGeneratorType == "sd" && rc.SDBaseURL == "" && c.SDBaseURL == "" {
+		return fmt.Errorf("sd_base_url must not be empty when image generator is \"sd\"")
+	}
+
+	c.OllamaModel = rc.OllamaModel
+	c.ImageGeneratorType = rc.ImageGeneratorType
+	if rc.GeminiImageModel != "" {
+		c.GeminiImageModel = rc.GeminiImageModel
+	}
+	if rc.SDBaseURL != "" {
+		c.SDBaseURL = rc.SDBaseURL
+	}
+	c.GenerateInterval = time.Duration(rc.GenerateInterval) * time.Second
+	return nil
+}
+
+// ParseOptions returns the conversation parsing options derived from the config.
+func (c *Config) ParseOptions() ParseOptions {
+	return ParseOptions{
+		ToolUseScenes:   c.ToolUseScenes,
+		IncludeTypes:    c.IncludeTypes,
+		IncludeThinking: c.IncludeThinking,
+	}
+}
+
+// GetGenerateInterval returns the current generate interval.
+func (c *Config) GetGenerateInterval() time.Duration {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.GenerateInterval
+}
+
+// GetImageGeneratorType returns the current image generator type.
+func (c *Config) GetImageGeneratorType() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.ImageGeneratorType
+}
+
+// SetImageGeneratorType switches the current image generator type.
+func (c *Config) SetImageGeneratorType(t string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ImageGeneratorType = t
+}
+
+// GetOllamaModel returns the current Ollama model name.
+func (c *Config) GetOllamaModel() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.OllamaModel
+}
+
+// GetSDBaseURL returns the current Stable Diffusion base URL.
+func (c *Config) GetSDBaseURL() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.SDBaseURL
+}
+
+// GetGeminiImageModel returns the current Gemini image model name.
+func (c *Config) GetGeminiImageModel() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.GeminiImageModel
+}
+
+func LoadConfig() (*Config, error) {
+	// .env file is optional; environment variables take precedence
+	_ = godotenv.Load()
+
+	promptGeneratorType := strings.ToLower(os.Getenv("PROMPT_GENERATOR"))
+	if promptGeneratorType == "" {
+		promptGeneratorType = "gemini"
+	}
+	if promptGeneratorType != "gemini" && promptGeneratorType != "ollama" && promptGeneratorType != "anthropic" {
+		return nil, fmt.Errorf("PROMPT_GENERATOR must be \"gemini\", \"ollama\" or \"anthropic\", got %q", promptGeneratorType)
+	}
+
+	ollamaBaseURL := os.Getenv("OLLAMA_BASE_URL")
+	if ollamaBaseURL == "" {
+		ollamaBaseURL = "http://localhost:11434"
+	}
+
+	ollamaModel := os.Getenv("OLLAMA_MODEL")
+	if ollamaModel == "" {
+		ollamaModel = "gemma3"
+	}
+
+	ollamaHeaders, err := parseHeaders(os.Getenv("IMGCHAT_OLLAMA_HEADERS"))
+	if err != nil {
+		return nil, fmt.Errorf("IMGCHAT_OLLAMA_HEADERS: %w", err)
+	}
+
+	anthropicAPIKey := os.Getenv("ANTHROPIC_API_KEY")
+	if promptGeneratorType == "anthropic" && anthropicAPIKey == "" {
+		return nil, fmt.Errorf("ANTHROPIC_API_KEY environment variable is required when prompt generator is \"anthropic\"")
+	}
+
+	anthropicModel := os.Getenv("ANTHROPIC_MODEL")
+	if anthropicModel == "" {
+		anthropicModel = "claude-haiku-4-5"
+	}
+
+	apiKey := os.Getenv("GEMINI_API_KEY")
+
+	sdBaseURL := os.Getenv("SD_BASE_URL")
+	if sdBaseURL == "" {
+		sdBaseURL = "http://localhost:7860"
+	}
+
+	sdHeaders, err := parseHeaders(os.Getenv("IMGCHAT_SD_HEADERS"))
+	if err != nil {
+		return nil, fmt.Errorf("IMGCHAT_SD_HEADERS: %w", err)
+	}
+
+	geminiModel := os.Getenv("GEMINI_MODEL")
+	if geminiModel == "" {
+		geminiModel = "gemini-2.5-flash"
+	}
+
+	serverPort := os.Getenv("SERVER_PORT")
+	if serverPort == "" {
+		serverPort = "8080"
+	}
+
+	// Normalized to a leading slash and no trailing slash; "/" means none.
+	basePath := strings.Trim(os.Getenv("IMGCHAT_BASE_PATH"), "/")
+	if basePath != "" {
+		basePath = "/" + basePath
+	}
+
+	claudeDir := os.Getenv("CLAUDE_PROJECTS_DIR")
+	if claudeDir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get home directory: %w", err)
+		}
+		claudeDir = filepath.Join(home, ".claude", "projects")
+	}
+
+	charactersDir := os.Getenv("CHARACTERS_DIR")
+	if charactersDir == "" {
+		charactersDir = "characters"
+	}
+
+	// Several directories may be given, separated like PATH entries; later
+	// ones override earlier ones by filename.
+	characters, styleModifiers, err := loadCharacters(filepath.SplitList(charactersDir))
+	if err != nil {
+		if os.Getenv("CHARACTERS_DIR") != "" {
+			// An explicitly configured directory should not fail silently.
+			return nil, fmt.Errorf("CHARACTERS_DIR %q could not be read: %w", charactersDir, err)
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			Warnf("warning: could not load characters from %q: %v", charactersDir, err)
+		}
+	}
+	var characterFile string
+
+	// Fallback to CHARACTER_FILE if no characters found in directory
+	if len(characters) == 0 {
+		if f := os.Getenv("CHARACTER_FILE"); f != "" {
+			data, err := os.ReadFile(f)
+			if err != nil {
+				Warnf("warning: could not read CHARACTER_FILE %q: %v", f, err)
+			} else {
+				c, issues := parseCharacterFile(string(data))
+				logCharacterIssues(f, issues)
+				if c.Setting != "" {
+					characterFile = f
+					c.Name = characterName(f)
+					c.Path = f
+					characters = []Character{c}
+				}
+			}
+		}
+	}
+
+	debug := os.Getenv("DEBUG") == "1" || os.Getenv("DEBUG") == "true"
+	logLevel := LogLevelInfo
+	if debug {
+		logLevel = LogLevelDebug
+	}
+	if v := os.Getenv("IMGCHAT_LOG_LEVEL"); v != "" {
+		if l, ok := ParseLogLevel(v); ok {
+			logLevel = l
+		} else {
+			Warnf("warning: invalid IMGCHAT_LOG_LEVEL %q (must be error, warn, info or debug), using default %s", v, logLevel)
+		}
+	}
+
+	offsetStatePath := os.Getenv("IMGCHAT_OFFSET_STATE")
+	tailOnly := os.Getenv("IMGCHAT_TAIL_ONLY") == "1" || os.Getenv("IMGCHAT_TAIL_ONLY") == "true"
+
+	breakerThreshold := 3
+	if v := os.Getenv("IMGCHAT_BREAKER_THRESHOLD"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			breakerThreshold = n
+		} else {
+			Warnf("warning: invalid IMGCHAT_BREAKER_THRESHOLD %q, using default %d", v, breakerThreshold)
+		}
+	}
+
+	breakerCooldown := 120 * time.Second
+	if v := os.Getenv("IMGCHAT_BREAKER_COOLDOWN"); v != "" {
+		if sec, err := strconv.Atoi(v); err == nil && sec > 0 {
+			breakerCooldown = time.Duration(sec) * time.Second
+		} else {
+			Warnf("warning: invalid IMGCHAT_BREAKER_COOLDOWN %q, using default %s", v, breakerCooldown)
+		}
+	}
+
+	minFreeDiskMB := 100
+	if v := os.Getenv("IMGCHAT_MIN_FREE_DISK_MB"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			minFreeDiskMB = n
+		} else {
+			Warnf("warning: invalid IMGCHAT_MIN_FREE_DISK_MB %q, using default %d", v, minFreeDiskMB)
+		}
+	}
+
+	toolUseScenes := os.Getenv("IMGCHAT_TOOL_USE_SCENES") == "1" || os.Getenv("IMGCHAT_TOOL_USE_SCENES") == "true"
+	includeThinking := os.Getenv("IMGCHAT_INCLUDE_THINKING") == "1" || os.Getenv("IMGCHAT_INCLUDE_THINKING") == "true"
+	var includeTypes []string
+	if v := os.Getenv("IMGCHAT_INCLUDE_TYPES"); v != "" {
+		for _, t := range strings.Split(v, ",") {
+			t = strings.ToLower(strings.TrimSpace(t))
+			if t == "" || slices.Contains(includeTypes, t) {
+				continue
+			}
+			if !slices.Contains(EntryTypes(), t) {
+				Warnf("warning: unknown IMGCHAT_INCLUDE_TYPES entry %q (must be one of %s), ignoring", t, strings.Join(EntryTypes(), ", "))
+				continue
+			}
+			includeTypes = append(includeTypes, t)
+		}
+		if len(includeTypes) == 0 {
+			Warnf("warning: invalid IMGCHAT_INCLUDE_TYPES %q, using default %s", v, strings.Join(DefaultIncludeTypes, ","))
+		}
+	}
+	forceRegenerate := os.Getenv("IMGCHAT_FORCE_REGENERATE") == "1" || os.Getenv("IMGCHAT_FORCE_REGENERATE") == "true"
+
+	waitTurnComplete := os.Getenv("IMGCHAT_WAIT_TURN_COMPLETE") == "1" || os.Getenv("IMGCHAT_WAIT_TURN_COMPLETE") == "true"
+	turnQuietPeriod := defaultTurnQuietPeriod
+	if v := os.Getenv("IMGCHAT_TURN_QUIET_PERIOD"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			turnQuietPeriod = time.Duration(n) * time.Second
+		} else {
+			Warnf("warning: invalid IMGCHAT_TURN_QUIET_PERIOD %q, using default %s", v, turnQuietPeriod)
+		}
+	}
+
+	requireClients := true
+	switch v := strings.ToLower(os.Getenv("IMGCHAT_REQUIRE_CLIENTS")); v {
+	case "", "1", "true":
+	case "0", "false":
+		requireClients = false
+	default:
+		Warnf("warning: invalid IMGCHAT_REQUIRE_CLIENTS %q, using default true", v)
+	}
+
+	useSummary := os.Getenv("IMGCHAT_USE_SUMMARY") == "1" || os.Getenv("IMGCHAT_USE_SUMMARY") == "true"
+
+	statsInterval := time.Hour
+	if v := os.Getenv("IMGCHAT_STATS_INTERVAL"); v != "" {
+		if sec, err := strconv.Atoi(v); err == nil && sec >= 0 {
+			statsInterval = time.Duration(sec) * time.Second
+		} else {
+			Warnf("warning: invalid IMGCHAT_STATS_INTERVAL %q, using default %s", v, statsInterval)
+		}
+	}
+
+	webhookURL := os.Getenv("IMGCHAT_WEBHOOK_URL")
+
+	var contactSheetInterval time.Duration
+	if v := os.Getenv("IMGCHAT_CONTACT_SHEET_INTERVAL"); v != "" {
+		if sec, err := strconv.Atoi(v); err == nil && sec >= 0 {
+			contactSheetInterval = time.Duration(sec) * time.Second
+		} else {
+			Warnf("warning: invalid IMGCHAT_CONTACT_SHEET_INTERVAL %q, contact sheets disabled", v)
+		}
+	}
+	contactSheetCols, contactSheetRows := 4, 4
+	if v := os.Getenv("IMGCHAT_CONTACT_SHEET_GRID"); v != "" {
+		c, r, ok := strings.Cut(strings.ToLower(v), "x")
+		cols, errC := strconv.Atoi(strings.TrimSpace(c))
+		rows, errR := strconv.Atoi(strings.TrimSpace(r))
+		if ok && errC == nil && errR == nil && cols > 0 && rows > 0 && cols*rows <= 100 {
+			contactSheetCols, contactSheetRows = cols, rows
+		} else {
+			Warnf("warning: invalid IMGCHAT_CONTACT_SHEET_GRID %q, using default %dx%d", v, contactSheetCols, contactSheetRows)
+		}
+	}
+	contactSheetBroadcast := os.Getenv("IMGCHAT_CONTACT_SHEET_BROADCAST") == "1" || os.Getenv("IMGCHAT_CONTACT_SHEET_BROADCAST") == "true"
+	contactSheetKeep := 7
+	if v := os.Getenv("IMGCHAT_CONTACT_SHEET_KEEP"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			contactSheetKeep = n
+		} else {
+			Warnf("warning: invalid IMGCHAT_CONTACT_SHEET_KEEP %q, using default %d", v, contactSheetKeep)
+		}
+	}
+
+	promptTimeout := 30 * time.Second
+	if v := os.Getenv("IMGCHAT_PROMPT_TIMEOUT"); v != "" {
+		if sec, err := strconv.Atoi(v); err == nil && sec >= 0 {
+			promptTimeout = time.Duration(sec) * time.Second
+		} else {
+			Warnf("warning: invalid IMGCHAT_PROMPT_TIMEOUT %q, using default %s", v, promptTimeout)
+		}
+	}
+
+	promptWorkers := 1
+	if v := os.Getenv("IMGCHAT_PROMPT_WORKERS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 1 && n <= maxPromptWorkers {
+			promptWorkers = n
+		} else {
+			Warnf("warning: invalid IMGCHAT_PROMPT_WORKERS %q (must be 1-%d), using default %d", v, maxPromptWorkers, promptWorkers)
+		}
+	}
+
+	var promptDedupThreshold float64
+	if v := os.Getenv("IMGCHAT_PROMPT_DEDUP_THRESHOLD"); v != "" {
+		if f, err := strconv.ParseFloat(v, 64); err == nil && f >= 0 && f <= 1 {
+			promptDedupThreshold = f
+		} else {
+			Warnf("warning: invalid IMGCHAT_PROMPT_DEDUP_THRESHOLD %q (must be 0-1), dedup disabled", v)
+		}
+	}
+
+	promptDedupWindow := defaultPromptDedupWindow
+	if v := os.Getenv("IMGCHAT_PROMPT_DEDUP_WINDOW"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 1 && n <= maxPromptDedupWindow {
+			promptDedupWindow = n
+		} else {
+			Warnf("warning: invalid IMGCHAT_PROMPT_DEDUP_WINDOW %q (must be 1-%d), using default %d", v, maxPromptDedupWindow, promptDedupWindow)
+		}
+	}
+
+	sdSteps := defaultSDSteps
+	if v := os.Getenv("IMGCHAT_SD_STEPS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			sdSteps = n
+		} else {
+			Warnf("warning: invalid IMGCHAT_SD_STEPS %q, using default %d", v, sdSteps)
+		}
+	}
+
+	sdWidth := defaultSDWidth
+	if v := os.Getenv("IMGCHAT_SD_WIDTH"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			sdWidth = n
+		} else {
+			Warnf("warning: invalid IMGCHAT_SD_WIDTH %q, using default %d", v, sdWidth)
+		}
+	}
+
+	sdHeight := defaultSDHeight
+	if v := os.Getenv("IMGCHAT_SD_HEIGHT"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			sdHeight = n
+		} else {
+			Warnf("warning: invalid IMGCHAT_SD_HEIGHT %q, using default %d", v, sdHeight)
+		}
+	}
+
+	if aspect := os.Getenv("IMGCHAT_SD_ASPECT"); aspect != "" {
+		megapixels := defaultSDMegapixels
+		if v := os.Getenv("IMGCHAT_SD_MEGAPIXELS"); v != "" {
+			if f, err := strconv.ParseFloat(v, 64); err == nil && f > 0 {
+				megapixels = f
+			} else {
+				Warnf("warning: invalid IMGCHAT_SD_MEGAPIXELS %q, using default %.2f", v, megapixels)
+			}
+		}
+		w, h, err := aspectDimensions(aspect, megapixels)
+		if err != nil {
+			return nil, fmt.Errorf("IMGCHAT_SD_ASPECT: %w", err)
+		}
+		if os.Getenv("IMGCHAT_SD_WIDTH") != "" || os.Getenv("IMGCHAT_SD_HEIGHT") != "" {
+			Warnf("warning: IMGCHAT_SD_ASPECT is set, ignoring IMGCHAT_SD_WIDTH/IMGCHAT_SD_HEIGHT")
+		}
+		sdWidth, sdHeight = w, h
+	}
+
+	sdMaxPixels := defaultSDMaxPixels
+	if v := os.Getenv("IMGCHAT_SD_MAX_PIXELS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			sdMaxPixels = n
+		} else {
+			Warnf("warning: invalid IMGCHAT_SD_MAX_PIXELS %q, using default %d", v, sdMaxPixels)
+		}
+	}
+
+	sdCfgScale := defaultSDCfgScale
+	if v := os.Getenv("IMGCHAT_SD_CFG_SCALE"); v != "" {
+		if f, err := strconv.ParseFloat(v, 64); err == nil && f > 0 {
+			sdCfgScale = f
+		} else {
+			Warnf("warning: invalid IMGCHAT_SD_CFG_SCALE %q, using default %.1f", v, sdCfgScale)
+		}
+	}
+
+	sdSamplerName := defaultSDSamplerName
+	if v := os.Getenv("IMGCHAT_SD_SAMPLER_NAME"); v != "" {
+		sdSamplerName = v
+	}
+	sdScheduler := strings.TrimSpace(os.Getenv("IMGCHAT_SD_SCHEDULER"))
+
+	sdInheritDefaults := os.Getenv("IMGCHAT_SD_INHERIT_DEFAULTS") == "1" || os.Getenv("IMGCHAT_SD_INHERIT_DEFAULTS") == "true"
+	if sdInheritDefaults {
+		// Leave what the user did not set zero, for the SD generator to fill
+		// in from the WebUI's options at startup.
+		if os.Getenv("IMGCHAT_SD_STEPS") == "" {
+			sdSteps = 0
+		}
+		if os.Getenv("IMGCHAT_SD_ASPECT") == "" {
+			if os.Getenv("IMGCHAT_SD_WIDTH") == "" {
+				sdWidth = 0
+			}
+			if os.Getenv("IMGCHAT_SD_HEIGHT") == "" {
+				sdHeight = 0
+			}
+		}
+		if os.Getenv("IMGCHAT_SD_CFG_SCALE") == "" {
+			sdCfgScale = 0
+		}
+		if os.Getenv("IMGCHAT_SD_SAMPLER_NAME") == "" {
+			sdSamplerName = ""
+		}
+	}
+
+	sdExtraPrompt := os.Getenv("IMGCHAT_SD_EXTRA_PROMPT")
+	sdExtraNegPrompt := os.Getenv("IMGCHAT_SD_EXTRA_NEG_PROMPT")
+
+	// Prompt files are combined with (appended after) the env var values.
+	if path := os.Getenv("IMGCHAT_SD_EXTRA_PROMPT_FILE"); path != "" {
+		if text, err := readPromptFile(path); err != nil {
+			Warnf("warning: could not read IMGCHAT_SD_EXTRA_PROMPT_FILE %q: %v", path, err)
+		} else {
+			sdExtraPrompt = joinPromptParts(sdExtraPrompt, text)
+		}
+	}
+	if path := os.Getenv("IMGCHAT_SD_NEG_PROMPT_FILE"); path != "" {
+		if text, err := readPromptFile(path); err != nil {
+			Warnf("warning: could not read IMGCHAT_SD_NEG_PROMPT_FILE %q: %v", path, err)
+		} else {
+			sdExtraNegPrompt = joinPromptParts(sdExtraNegPrompt, text)
+		}
+	}
+
+	sdRestoreFaces := os.Getenv("IMGCHAT_SD_RESTORE_FACES") == "1" || os.Getenv("IMGCHAT_SD_RESTORE_FACES") == "true"
+	sdADetailerModel := os.Getenv("IMGCHAT_SD_ADETAILER_MODEL")
+
+	sdMaxPromptTokens := 0
+	if v := os.Getenv("IMGCHAT_SD_MAX_PROMPT_TOKENS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			sdMaxPromptTokens = n
+		} else {
+			Warnf("warning: invalid IMGCHAT_SD_MAX_PROMPT_TOKENS %q, prompts will not be trimmed", v)
+		}
+	}
+
+	sdHiresEnabled := os.Getenv("IMGCHAT_SD_HIRES") == "1" || os.Getenv("IMGCHAT_SD_HIRES") == "true"
+
+	sdHiresScale := 2.0
+	if v := os.Getenv("IMGCHAT_SD_HIRES_SCALE"); v != "" {
+		if f, err := strconv.ParseFloat(v, 64); err == nil && f >= 1 {
+			sdHiresScale = f
+		} else {
+			Warnf("warning: invalid IMGCHAT_SD_HIRES_SCALE %q, using default %.1f", v, sdHiresScale)
+		}
+	}
+
+	sdHiresUpscaler := "Latent"
+	if v := os.Getenv("IMGCHAT_SD_HIRES_UPSCALER"); v != "" {
+		sdHiresUpscaler = v
+	}
+
+	sdHiresDenoising := 0.5
+	if v := os.Getenv("IMGCHAT_SD_HIRES_DENOISING"); v != "" {
+		if f, err := strconv.ParseFloat(v, 64); err == nil && f >= 0 && f <= 1 {
+			sdHiresDenoising = f
+		} else {
+			Warnf("warning: invalid IMGCHAT_SD_HIRES_DENOISING %q, using default %.2f", v, sdHiresDenoising)
+		}
+	}
+
+	// The ceiling applies to the image SD finally renders, after the hires
+	// fix has upscaled it.
+	sdHires := SDHiresConfig{Enabled: sdHiresEnabled, Scale: sdHiresScale}
+	if w, h := clampSDPixels(sdWidth, sdHeight, sdHires.outputScale(), sdMaxPixels); w != sdWidth || h != sdHeight {
+		Warnf("warning: SD image size %s exceeds IMGCHAT_SD_MAX_PIXELS %d, using %s", sdSizeString(sdWidth, sdHeight, sdHires), sdMaxPixels, sdSizeString(w, h, sdHires))
+		sdWidth, sdHeight = w, h
+	}
+
+	var recentWindow time.Duration
+	if v := os.Getenv("IMGCHAT_RECENT_WINDOW"); v != "" {
+		if sec, err := strconv.Atoi(v); err == nil && sec >= 0 {
+			recentWindow = time.Duration(sec) * time.Second
+		} else {
+			Warnf("warning: invalid IMGCHAT_RECENT_WINDOW %q, using default %s", v, recentWindow)
+		}
+	}
+
+	recentStrategy := RecentByCount
+	if recentWindow > 0 {
+		recentStrategy = RecentByWindow
+	}
+	if v := os.Getenv("IMGCHAT_RECENT_STRATEGY"); v != "" {
+		switch v {
+		case RecentByCount, RecentByWindow, RecentByEither:
+			recentStrategy = v
+		default:
+			Warnf("warning: invalid IMGCHAT_RECENT_STRATEGY %q, using default %q", v, recentStrategy)
+		}
+	}
+
+	contextRole := ContextRoleAll
+	if v := os.Getenv("IMGCHAT_CONTEXT_ROLE"); v != "" {
+		switch v {
+		case ContextRoleAll, ContextRoleUser:
+			contextRole = v
+		default:
+			Warnf("warning: invalid IMGCHAT_CONTEXT_ROLE %q, using default %q", v, contextRole)
+		}
+	}
+
+	maxMessageChars := 4000
+	if v := os.Getenv("IMGCHAT_MAX_MESSAGE_CHARS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			maxMessageChars = n
+		} else {
+			Warnf("warning: invalid IMGCHAT_MAX_MESSAGE_CHARS %q, using default %d", v, maxMessageChars)
+		}
+	}
+
+	projectHint := os.Getenv("IMGCHAT_PROJECT_HINT") == "1" || os.Getenv("IMGCHAT_PROJECT_HINT") == "true"
+	outcomeHints := os.Getenv("IMGCHAT_OUTCOME_HINTS") == "1" || os.Getenv("IMGCHAT_OUTCOME_HINTS") == "true"
+
+	codeHeavy := CodeHeavyOff
+	if v := os.Getenv("IMGCHAT_CODE_HEAVY"); v != "" {
+		switch v {
+		case CodeHeavyOff, CodeHeavySkip, CodeHeavyAbstract:
+			codeHeavy = v
+		default:
+			Warnf("warning: invalid IMGCHAT_CODE_HEAVY %q, using default %q", v, codeHeavy)
+		}
+	}
+
+	promptApproval := os.Getenv("IMGCHAT_PROMPT_APPROVAL") == "1" || os.Getenv("IMGCHAT_PROMPT_APPROVAL") == "true"
+
+	promptApprovalTimeout := 60 * time.Second
+	if v := os.Getenv("IMGCHAT_PROMPT_APPROVAL_TIMEOUT"); v != "" {
+		if sec, err := strconv.Atoi(v); err == nil && sec >= 0 {
+			promptApprovalTimeout = time.Duration(sec) * time.Second
+		} else {
+			Warnf("warning: invalid IMGCHAT_PROMPT_APPROVAL_TIMEOUT %q, using default %s", v, promptApprovalTimeout)
+		}
+	}
+
+	var minDisplayInterval time.Duration
+	if v := os.Getenv("IMGCHAT_MIN_DISPLAY_INTERVAL"); v != "" {
+		if sec, err := strconv.Atoi(v); err == nil && sec >= 0 {
+			minDisplayInterval = time.Duration(sec) * time.Second
+		} else {
+			Warnf("warning: invalid IMGCHAT_MIN_DISPLAY_INTERVAL %q, using default %s", v, minDisplayInterval)
+		}
+	}
+
+	var idleTimeout time.Duration
+	if v := os.Getenv("IMGCHAT_IDLE_TIMEOUT"); v != "" {
+		if sec, err := strconv.Atoi(v); err == nil && sec >= 0 {
+			idleTimeout = time.Duration(sec) * time.Second
+		} else {
+			Warnf("warning: invalid IMGCHAT_IDLE_TIMEOUT %q, using default %s", v, idleTimeout)
+		}
+	}
+
+	focusMode := os.Getenv("IMGCHAT_FOCUS_MODE") == "1" || os.Getenv("IMGCHAT_FOCUS_MODE") == "true"
+	focusSwitchAfter := 2 * time.Minute
+	if v := os.Getenv("IMGCHAT_FOCUS_SWITCH_AFTER"); v != "" {
+		if sec, err := strconv.Atoi(v); err == nil && sec >= 0 {
+			focusSwitchAfter = time.Duration(sec) * time.Second
+		} else {
+			Warnf("warning: invalid IMGCHAT_FOCUS_SWITCH_AFTER %q, using default %s", v, focusSwitchAfter)
+		}
+	}
+
+	var scheduleInterval time.Duration
+	if v := os.Getenv("IMGCHAT_SCHEDULE_INTERVAL"); v != "" {
+		if sec, err := strconv.Atoi(v); err == nil && sec >= 0 {
+			scheduleInterval = time.Duration(sec) * time.Second
+		} else {
+			Warnf("warning: invalid IMGCHAT_SCHEDULE_INTERVAL %q, using default %s", v, scheduleInterval)
+		}
+	}
+
+	catchupCount := 5
+	if v := os.Getenv("IMGCHAT_CATCHUP_COUNT"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			catchupCount = n
+		} else {
+			Warnf("warning: invalid IMGCHAT_CATCHUP_COUNT %q, using default %d", v, catchupCount)
+		}
+	}
+
+	persistRecent := os.Getenv("IMGCHAT_PERSIST_RECENT") == "1" || os.Getenv("IMGCHAT_PERSIST_RECENT") == "true"
+
+	wsInlineImages := os.Getenv("IMGCHAT_WS_INLINE_IMAGES") == "1" || os.Getenv("IMGCHAT_WS_INLINE_IMAGES") == "true"
+
+	adminToken := os.Getenv("IMGCHAT_ADMIN_TOKEN")
+
+	wsWriteTimeout := 10 * time.Second
+	if v := os.Getenv("IMGCHAT_WS_WRITE_TIMEOUT"); v != "" {
+		if sec, err := strconv.Atoi(v); err == nil && sec > 0 {
+			wsWriteTimeout = time.Duration(sec) * time.Second
+		} else {
+			Warnf("warning: invalid IMGCHAT_WS_WRITE_TIMEOUT %q, using default %s", v, wsWriteTimeout)
+		}
+	}
+
+	reproducible := os.Getenv("IMGCHAT_REPRODUCIBLE") == "1" || os.Getenv("IMGCHAT_REPRODUCIBLE") == "true"
+
+	seed := int64(-1)
+	if reproducible {
+		seed = 42
+	}
+	if v := os.Getenv("IMGCHAT_SEED"); v != "" {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil && n >= -1 {
+			seed = n
+		} else {
+			Warnf("warning: invalid IMGCHAT_SEED %q, using default %d", v, seed)
+		}
+	}
+
+	var clock Clock = realClock{}
+	if reproducible {
+		clock = newSteppingClock(reproducibleEpoch, time.Second)
+	}
+
+	caption := CaptionOff
+	if v := os.Getenv("IMGCHAT_CAPTION"); v != "" {
+		switch v {
+		case CaptionOff, CaptionTitle, CaptionTime, CaptionBoth:
+			caption = v
+		default:
+			Warnf("warning: invalid IMGCHAT_CAPTION %q, using default %q", v, caption)
+		}
+	}
+
+	stripMetadata := os.Getenv("IMGCHAT_STRIP_METADATA") == "1" || os.Getenv("IMGCHAT_STRIP_METADATA") == "true"
+
+	var keepAllImages bool
+	switch v := strings.ToLower(os.Getenv("IMGCHAT_IMAGE_CLEANUP")); v {
+	case "", "on":
+	case "off":
+		keepAllImages = true
+	default:
+		Warnf("warning: invalid IMGCHAT_IMAGE_CLEANUP %q (must be \"on\" or \"off\"), keeping cleanup on", v)
+	}
+
+	maxImagesPerSession := 0
+	if v := os.Getenv("IMGCHAT_MAX_IMAGES_PER_SESSION"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			maxImagesPerSession = n
+		} else {
+			Warnf("warning: invalid IMGCHAT_MAX_IMAGES_PER_SESSION %q, using default %d", v, maxImagesPerSession)
+		}
+	}
+
+	cleanupEvents := os.Getenv("IMGCHAT_CLEANUP_EVENTS") == "1" || os.Getenv("IMGCHAT_CLEANUP_EVENTS") == "true"
+
+	promptGuidance := strings.TrimSpace(os.Getenv("IMGCHAT_PROMPT_GUIDANCE"))
+
+	userPromptTemplate := os.Getenv("IMGCHAT_USER_PROMPT_TEMPLATE")
+	if path := os.Getenv("IMGCHAT_USER_PROMPT_TEMPLATE_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("IMGCHAT_USER_PROMPT_TEMPLATE_FILE: %w", err)
+		}
+		userPromptTemplate = string(data)
+	}
+	var userPromptTmpl *template.Template
+	if strings.TrimSpace(userPromptTemplate) != "" {
+		tmpl, err := parseUserPromptTemplate(userPromptTemplate)
+		if err != nil {
+			return nil, fmt.Errorf("IMGCHAT_USER_PROMPT_TEMPLATE: %w", err)
+		}
+		userPromptTmpl = tmpl
+	}
+
+	styleName := strings.ToLower(strings.TrimSpace(os.Getenv("IMGCHAT_STYLE")))
+	var style StylePreset
+	if styleName != "" {
+		presets, err := loadStylePresets(os.Getenv("IMGCHAT_STYLES_DIR"))
+		if err != nil {
+			Warnf("warning: could not load styles from %q: %v", os.Getenv("IMGCHAT_STYLES_DIR"), err)
+		}
+		p, ok := presets[styleName]
+		if !ok {
+			return nil, fmt.Errorf("IMGCHAT_STYLE %q is not a known style (available: %s)", styleName, strings.Join(styleNames(presets), ", "))
+		}
+		style = p
+	}
+
+	imageGeneratorType := strings.ToLower(os.Getenv("IMAGE_GENERATOR"))
+	if imageGeneratorType == "" {
+		imageGeneratorType = "sd"
+	}
+	if imageGeneratorType != "sd" && imageGeneratorType != "gemini" && imageGeneratorType != "passthrough" {
+		return nil, fmt.Errorf("IMAGE_GENERATOR must be \"sd\", \"gemini\" or \"passthrough\", got %q", imageGeneratorType)
+	}
+
+	backendRoutes, err := parseBackendRoutes(os.Getenv("IMGCHAT_BACKEND_ROUTES"))
+	if err != nil {
+		return nil, fmt.Errorf("IMGCHAT_BACKEND_ROUTES: %w", err)
+	}
+	usesImageBackend := func(name string) bool {
+		return imageGeneratorType == name || slices.ContainsFunc(backendRoutes, func(r BackendRoute) bool { return r.Backend == name })
+	}
+
+	passthroughDir := os.Getenv("IMGCHAT_PASSTHROUGH_DIR")
+	if usesImageBackend("passthrough") && passthroughDir == "" {
+		return nil, fmt.Errorf("IMGCHAT_PASSTHROUGH_DIR is required when IMAGE_GENERATOR or IMGCHAT_BACKEND_ROUTES uses \"passthrough\"")
+	}
+	passthroughMode := PassthroughRoundRobin
+	if v := os.Getenv("IMGCHAT_PASSTHROUGH_MODE"); v != "" {
+		switch v {
+		case PassthroughRoundRobin, PassthroughHash:
+			passthroughMode = v
+		default:
+			Warnf("warning: invalid IMGCHAT_PASSTHROUGH_MODE %q (must be %q or %q), using default %q", v, PassthroughRoundRobin, PassthroughHash, passthroughMode)
+		}
+	}
+
+	geminiImageModel := os.Getenv("GEMINI_IMAGE_MODEL")
+	if geminiImageModel == "" {
+		geminiImageModel = "gemini-2.5-flash-image"
+	}
+
+	geminiBackend := GeminiBackendAPI
+	if v := os.Getenv("IMGCHAT_GEMINI_BACKEND"); v != "" {
+		switch v {
+		case GeminiBackendAPI, GeminiBackendVertex:
+			geminiBackend = v
+		default:
+			return nil, fmt.Errorf("IMGCHAT_GEMINI_BACKEND must be %q or %q, got %q", GeminiBackendAPI, GeminiBackendVertex, v)
+		}
+	}
+	googleCloudProject := os.Getenv("GOOGLE_CLOUD_PROJECT")
+	googleCloudLocation := os.Getenv("GOOGLE_CLOUD_LOCATION")
+
+	// Credentials are required when prompt generator or image generator uses Gemini
+	usesGemini := promptGeneratorType == "gemini" || usesImageBackend("gemini")
+	if usesGemini && geminiBackend == GeminiBackendVertex {
+		if googleCloudProject == "" || googleCloudLocation == "" {
+			return nil, fmt.Errorf("GOOGLE_CLOUD_PROJECT and GOOGLE_CLOUD_LOCATION environment variables are required when IMGCHAT_GEMINI_BACKEND is \"vertex\"")
+		}
+	} else if usesGemini && apiKey == "" {
+		return nil, fmt.Errorf("GEMINI_API_KEY environment variable is required when prompt generator or image generator is \"gemini\"")
+	}
+
+	generateInterval := 60 * time.Second
+	if v := os.Getenv("GENERATE_INTERVAL"); v != "" {
+		if sec, err := strconv.Atoi(v); err == nil && sec > 0 {
+			generateInterval = time.Duration(sec) * time.Second
+		} else {
+			Warnf("warning: invalid GENERATE_INTERVAL %q, using default 60s", v)
+		}
+	}
+
+	var promptInterval, imageInterval time.Duration
+	if v := os.Getenv("IMGCHAT_PROMPT_INTERVAL"); v != "" {
+		if sec, err := strconv.Atoi(v); err == nil && sec >= 0 {
+			promptInterval = time.Duration(sec) * time.Second
+		} else {
+			Warnf("warning: invalid IMGCHAT_PROMPT_INTERVAL %q, using GENERATE_INTERVAL", v)
+		}
+	}
+	if v := os.Getenv("IMGCHAT_IMAGE_INTERVAL"); v != "" {
+		if sec, err := strconv.Atoi(v); err == nil && sec >= 0 {
+			imageInterval = time.Duration(sec) * time.Second
+		} else {
+			Warnf("warning: invalid IMGCHAT_IMAGE_INTERVAL %q, using default 0 (disabled)", v)
+		}
+	}
+
+	debounceInterval := 3 * time.Second
+	if v := os.Getenv("IMGCHAT_WATCH_DEBOUNCE_MS"); v != "" {
+		if ms, err := strconv.Atoi(v); err == nil && ms >= 0 {
+			debounceInterval = time.Duration(ms) * time.Millisecond
+		} else {
+			Warnf("warning: invalid IMGCHAT_WATCH_DEBOUNCE_MS %q, using default %s", v, debounceInterval)
+		}
+	}
+
+	watcherEventBuffer := defaultWatcherEventBuffer
+	if v := os.Getenv("IMGCHAT_WATCH_BUFFER"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			watcherEventBuffer = n
+		} else {
+			Warnf("warning: invalid IMGCHAT_WATCH_BUFFER %q, using default %d", v, watcherEventBuffer)
+		}
+	}
+
+	characterMode := CharacterModeSession
+	if v := os.Getenv("IMGCHAT_CHARACTER_MODE"); v != "" {
+		switch v {
+		case CharacterModeSession, CharacterModeRotate:
+			characterMode = v
+		default:
+			Warnf("warning: invalid IMGCHAT_CHARACTER_MODE %q, using default %q", v, characterMode)
+		}
+	}
+
+	characterActiveWindow := defaultCharacterActiveWindow
+	if v := os.Getenv("IMGCHAT_CHARACTER_ACTIVE_WINDOW"); v != "" {
+		if sec, err := strconv.Atoi(v); err == nil && sec > 0 {
+			characterActiveWindow = time.Duration(sec) * time.Second
+		} else {
+			Warnf("warning: invalid IMGCHAT_CHARACTER_ACTIVE_WINDOW %q, using default %s", v, characterActiveWindow)
+		}
+	}
+
+	adaptiveInterval := os.Getenv("IMGCHAT_ADAPTIVE_INTERVAL") == "1" || os.Getenv("IMGCHAT_ADAPTIVE_INTERVAL") == "true"
+
+	adaptiveIntervalMin := 10 * time.Second
+	if v := os.Getenv("IMGCHAT_ADAPTIVE_INTERVAL_MIN"); v != "" {
+		if sec, err := strconv.Atoi(v); err == nil && sec > 0 {
+			adaptiveIntervalMin = time.Duration(sec) * time.Second
+		} else {
+			Warnf("warning: invalid IMGCHAT_ADAPTIVE_INTERVAL_MIN %q, using default %s", v, adaptiveIntervalMin)
+		}
+	}
+
+	adaptiveIntervalMax := 5 * time.Minute
+	if v := os.Getenv("IMGCHAT_ADAPTIVE_INTERVAL_MAX"); v != "" {
+		if sec, err := strconv.Atoi(v); err == nil && sec > 0 {
+			adaptiveIntervalMax = time.Duration(sec) * time.Second
+		} else {
+			Warnf("warning: invalid IMGCHAT_ADAPTIVE_INTERVAL_MAX %q, using default %s", v, adaptiveIntervalMax)
+		}
+	}
+	if adaptiveIntervalMax < adaptiveIntervalMin {
+		Warnf("warning: IMGCHAT_ADAPTIVE_INTERVAL_MAX (%s) is below the minimum (%s), using the minimum", adaptiveIntervalMax, adaptiveIntervalMin)
+		adaptiveIntervalMax = adaptiveIntervalMin
+	}
+
+	adaptiveIntervalChars := 1000
+	if v := os.Getenv("IMGCHAT_ADAPTIVE_INTERVAL_CHARS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			adaptiveIntervalChars = n
+		} else {
+			Warnf("warning: invalid IMGCHAT_ADAPTIVE_INTERVAL_CHARS %q, using default %d", v, adaptiveIntervalChars)
+		}
+	}
+
+	return &Config{
+		GeminiAPIKey:          apiKey,
+		GeminiModel:           geminiModel,
+		SDBaseURL:             sdBaseURL,
+		PromptGeneratorType:   promptGeneratorType,
+		OllamaBaseURL:         ollamaBaseURL,
+		OllamaModel:           ollamaModel,
+		ServerPort:            serverPort,
+		ClaudeProjectDir:      claudeDir,
+		DebounceInterval:      debounceInterval,
+		GenerateInterval:      generateInterval,
+		RecentMessages:        10,
+		CharactersDir:         charactersDir,
+		Characters:            characters,
+		CharacterFile:         characterFile,
+		Debug:                 debug,
+		CharacterActiveWindow: characterActiveWindow,
+		ImageGeneratorType:    imageGeneratorType,
+		GeminiImageModel:      geminiImageModel,
+		SDSteps:               sdSteps,
+		SDWidth:               sdWidth,
+		SDHeight:              sdHeight,
+		SDCfgScale:            sdCfgScale,
+		SDSamplerName:         sdSamplerName,
+		SDExtraPrompt:         sdExtraPrompt,
+		SDExtraNegPrompt:      sdExtraNegPrompt,
+		SDHiresEnabled:        sdHiresEnabled,
+		SDHiresScale:          sdHiresScale,
+		SDHiresUpscaler:       sdHiresUpscaler,
+		SDHiresDenoising:      sdHiresDenoising,
+		UseSummary:            useSummary,
+		OffsetStatePath:       offsetStatePath,
+		BreakerThreshold:      breakerThreshold,
+		BreakerCooldown:       breakerCooldown,
+		StyleName:             styleName,
+		StyleTags:             style.Tags,
+		StyleGuidance:         style.Guidance,
+		ToolUseScenes:         toolUseScenes,
+		StripMetadata:         stripMetadata,
+		CatchupCount:          catchupCount,
+		WSInlineImages:        wsInlineImages,
+		Reproducible:          reproducible,
+		Seed:                  seed,
+		Clock:                 clock,
+		SDRestoreFaces:        sdRestoreFaces,
+		SDADetailerModel:      sdADetailerModel,
+		AdaptiveInterval:      adaptiveInterval,
+		AdaptiveIntervalMin:   adaptiveIntervalMin,
+		AdaptiveIntervalMax:   adaptiveIntervalMax,
+		AdaptiveIntervalChars: adaptiveIntervalChars,
+		MinFreeDiskMB:         minFreeDiskMB,
+		MinDisplayInterval:    minDisplayInterval,
+		RecentWindow:          recentWindow,
+		RecentStrategy:        recentStrategy,
+		PromptApproval:        promptApproval,
+		PromptApprovalTimeout: promptApprovalTimeout,
+		AnthropicAPIKey:       anthropicAPIKey,
+		AnthropicModel:        anthropicModel,
+		SDMaxPromptTokens:     sdMaxPromptTokens,
+		IdleTimeout:           idleTimeout,
+		PromptWorkers:         promptWorkers,
+		TailOnly:              tailOnly,
+		PromptGuidance:        promptGuidance,
+		KeepAllImages:         keepAllImages,
+		CodeHeavy:             codeHeavy,
+		MaxImagesPerSession:   maxImagesPerSession,
+		SDScheduler:           sdScheduler,
+		RequireClients:        requireClients,
+		PromptTimeout:         promptTimeout,
+		StatsInterval:         statsInterval,
+		ProjectHint:           projectHint,
+		PromptInterval:        promptInterval,
+		ImageInterval:         imageInterval,
+		MaxMessageChars:       maxMessageChars,
+		WebhookURL:            webhookURL,
+		CharacterMode:         characterMode,
+		ContextRole:           contextRole,
+		ContactSheetInterval:  contactSheetInterval,
+		ContactSheetCols:      contactSheetCols,
+		ContactSheetRows:      contactSheetRows,
+		ContactSheetBroadcast: contactSheetBroadcast,
+		ContactSheetKeep:      contactSheetKeep,
+		GeminiBackend:         geminiBackend,
+		GoogleCloudProject:    googleCloudProject,
+		GoogleCloudLocation:   googleCloudLocation,
+		UserPromptTemplate:    userPromptTemplate,
+		userPromptTmpl:        userPromptTmpl,
+		Caption:               caption,
+		SDInheritDefaults:     sdInheritDefaults,
+		PromptDedupThreshold:  promptDedupThreshold,
+		PromptDedupWindow:     promptDedupWindow,
+		ForceRegenerate:       forceRegenerate,
+		IncludeTypes:          includeTypes,
+		LogLevel:              logLevel,
+		PassthroughDir:        passthroughDir,
+		PassthroughMode:       passthroughMode,
+		WSWriteTimeout:        wsWriteTimeout,
+		ScheduleInterval:      scheduleInterval,
+		AdminToken:            adminToken,
+		IncludeThinking:       includeThinking,
+		BasePath:              basePath,
+		OutcomeHints:          outcomeHints,
+		SDMaxPixels:           sdMaxPixels,
+		BackendRoutes:         backendRoutes,
+		PersistRecent:         persistRecent,
+		WatcherEventBuffer:    watcherEventBuffer,
+		FocusMode:             focusMode,
+		FocusSwitchAfter:      focusSwitchAfter,
+		SDHeaders:             sdHeaders,
+		OllamaHeaders:         ollamaHeaders,
+		CleanupEvents:         cleanupEvents,
+		StyleModifiers:        styleModifiers,
+		WaitTurnComplete:      waitTurnComplete,
+		TurnQuietPeriod:       turnQuietPeriod,
+	}, nil
+}
+
+// Character is a character setting loaded from a character file.
+type Character struct {
+	// Name is the file name without its extension, e.g. "hero".
+	Name string
+	// Setting is the description added to the prompt generator's system prompt.
+	Setting string
+	// ImageModel is the image model the character declares ("" = default).
+	ImageModel string
+	// Path is the file the character was loaded from.
+	Path string
+}
+
+// characterName returns the character name for a character file path.
+func characterName(path string) string {
+	base := filepath.Base(path)
+	return strings.TrimSuffix(base, filepath.Ext(base))
+}
+
+// styleModifierPrefix marks the character files that are style modifiers:
+// always applied on top of the selected character instead of being selected.
+const styleModifierPrefix = "_style_"
+
+// loadCharacters reads the .md files of each directory in dirs, sorted by
+// filename, returning the characters and the style modifiers
+// (styleModifierPrefix files) separately. A file in a later directory
+// replaces the file with the same name from an earlier one, so shared
+// characters can be overridden locally.
+func loadCharacters(dirs []string) ([]Character, []Character, error) {
+	paths := make(map[string]string) // file name -> path of the winning file
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, e := range entries {
+			if e.IsDir() || !strings.HasSuffix(strings.ToLower(e.Name()), ".md") {
+				continue
+			}
+			path := filepath.Join(dir, e.Name())
+			if prev, ok := paths[e.Name()]; ok {
+				Infof("character file %s overrides %s", path, prev)
+			}
+			paths[e.Name()] = path
+		}
+	}
+
+	names := make([]string, 0, len(paths))
+	for name := range paths {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var characters, modifiers []Character
+	for _, name := range names {
+		path := paths[name]
+		data, err := os.ReadFile(path)
+		if err != nil {
+			Warnf("warning: could not read character file %q: %v", path, err)
+			continue
+		}
+		c, issues := parseCharacterFile(string(data))
+		logCharacterIssues(path, issues)
+		if strings.HasPrefix(strings.ToLower(name), styleModifierPrefix) {
+			if c.Setting == "" {
+				continue
+			}
+			if c.ImageModel != "" {
+				Warnf("warning: character file %s: image_model is ignored in a style modifier", path)
+				c.ImageModel = ""
+			}
+			c.Name = characterName(name[len(styleModifierPrefix):])
+			c.Path = path
+			modifiers = append(modifiers, c)
+			Infof("loaded style modifier: %s", path)
+			continue
+		}
+		if c.Setting != "" {
+			c.Name = characterName(name)
+			c.Path = path
+			characters = append(characters, c)
+			if c.ImageModel != "" {
+				Infof("loaded character setting: %s (image model: %s)", path, c.ImageModel)
+			} else {
+				Infof("loaded character setting: %s", path)
+			}
+		}
+	}
+	return characters, modifiers, nil
+}
+
+// characterIssue is a problem found while parsing a character file. Line is
+// 1-based, or 0 when the problem concerns the whole file.
+type characterIssue struct {
+	Line int
+	Msg  string
+}
+
+func (ci characterIssue) String() string {
+	if ci.Line == 0 {
+		return ci.Msg
+	}
+	return fmt.Sprintf("line %d: %s", ci.Line, ci.Msg)
+}
+
+// characterFileKeys are the keys allowed in a character file's front matter.
+var characterFileKeys = []string{"image_model"}
+
+// parseCharacterFile splits an optional front matter block off a character
+// file and returns the character it describes, without a name:
+//
+//	---
+//	image_model: realisticVisionV60.safetensors
+//	---
+//
+// Malformed front matter lines are skipped and reported as issues rather than
+// failing the whole file.
+func parseCharacterFile(data string) (Character, []characterIssue) {
+	data = strings.ReplaceAll(data, "\r\n", "\n")
+	content := strings.TrimSpace(data)
+	// Blank lines before the front matter still count for line numbers.
+	lineOffset := strings.Count(data[:len(data)-len(strings.TrimLeft(data, " \t\n"))], "\n")
+	rest, ok := strings.CutPrefix(content, "---\n")
+	if !ok {
+		return Character{Setting: content}, nil
+	}
+	header, body, ok := strings.Cut(rest, "\n---")
+	if !ok {
+		return Character{Setting: content}, []characterIssue{{
+			Line: lineOffset + 1,
+			Msg:  "front matter is not closed by a --- line; treating the whole file as the description",
+		}}
+	}
+
+	var c Character
+	var issues []characterIssue
+	seen := make(map[string]bool)
+	for i, line := range strings.Split(header, "\n") {
+		lineNo := lineOffset + i + 2 // after the opening ---
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			issues = append(issues, characterIssue{lineNo, fmt.Sprintf("expected \"key: value\", got %q", strings.TrimSpace(line))})
+			continue
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if !slices.Contains(characterFileKeys, key) {
+			issues = append(issues, characterIssue{lineNo, fmt.Sprintf("unknown key %q (known keys: %s)", key, strings.Join(characterFileKeys, ", "))})
+			continue
+		}
+		if value == "" {
+			issues = append(issues, characterIssue{lineNo, fmt.Sprintf("%s has no value", key)})
+			continue
+		}
+		if seen[key] {
+			issues = append(issues, characterIssue{lineNo, fmt.Sprintf("duplicate key %q, using this value", key)})
+		}
+		seen[key] = true
+		switch key {
+		case "image_model":
+			c.ImageModel = value
+		}
+	}
+	c.Setting = strings.TrimSpace(body)
+	if c.Setting == "" {
+		issues = append(issues, characterIssue{0, "no character description after the front matter"})
+	}
+	return c, issues
+}
+
+// logCharacterIssues reports the problems found in a character file.
+func logCharacterIssues(path string, issues []characterIssue) {
+	for _, ci := range issues {
+		Warnf("warning: character file %s: %s", path, ci)
+	}
+}
+
+// LoadCharacterFile reads a single character .md file, as found in
+// CHARACTERS_DIR. Problems in its front matter are logged.
+func LoadCharacterFile(path string) (Character, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Character{}, err
+	}
+	c, issues := parseCharacterFile(string(data))
+	logCharacterIssues(path, issues)
+	if c.Setting == "" {
+		return Character{}, fmt.Errorf("%s has no character description", path)
+	}
+	c.Name = characterName(path)
+	c.Path = path
+	return c, nil
+}
+
+// CharacterImageModel returns the image model declared for the character at
+// index, or "" for the default model.
+func (c *Config) CharacterImageModel(index int) string {
+	if index < 0 || index >= len(c.Characters) {
+		return ""
+	}
+	return c.Characters[index].ImageModel
+}
+
+// CharacterName returns the name of the character at index, or "" if there
+// is none.
+func (c *Config) CharacterName(index int) string {
+	if index < 0 || index >= len(c.Characters) {
+		return ""
+	}
+	return c.Characters[index].Name
+}
+
+// aspectDimensions maps an aspect ratio such as "2:3" and a pixel budget in
+// megapixels to a width and height that are multiples of 8 (at least 64), as
+// Stable Diffusion requires.
+func aspectDimensions(aspect string, megapixels float64) (width, height int, err error) {
+	ws, hs, ok := strings.Cut(aspect, ":")
+	if !ok {
+		return 0, 0, fmt.Errorf("aspect ratio must look like \"2:3\", got %q", aspect)
+	}
+	aw, err1 := strconv.ParseFloat(strings.TrimSpace(ws), 64)
+	ah, err2 := strconv.ParseFloat(strings.TrimSpace(hs), 64)
+	if err1 != nil || err2 != nil || aw <= 0 || ah <= 0 {
+		return 0, 0, fmt.Errorf("aspect ratio must look like \"2:3\", got %q", aspect)
+	}
+	pixels := megapixels * 1e6
+	w := math.Sqrt(pixels * aw / ah)
+	h := w * ah / aw
+	return roundTo8(w), roundTo8(h), nil
+}
+
+// BackendRoute sends the sessions whose project name or session ID starts
+// with Prefix to the image generator Backend.
+type BackendRoute struct {
+	Prefix  string
+	Backend string
+}
+
+// parseBackendRoutes parses IMGCHAT_BACKEND_ROUTES: comma-separated
+// prefix=backend pairs, such as "my-app=gemini,scratch=sd".
+func parseBackendRoutes(s string) ([]BackendRoute, error) {
+	var routes []BackendRoute
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		prefix, backend, ok := strings.Cut(part, "=")
+		prefix, backend = strings.TrimSpace(prefix), strings.ToLower(strings.TrimSpace(backend))
+		if !ok || prefix == "" {
+			return nil, fmt.Errorf("route must look like \"prefix=backend\", got %q", part)
+		}
+		switch backend {
+		case "sd", "gemini", "passthrough":
+		default:
+			return nil, fmt.Errorf("backend must be \"sd\", \"gemini\" or \"passthrough\", got %q", backend)
+		}
+		routes = append(routes, BackendRoute{Prefix: prefix, Backend: backend})
+	}
+	return routes, nil
+}
+
+// parseHeaders parses IMGCHAT_SD_HEADERS and IMGCHAT_OLLAMA_HEADERS:
+// semicolon-separated Key:Value pairs, such as
+// "Authorization:Bearer abc;X-Api-Key:xyz". It returns nil for "".
+func parseHeaders(s string) (http.Header, error) {
+	var h http.Header
+	for _, part := range strings.Split(s, ";") {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(part, ":")
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("header must look like \"Key:Value\", got %q", part)
+		}
+		if strings.IndexFunc(key, func(r rune) bool { return !isHeaderNameRune(r) }) >= 0 {
+			return nil, fmt.Errorf("invalid header name %q", key)
+		}
+		if strings.ContainsAny(value, "\r\n\x00") {
+			return nil, fmt.Errorf("invalid value for header %q", key)
+		}
+		if h == nil {
+			h = make(http.Header)
+		}
+		h.Add(key, value)
+	}
+	return h, nil
+}
+
+// isHeaderNameRune reports whether r may appear in an HTTP header name (an
+// RFC 9110 token).
+func isHeaderNameRune(r rune) bool {
+	return r < 0x80 && (r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || strings.ContainsRune("!#$%&'*+-.^_`|~", r))
+}
+
+// addHeaders adds the configured extra headers h to req.
+func addHeaders(req *http.Request, h http.Header) {
+	for key, values := range h {
+		for _, v := range values {
+			req.Header.Add(key, v)
+		}
+	}
+}
+
+// clampSDPixels scales width and height down, keeping their ratio, so that
+// the final image, (width x hrScale) x (height x hrScale) with the hires fix,
+// does not exceed maxPixels, and rounds them down to multiples of 8. hrScale
+// is 1 without the hires fix. Sizes within the limit, and any size when
+// maxPixels is 0, are returned unchanged.
+func clampSDPixels(width, height int, hrScale float64, maxPixels int) (int, int) {
+	hrScale = max(hrScale, 1)
+	output := float64(width) * hrScale * float64(height) * hrScale
+	if maxPixels <= 0 || output <= float64(maxPixels) {
+		return width, height
+	}
+	scale := math.Sqrt(float64(maxPixels) / output)
+	w := max(int(float64(width)*scale)/8*8, 8)
+	h := max(int(float64(height)*scale)/8*8, 8)
+	return w, h
+}
+
+// sdSizeString describes an SD image size for warnings, with the size the
+// hires fix upscales it to when enabled.
+func sdSizeString(width, height int, hires SDHiresConfig) string {
+	if s := hires.outputScale(); s > 1 {
+		return fmt.Sprintf("%dx%d (%dx%d after the hires fix)", width, height, int(float64(width)*s), int(float64(height)*s))
+	}
+	return fmt.Sprintf("%dx%d", width, height)
+}
+
+// roundTo8 rounds v to the nearest multiple of 8, with a minimum of 64.
+func roundTo8(v float64) int {
+	return max(int(math.Round(v/8))*8, 64)
+}
+
+// readPromptFile reads a prompt fragment from a file. Each non-empty line is
+// treated as one or more comma-separated tags; lines starting with '#' are
+// comments. The lines are joined with ", ".
+func readPromptFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	var parts []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.Trim(strings.TrimSpace(line), ",")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts = append(parts, strings.TrimSpace(line))
+	}
+	return strings.Join(parts, ", "), nil
+}
+
+// joinPromptParts joins non-empty prompt fragments with ", ".
+func joinPromptParts(parts ...string) string {
+	var nonEmpty []string
+	for _, p := range parts {
+		if p = strings.Trim(strings.TrimSpace(p), ","); p != "" {
+			nonEmpty = append(nonEmpty, strings.TrimSpace(p))
+		}
+	}
+	return strings.Join(nonEmpty, ", ")
+}
+
+// clock returns the configured Clock, defaulting to the wall clock.
+func (c *Config) clock() Clock {
+	if c == nil || c.Clock == nil {
+		return realClock{}
+	}
+	return c.Clock
+}
+
+// debugMode reports whether debug mode is on: DEBUG was set, or the log
+// level is debug, e.g. from IMGCHAT_LOG_LEVEL.
+func (c *Config) debugMode() bool {
+	return c.Debug || c.LogLevel == LogLevelDebug
+}
+
+// timerClock returns the Clock for rate limiting and timers: the configured
+// one, except for the stepping clock of reproducible mode, which moves on
+// with every reading and is only meant to name and stamp images.
+func (c *Config) timerClock() Clock {
+	if _, ok := c.clock().(*steppingClock); ok {
+		return realClock{}
+	}
+	return c.clock()
+}
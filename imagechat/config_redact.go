@@ -0,0 +1,117 @@
+package imagechat
+
+import (
+	"net/url"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+const redacted = "[REDACTED]"
+
+// redactedURLPart replaces secrets inside URLs, where brackets would be escaped.
+const redactedURLPart = "REDACTED"
+
+// sensitiveFieldMarkers are substrings of Config field names whose values
+// must never be exposed.
+var sensitiveFieldMarkers = []string{"Key", "Token", "Secret", "Password", "Header", "Webhook"}
+
+// Redacted returns the effective configuration as a field-name → value map,
+// with secrets replaced by a placeholder and credentials stripped from URLs.
+func (c *Config) Redacted() map[string]any {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	out := make(map[string]any)
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		// Skip unexported fields and injected dependencies such as Clock.
+		if !f.IsExported() || f.Type.Kind() == reflect.Interface {
+			continue
+		}
+		val := v.Field(i).Interface()
+		if isSensitiveField(f.Name) {
+			if !v.Field(i).IsZero() {
+				val = redacted
+			}
+		} else if s, ok := val.(string); ok && strings.HasSuffix(f.Name, "URL") {
+			val = redactURL(s)
+		} else if d, ok := val.(interface{ String() string }); ok && f.Type.PkgPath() == "time" {
+			val = d.String()
+		}
+		out[f.Name] = val
+	}
+	return out
+}
+
+func isSensitiveField(name string) bool {
+	for _, m := range sensitiveFieldMarkers {
+		if strings.Contains(name, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactURL removes any password embedded in a URL's userinfo and masks
+// query parameters that commonly carry credentials.
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return raw
+	}
+	if u.User != nil {
+		if _, hasPw := u.User.Password(); hasPw {
+			u.User = url.UserPassword(u.User.Username(), redactedURLPart)
+		}
+	}
+	q := u.Query()
+	changed := false
+	for k := range q {
+		lk := strings.ToLower(k)
+		if strings.Contains(lk, "key") || strings.Contains(lk, "token") || strings.Contains(lk, "secret") {
+			q.Set(k, redactedURLPart)
+			changed = true
+		}
+	}
+	if changed {
+		u.RawQuery = q.Encode()
+	}
+	return u.String()
+}
+
+// secretPatterns match credentials that may appear in error messages, such
+// as API keys in request URLs and bearer tokens.
+var secretPatterns = []struct {
+	re   *regexp.Regexp
+	repl string
+}{
+	{regexp.MustCompile(`(?i)((?:api_?)?key|token|secret)=[^&\s"']+`), "$1=" + redactedURLPart},
+	{regexp.MustCompile(`(?i)(bearer) [^\s"']+`), "$1 " + redactedURLPart},
+}
+
+// redactSecrets masks the configured secrets and credential-looking
+// substrings in free text such as an error message.
+func (c *Config) redactSecrets(s string) string {
+	if c != nil {
+		c.mu.RLock()
+		v := reflect.ValueOf(c).Elem()
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if !f.IsExported() || f.Type.Kind() != reflect.String || !isSensitiveField(f.Name) {
+				continue
+			}
+			if secret := v.Field(i).String(); secret != "" {
+				s = strings.ReplaceAll(s, secret, redacted)
+			}
+		}
+		c.mu.RUnlock()
+	}
+	for _, p := range secretPatterns {
+		s = p.re.ReplaceAllString(s, p.repl)
+	}
+	return s
+}
@@ -0,0 +1,278 @@
+package imagechat
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestAspectDimensions(t *testing.T) {
+	tests := []struct {
+		aspect     string
+		megapixels float64
+		wantW      int
+		wantH      int
+		wantErr    bool
+	}{
+		{"1:1", 0.25, 504, 504, false},
+		{"1:1", 1, 1000, 1000, false},
+		{"2:3", 0.5, 576, 864, false},
+		{"3:2", 0.5, 864, 576, false},
+		{"16:9", 1, 1336, 752, false},
+		{" 9 : 16 ", 1, 752, 1336, false},
+		{"1.5:1", 0.5, 864, 576, false},
+		{"100:1", 0.01, 1000, 64, false},
+		{"2x3", 1, 0, 0, true},
+		{"0:1", 1, 0, 0, true},
+		{"-2:3", 1, 0, 0, true},
+		{"a:b", 1, 0, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s@%gMP", tt.aspect, tt.megapixels), func(t *testing.T) {
+			w, h, err := aspectDimensions(tt.aspect, tt.megapixels)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("aspectDimensions(%q, %g) error = %v, want error %v", tt.aspect, tt.megapixels, err, tt.wantErr)
+			}
+			if w != tt.wantW || h != tt.wantH {
+				t.Errorf("aspectDimensions(%q, %g) = %dx%d, want %dx%d", tt.aspect, tt.megapixels, w, h, tt.wantW, tt.wantH)
+			}
+			if !tt.wantErr && (w%8 != 0 || h%8 != 0) {
+				t.Errorf("%dx%d is not a multiple of 8", w, h)
+			}
+		})
+	}
+}
+
+func TestParseCharacterFile(t *testing.T) {
+	tests := []struct {
+		name       string
+		data       string
+		wantModel  string
+		wantSet    string
+		wantIssues []string
+	}{
+		{
+			name:    "plain description",
+			data:    "A cheerful girl with red hair.\n",
+			wantSet: "A cheerful girl with red hair.",
+		},
+		{
+			name:      "front matter",
+			data:      "---\nimage_model: anime.safetensors\n---\nA cheerful girl.\n",
+			wantModel: "anime.safetensors",
+			wantSet:   "A cheerful girl.",
+		},
+		{
+			name:      "comments, blank lines and CRLF",
+			data:      "---\r\n# model for this one\r\n\r\nimage_model: anime.safetensors\r\n---\r\nA cheerful girl.\r\n",
+			wantModel: "anime.safetensors",
+			wantSet:   "A cheerful girl.",
+		},
+		{
+			name:       "unknown key",
+			data:       "---\nimage_model: anime.safetensors\nlora: style\n---\nA girl.\n",
+			wantModel:  "anime.safetensors",
+			wantSet:    "A girl.",
+			wantIssues: []string{`line 3: unknown key "lora" (known keys: image_model)`},
+		},
+		{
+			name:       "empty value",
+			data:       "---\nimage_model:\n---\nA girl.\n",
+			wantSet:    "A girl.",
+			wantIssues: []string{"line 2: image_model has no value"},
+		},
+		{
+			name:       "not key value",
+			data:       "---\nimage_model anime.safetensors\n---\nA girl.\n",
+			wantSet:    "A girl.",
+			wantIssues: []string{`line 2: expected "key: value", got "image_model anime.safetensors"`},
+		},
+		{
+			name:       "duplicate key",
+			data:       "---\nimage_model: a.safetensors\nimage_model: b.safetensors\n---\nA girl.\n",
+			wantModel:  "b.safetensors",
+			wantSet:    "A girl.",
+			wantIssues: []string{`line 3: duplicate key "image_model", using this value`},
+		},
+		{
+			name:       "unterminated block",
+			data:       "\n\n---\nimage_model: anime.safetensors\nA girl.\n",
+			wantSet:    "---\nimage_model: anime.safetensors\nA girl.",
+			wantIssues: []string{"line 3: front matter is not closed by a --- line; treating the whole file as the description"},
+		},
+		{
+			name:       "leading blank lines shift line numbers",
+			data:       "\n\n---\nmodel: x\n---\nA girl.\n",
+			wantSet:    "A girl.",
+			wantIssues: []string{`line 4: unknown key "model" (known keys: image_model)`},
+		},
+		{
+			name:       "no description",
+			data:       "---\nimage_model: anime.safetensors\n---\n",
+			wantModel:  "anime.safetensors",
+			wantIssues: []string{"no character description after the front matter"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, issues := parseCharacterFile(tt.data)
+			if c.ImageModel != tt.wantModel || c.Setting != tt.wantSet {
+				t.Errorf("got model %q, setting %q; want %q, %q", c.ImageModel, c.Setting, tt.wantModel, tt.wantSet)
+			}
+			var got []string
+			for _, ci := range issues {
+				got = append(got, ci.String())
+			}
+			if !slices.Equal(got, tt.wantIssues) {
+				t.Errorf("issues = %q, want %q", got, tt.wantIssues)
+			}
+		})
+	}
+}
+
+func TestClampSDPixels(t *testing.T) {
+	const limit = 2048 * 2048
+	tests := []struct {
+		name          string
+		width, height int
+		hrScale       float64
+		maxPixels     int
+		wantW, wantH  int
+	}{
+		{"within limit", 512, 768, 1, limit, 512, 768},
+		{"oversized", 4096, 4096, 1, limit, 2048, 2048},
+		{"oversized, no limit", 4096, 4096, 1, 0, 4096, 4096},
+		{"hires within limit", 512, 768, 2, limit, 512, 768},
+		{"hires output oversized", 1024, 1536, 2, limit, 832, 1248},
+		{"hires fractional scale", 4096, 4096, 1.5, limit, 1360, 1360},
+		{"hires, no limit", 1024, 1536, 2, 0, 1024, 1536},
+		{"scale below 1 is ignored", 4096, 4096, 0.5, limit, 2048, 2048},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, h := clampSDPixels(tt.width, tt.height, tt.hrScale, tt.maxPixels)
+			if w != tt.wantW || h != tt.wantH {
+				t.Fatalf("clampSDPixels(%d, %d, %g, %d) = %dx%d, want %dx%d", tt.width, tt.height, tt.hrScale, tt.maxPixels, w, h, tt.wantW, tt.wantH)
+			}
+			scale := max(tt.hrScale, 1)
+			if out := float64(w) * scale * float64(h) * scale; tt.maxPixels > 0 && out > float64(tt.maxPixels) {
+				t.Errorf("final image %.0f pixels exceeds %d", out, tt.maxPixels)
+			}
+		})
+	}
+}
+
+func TestLoadConfigClampsSDSize(t *testing.T) {
+	tests := []struct {
+		name         string
+		env          map[string]string
+		wantW, wantH int
+	}{
+		{"default size", nil, 512, 768},
+		{"oversized", map[string]string{"IMGCHAT_SD_WIDTH": "4096", "IMGCHAT_SD_HEIGHT": "4096"}, 2048, 2048},
+		{"hires within limit", map[string]string{"IMGCHAT_SD_HIRES": "1"}, 512, 768},
+		{"hires output oversized", map[string]string{"IMGCHAT_SD_WIDTH": "1024", "IMGCHAT_SD_HEIGHT": "1536", "IMGCHAT_SD_HIRES": "1"}, 832, 1248},
+		{"hires scale", map[string]string{"IMGCHAT_SD_WIDTH": "1024", "IMGCHAT_SD_HEIGHT": "1536", "IMGCHAT_SD_HIRES": "1", "IMGCHAT_SD_HIRES_SCALE": "1.2"}, 1024, 1536},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("PROMPT_GENERATOR", "ollama")
+			t.Setenv("IMAGE_GENERATOR", "sd")
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			cfg, err := LoadConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.SDWidth != tt.wantW || cfg.SDHeight != tt.wantH {
+				t.Errorf("SD size %dx%d, want %dx%d", cfg.SDWidth, cfg.SDHeight, tt.wantW, tt.wantH)
+			}
+		})
+	}
+}
+
+// writeCharacterFiles writes name -> content files into a new directory.
+func writeCharacterFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestLoadCharactersStyleModifiers(t *testing.T) {
+	shared := writeCharacterFiles(t, map[string]string{
+		"alice.md":            "Alice, a knight.",
+		"bob.md":              "Bob, a wizard.",
+		"_style_ink.md":       "thin ink outlines",
+		"_style_palette.md":   "pastel palette",
+		"_STYLE_lighting.md":  "---\nimage_model: ignored.safetensors\n---\nsoft rim lighting",
+		"_style_disabled.md":  "warm film grain",
+		"notes.txt":           "not a character",
+		"_style_palette.md~":  "editor backup",
+		"_style_untouched.md": "",
+	})
+	local := writeCharacterFiles(t, map[string]string{
+		"bob.md":             "Bob, a pirate.",
+		"_style_palette.md":  "neon palette",
+		"_style_disabled.md": "",
+	})
+
+	characters, modifiers, err := loadCharacters([]string{shared, local})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, c := range characters {
+		got = append(got, c.Name+": "+c.Setting)
+	}
+	if want := []string{"alice: Alice, a knight.", "bob: Bob, a pirate."}; !slices.Equal(got, want) {
+		t.Errorf("characters = %q, want %q", got, want)
+	}
+
+	got = nil
+	for _, m := range modifiers {
+		got = append(got, m.Name+": "+m.Setting)
+		if m.ImageModel != "" {
+			t.Errorf("style modifier %s kept image model %q", m.Name, m.ImageModel)
+		}
+	}
+	want := []string{"lighting: soft rim lighting", "ink: thin ink outlines", "palette: neon palette"}
+	if !slices.Equal(got, want) {
+		t.Errorf("style modifiers = %q, want %q", got, want)
+	}
+	if p := modifiers[2].Path; filepath.Dir(p) != local {
+		t.Errorf("palette loaded from %s, want the overriding directory", p)
+	}
+
+	// Rotation only ever picks characters, and every system prompt carries
+	// all the style modifiers.
+	cfg := &Config{CharacterMode: CharacterModeRotate, StyleModifiers: modifiers}
+	b := newPromptGeneratorBase(cfg, characters)
+	for i := range 2 * len(characters) {
+		idx := b.selectCharacterIndex("/projects/-home-me-app/session.jsonl")
+		if idx < 0 || idx >= len(characters) {
+			t.Fatalf("selection %d picked index %d of %d characters", i, idx, len(characters))
+		}
+		sp := b.buildSystemPrompt(idx)
+		if !strings.Contains(sp, characters[idx].Setting) {
+			t.Errorf("system prompt lacks the character %s", characters[idx].Name)
+		}
+		for _, m := range modifiers {
+			if !strings.Contains(sp, m.Setting) {
+				t.Errorf("system prompt for %s lacks style modifier %s", characters[idx].Name, m.Name)
+			}
+		}
+		if strings.Contains(sp, "pastel palette") {
+			t.Error("system prompt has the overridden style modifier")
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package imagechat
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/jpeg" // decode .jpg images
+	"image/png"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// contactSheetPrefix starts the filename of every contact sheet, so sheets
+// are never composited into later sheets or removed by image cleanup.
+const contactSheetPrefix = "contact_"
+
+// contactSheetCell is the side of the square cell each image is fitted into.
+const contactSheetCell = 256
+
+// contactSheetBackground fills the cells around images that are not square.
+var contactSheetBackground = color.RGBA{0x1a, 0x1a, 0x1a, 0xff}
+
+// isContactSheet reports whether name is a contact sheet saved by
+// saveContactSheet.
+func isContactSheet(name string) bool {
+	return strings.HasPrefix(name, contactSheetPrefix)
+}
+
+// saveContactSheet composites the newest cols*rows images of dir, newest
+// first, into one grid PNG saved alongside them. It returns the sheet's
+// filename, or "" if there were no images to composite or none was added
+// since the last sheet, which would come out the same.
+func saveContactSheet(cfg *Config, dir string, cols, rows int) (string, error) {
+	images, err := listImages(dir, func(name string) bool { return !isContactSheet(name) })
+	if err != nil {
+		return "", err
+	}
+	if len(images) == 0 {
+		return "", nil
+	}
+	sheets, err := listImages(dir, isContactSheet)
+	if err != nil {
+		return "", err
+	}
+	if len(sheets) > 0 && !images[0].modTime.After(sheets[0].modTime) {
+		return "", nil
+	}
+
+	sheet := image.NewRGBA(image.Rect(0, 0, cols*contactSheetCell, rows*contactSheetCell))
+	draw.Draw(sheet, sheet.Bounds(), image.NewUniform(contactSheetBackground), image.Point{}, draw.Src)
+	placed := 0
+	for _, f := range images {
+		if placed == cols*rows {
+			break
+		}
+		img, err := decodeImageFile(filepath.Join(dir, f.name))
+		if err != nil {
+			Debugf("contact sheet: skipping %s: %v", f.name, err)
+			continue
+		}
+		cell := image.Rect(0, 0, contactSheetCell, contactSheetCell).
+			Add(image.Pt(placed%cols*contactSheetCell, placed/cols*contactSheetCell))
+		drawFitted(sheet, cell, img)
+		placed++
+	}
+	if placed == 0 {
+		return "", nil
+	}
+
+	filename := fmt.Sprintf("%s%d%s", contactSheetPrefix, cfg.clock().Now().UnixMilli(), imageExt)
+	f, err := os.Create(filepath.Join(dir, filename))
+	if err != nil {
+		return "", err
+	}
+	if err := png.Encode(f, sheet); err != nil {
+		f.Close()
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	return filename, nil
+}
+
+// imageFile is an image in the image directory and when it was written.
+type imageFile struct {
+	name    string
+	modTime time.Time
+}
+
+// listImages returns the images in dir whose names match, newest first.
+func listImages(dir string, match func(name string) bool) ([]imageFile, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []imageFile
+	for _, e := range entries {
+		if e.IsDir() || !isImageFile(e.Name()) || !match(e.Name()) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, imageFile{name: e.Name(), modTime: info.ModTime()})
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if !files[i].modTime.Equal(files[j].modTime) {
+			return files[i].modTime.After(files[j].modTime)
+		}
+		// The names start with the save time in milliseconds.
+		return files[i].name > files[j].name
+	})
+	return files, nil
+}
+
+// pruneContactSheets removes all but the newest keep contact sheets of dir.
+// keep 0 keeps them all.
+func pruneContactSheets(dir string, keep int) {
+	if keep <= 0 {
+		return
+	}
+	sheets, err := listImages(dir, isContactSheet)
+	if err != nil {
+		Warnf("warning: could not list contact sheets: %v", err)
+		return
+	}
+	for _, f := range sheets[min(keep, len(sheets)):] {
+		if err := os.Remove(filepath.Join(dir, f.name)); err != nil && !os.IsNotExist(err) {
+			Warnf("warning: could not remove old contact sheet %s: %v", f.name, err)
+			continue
+		}
+		Debugf("removed old contact sheet %s", f.name)
+	}
+}
+
+func decodeImageFile(path string) (image.Image, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	return img, err
+}
+
+// drawFitted scales src to fit inside cell, keeping its aspect ratio, and
+// draws it centered. Scaling is nearest-neighbor, which is plenty for
+// thumbnails.
+func drawFitted(dst draw.Image, cell image.Rectangle, src image.Image) {
+	sb := src.Bounds()
+	if sb.Empty() {
+		return
+	}
+	w, h := cell.Dx(), cell.Dy()
+	if sb.Dx()*h > sb.Dy()*w {
+		h = max(sb.Dy()*w/sb.Dx(), 1)
+	} else {
+		w = max(sb.Dx()*h/sb.Dy(), 1)
+	}
+	x0 := cell.Min.X + (cell.Dx()-w)/2
+	y0 := cell.Min.Y + (cell.Dy()-h)/2
+	for y := 0; y < h; y++ {
+		sy := sb.Min.Y + y*sb.Dy()/h
+		for x := 0; x < w; x++ {
+			dst.Set(x0+x, y0+y, src.At(sb.Min.X+x*sb.Dx()/w, sy))
+		}
+	}
+}
+
+// runContactSheets saves a contact sheet of dir every cfg.ContactSheetInterval
+// until done is closed, passing each new sheet's filename to saved (if
+// non-nil) and keeping the newest cfg.ContactSheetKeep sheets. Sheets are
+// written through guard, so a full disk pauses them like images.
+func runContactSheets(cfg *Config, dir string, guard *DiskGuard, done <-chan struct{}, saved func(filename string)) {
+	ticker := time.NewTicker(cfg.ContactSheetInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			filename, err := guard.write(func() (string, error) {
+				return saveContactSheet(cfg, dir, cfg.ContactSheetCols, cfg.ContactSheetRows)
+			})
+			if errors.Is(err, errDiskUnavailable) {
+				Debugf("contact sheet: image directory not writable, skipping")
+				continue
+			}
+			if err != nil {
+				Errorf("contact sheet error: %v", err)
+				continue
+			}
+			if filename == "" {
+				Debugf("contact sheet: no new images since the last sheet")
+				continue
+			}
+			Infof("saved contact sheet %s", filename)
+			pruneContactSheets(dir, cfg.ContactSheetKeep)
+			if saved != nil {
+				saved(filename)
+			}
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package imagechat
+
+import (
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// writePNG writes a small PNG to dir/name, last modified at mtime.
+func writePNG(t *testing.T, dir, name string, mtime time.Time) {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := png.Encode(f, image.NewRGBA(image.Rect(0, 0, 8, 8))); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSaveContactSheetSkipsWithoutNewImages(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &Config{Clock: newSteppingClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC), time.Second)}
+
+	if name, err := saveContactSheet(cfg, dir, 2, 2); err != nil || name != "" {
+		t.Fatalf("empty directory: got %q, %v; want no sheet", name, err)
+	}
+
+	writePNG(t, dir, "img_1.png", time.Now().Add(-time.Hour))
+	writePNG(t, dir, "img_2.png", time.Now().Add(-time.Minute))
+	first, err := saveContactSheet(cfg, dir, 2, 2)
+	if err != nil || first == "" {
+		t.Fatalf("got %q, %v; want a sheet", first, err)
+	}
+
+	if name, err := saveContactSheet(cfg, dir, 2, 2); err != nil || name != "" {
+		t.Fatalf("no new images: got %q, %v; want no sheet", name, err)
+	}
+
+	writePNG(t, dir, "img_3.png", time.Now().Add(time.Minute))
+	second, err := saveContactSheet(cfg, dir, 2, 2)
+	if err != nil || second == "" || second == first {
+		t.Fatalf("after a new image: got %q, %v; want a new sheet", second, err)
+	}
+}
+
+func TestPruneContactSheets(t *testing.T) {
+	tests := []struct {
+		keep int
+		want []string
+	}{
+		{0, []string{"contact_1.png", "contact_2.png", "contact_3.png", "contact_4.png", "img_1.png"}},
+		{2, []string{"contact_3.png", "contact_4.png", "img_1.png"}},
+		{10, []string{"contact_1.png", "contact_2.png", "contact_3.png", "contact_4.png", "img_1.png"}},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		writeImages(t, dir, "img_1.png", "contact_1.png", "contact_2.png", "contact_3.png", "contact_4.png")
+		pruneContactSheets(dir, tt.keep)
+		if got := remainingFiles(t, dir); !slices.Equal(got, tt.want) {
+			t.Errorf("keep %d: left %q, want %q", tt.keep, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package imagechat
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// errDiskUnavailable is returned while image writes are paused because the
+// image directory is full or read-only. Callers should treat it as a skip.
+var errDiskUnavailable = errors.New("image directory is not writable")
+
+// diskErrorLogInterval rate-limits the repeated "still not writable" log.
+const diskErrorLogInterval = time.Minute
+
+// isDiskUnavailableError reports whether err means the disk is full or
+// mounted read-only, as opposed to a transient or backend error.
+func isDiskUnavailableError(err error) bool {
+	return errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EROFS) || errors.Is(err, errDiskUnavailable)
+}
+
+// DiskGuard pauses image generation when the image directory runs out of
+// space or becomes read-only, and resumes once it is writable again.
+type DiskGuard struct {
+	dir     string
+	minFree uint64
+	// onChange is called when generation is paused (true) or resumed (false).
+	onChange func(paused bool, reason string)
+
+	mu        sync.Mutex
+	paused    bool
+	lastLogAt time.Time
+}
+
+// NewDiskGuard returns a guard for dir. minFreeMB is the free space required
+// before each generation; 0 disables the space precheck.
+func NewDiskGuard(dir string, minFreeMB int, onChange func(paused bool, reason string)) *DiskGuard {
+	return &DiskGuard{
+		dir:      dir,
+		minFree:  uint64(minFreeMB) << 20,
+		onChange: onChange,
+	}
+}
+
+// check returns an error if the directory should not be written to now.
+// While paused it also probes with a real write, since a read-only mount
+// still reports free space.
+func (g *DiskGuard) check() error {
+	if g.minFree > 0 {
+		if free, err := freeDiskSpace(g.dir); err == nil && free < g.minFree {
+			return fmt.Errorf("%w: only %d MB free in %s (need %d MB)", syscall.ENOSPC, free>>20, g.dir, g.minFree>>20)
+		}
+	}
+	g.mu.Lock()
+	paused := g.paused
+	g.mu.Unlock()
+	if paused {
+		f, err := os.CreateTemp(g.dir, ".write-probe-*")
+		if err != nil {
+			return err
+		}
+		f.Close()
+		os.Remove(f.Name())
+	}
+	return nil
+}
+
+// fail pauses generation and logs an actionable message, at most once per
+// diskErrorLogInterval while the problem persists.
+func (g *DiskGuard) fail(err error) {
+	now := time.Now()
+	g.mu.Lock()
+	wasPaused := g.paused
+	g.paused = true
+	shouldLog := !wasPaused || now.Sub(g.lastLogAt) >= diskErrorLogInterval
+	if shouldLog {
+		g.lastLogAt = now
+	}
+	g.mu.Unlock()
+
+	if shouldLog {
+		Errorf("cannot write images to %s: %v — free up disk space or fix the directory permissions/mount; image generation is paused until it is writable again", g.dir, err)
+	}
+	if !wasPaused && g.onChange != nil {
+		g.onChange(true, err.Error())
+	}
+}
+
+// ok resumes generation if it was paused.
+func (g *DiskGuard) ok() {
+	g.mu.Lock()
+	wasPaused := g.paused
+	g.paused = false
+	g.mu.Unlock()
+
+	if wasPaused {
+		Infof("image directory %s is writable again, resuming image generation", g.dir)
+		if g.onChange != nil {
+			g.onChange(false, "")
+		}
+	}
+}
+
+// Wrap guards an ImageGenerator that writes into the guarded directory.
+func (g *DiskGuard) Wrap(gen ImageGenerator) ImageGenerator {
+	return &diskGuardImageGenerator{ImageGenerator: gen, guard: g}
+}
+
+// diskGuardImageGenerator skips generation while the disk is unavailable.
+type diskGuardImageGenerator struct {
+	ImageGenerator
+	guard *DiskGuard
+}
+
+func (d *diskGuardImageGenerator) Generate(prompt string) (string, error) {
+	return d.GenerateWithOptions(prompt, ImageOptions{})
+}
+
+func (d *diskGuardImageGenerator) GenerateWithOptions(prompt string, opts ImageOptions) (string, error) {
+	return d.guard.write(func() (string, error) {
+		return generateImage(d.ImageGenerator, prompt, opts)
+	})
+}
+
+// write runs save, which writes a file into the guarded directory and
+// returns its name, unless the directory is unavailable, in which case it
+// returns errDiskUnavailable. Its outcome pauses or resumes generation. A nil
+// guard just runs save.
+func (g *DiskGuard) write(save func() (string, error)) (string, error) {
+	if g == nil {
+		return save()
+	}
+	if err := g.check(); err != nil {
+		g.fail(err)
+		return "", errDiskUnavailable
+	}
+	filename, err := save()
+	if err != nil && isDiskUnavailableError(err) {
+		g.fail(err)
+		return "", errDiskUnavailable
+	}
+	if err == nil && filename != "" {
+		g.ok()
+	}
+	return filename, err
+}
+
+// diskNotice returns the user-facing notice for a pause/resume change.
+func diskNotice(paused bool, reason string) string {
+	if paused {
+		return "Cannot save images (" + reason + "); generation paused until disk space is freed"
+	}
+	return "Image directory is writable again; generation resumed"
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package imagechat
+
+import "errors"
+
+// freeDiskSpace is not implemented on this platform; the free-space precheck
+// is skipped and only write errors pause generation.
+func freeDiskSpace(dir string) (uint64, error) {
+	return 0, errors.New("free disk space check not supported on this platform")
+}
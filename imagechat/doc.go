@@ -0,0 +1,8 @@
+// Package imagechat watches Claude Code session logs, turns the conversation
+// into image prompts and renders them with an image generation backend.
+//
+// Run starts the complete application (watcher, generators, pipeline and web
+// UI). To embed only parts of it, wire a Watcher into a Pipeline with your
+// own PromptGenerator and ImageGenerator implementations, and optionally
+// mount Server.Handler on your own HTTP server.
+package imagechat
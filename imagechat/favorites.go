@@ -0,0 +1,100 @@
+package imagechat
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// favoritesFile is the name of the favorites list stored in the image directory.
+const favoritesFile = ".favorites.json"
+
+// FavoriteStore tracks images the user has marked as favorites. Favorites are
+// persisted next to the images so cleanupOldImages can skip them.
+type FavoriteStore struct {
+	imageDir string
+	mu       sync.Mutex
+	names    map[string]struct{}
+}
+
+func NewFavoriteStore(imageDir string) *FavoriteStore {
+	return &FavoriteStore{
+		imageDir: imageDir,
+		names:    loadFavorites(imageDir),
+	}
+}
+
+// Set marks or unmarks an image as a favorite and persists the change.
+func (fs *FavoriteStore) Set(name string, favorite bool) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if favorite {
+		fs.names[name] = struct{}{}
+	} else {
+		delete(fs.names, name)
+	}
+	return fs.saveLocked()
+}
+
+// Clear unmarks every favorite and persists the change.
+func (fs *FavoriteStore) Clear() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.names = make(map[string]struct{})
+	return fs.saveLocked()
+}
+
+// saveLocked writes the favorites list to the image directory.
+func (fs *FavoriteStore) saveLocked() error {
+	data, err := json.Marshal(fs.listLocked())
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(fs.imageDir, favoritesFile)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// List returns the favorite image filenames in sorted order.
+func (fs *FavoriteStore) List() []string {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.listLocked()
+}
+
+func (fs *FavoriteStore) listLocked() []string {
+	names := make([]string, 0, len(fs.names))
+	for n := range fs.names {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// loadFavorites reads the favorites list from imageDir. A missing or
+// unreadable list yields an empty set.
+func loadFavorites(imageDir string) map[string]struct{} {
+	names := make(map[string]struct{})
+	data, err := os.ReadFile(filepath.Join(imageDir, favoritesFile))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			Warnf("warning: could not read favorites: %v", err)
+		}
+		return names
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		Warnf("warning: ignoring corrupt favorites list: %v", err)
+		return names
+	}
+	for _, n := range list {
+		names[n] = struct{}{}
+	}
+	return names
+}
@@ -1,9 +1,8 @@
-package main
+package imagechat
 
 import (
 	"context"
 	"fmt"
-	"log"
 	"os"
 	"sync"
 
@@ -12,11 +11,12 @@ import (
 
 // GeminiImageGenerator generates images using the Gemini API.
 type GeminiImageGenerator struct {
-	client    *genai.Client
-	cfg       *Config
-	outputDir string
-	maxImages int
-	mu        sync.Mutex
+	imageCleanup
+	client     *genai.Client
+	cfg        *Config
+	outputDir  string
+	maxImages  int
+	mu         sync.Mutex
 	generating bool
 }
 
@@ -27,10 +27,7 @@ type GeminiImageGeneratorConfig struct {
 }
 
 func NewGeminiImageGenerator(igCfg GeminiImageGeneratorConfig) (*GeminiImageGenerator, error) {
-	client, err := genai.NewClient(context.Background(), &genai.ClientConfig{
-		APIKey:  igCfg.APIKey,
-		Backend: genai.BackendGeminiAPI,
-	})
+	client, err := genai.NewClient(context.Background(), geminiClientConfig(igCfg.Cfg, igCfg.APIKey))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create Gemini client: %w", err)
 	}
@@ -51,10 +48,16 @@ func NewGeminiImageGenerator(igCfg GeminiImageGeneratorConfig) (*GeminiImageGene
 // Returns the filename of the saved image. If generation is already in progress,
 // it returns ("", nil) to indicate the request was skipped.
 func (g *GeminiImageGenerator) Generate(prompt string) (string, error) {
+	return g.GenerateWithOptions(prompt, ImageOptions{})
+}
+
+// GenerateWithOptions is Generate with per-generation overrides. Only
+// SessionID is used, recorded in the image filename; Model is ignored.
+func (g *GeminiImageGenerator) GenerateWithOptions(prompt string, opts ImageOptions) (string, error) {
 	g.mu.Lock()
 	if g.generating {
 		g.mu.Unlock()
-		log.Println("image generation already in progress, skipping")
+		Infof("image generation already in progress, skipping")
 		return "", nil
 	}
 	g.generating = true
@@ -82,12 +85,12 @@ func (g *GeminiImageGenerator) Generate(prompt string) (string, error) {
 		return "", err
 	}
 
-	filename, err := saveImage(g.outputDir, imgData)
+	filename, err := saveImage(g.cfg, g.outputDir, imgData, opts)
 	if err != nil {
 		return "", err
 	}
 
-	cleanupOldImages(g.outputDir, g.maxImages)
+	g.cleanup(g.cfg, g.outputDir, g.maxImages)
 
 	return filename, nil
 }
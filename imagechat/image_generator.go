@@ -0,0 +1,526 @@
+package imagechat
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultMaxImages = 30
+
+// imageExt is the extension of the images saveImage writes.
+const imageExt = ".png"
+
+// imageExtensions are the file extensions treated as generated images by
+// cleanup, favorites and the image file server, so images of any format in
+// the directory are served and pruned alike.
+var imageExtensions = map[string]bool{
+	".png":  true,
+	".jpg":  true,
+	".jpeg": true,
+	".webp": true,
+}
+
+// isImageFile reports whether name has one of the imageExtensions.
+func isImageFile(name string) bool {
+	return imageExtensions[strings.ToLower(filepath.Ext(name))]
+}
+
+// ImageGenerator is the interface for image generation backends.
+type ImageGenerator interface {
+	Generate(prompt string) (string, error)
+}
+
+// ImageOptions are per-generation overrides for generators that support them.
+type ImageOptions struct {
+	// Model overrides the image model/checkpoint for this generation.
+	Model string
+	// SessionID is the session the image is for. It is recorded in the
+	// filename so cleanup can cap images per session.
+	SessionID string
+	// Title is the session title, drawn on the image with IMGCHAT_CAPTION.
+	Title string
+	// RandomSeed ignores IMGCHAT_SEED, so regenerating a prompt gives a
+	// different image even in reproducible mode.
+	RandomSeed bool
+}
+
+// optionsImageGenerator is implemented by image generators that accept
+// per-generation ImageOptions.
+type optionsImageGenerator interface {
+	GenerateWithOptions(prompt string, opts ImageOptions) (string, error)
+}
+
+// generateImage calls gen with opts if it supports them, or falls back to a
+// plain Generate.
+func generateImage(gen ImageGenerator, prompt string, opts ImageOptions) (string, error) {
+	if og, ok := gen.(optionsImageGenerator); ok {
+		return og.GenerateWithOptions(prompt, opts)
+	}
+	return gen.Generate(prompt)
+}
+
+// saveImage saves image data to the output directory with a timestamped filename,
+// followed by the session ID when one is given (img_<ms>_<session>.png).
+// With cfg.Caption set, the caption is drawn on the image first.
+// Returns the filename (not full path) of the saved image.
+func saveImage(cfg *Config, outputDir string, data []byte, opts ImageOptions) (string, error) {
+	// Read the clock once: in reproducible mode every call returns a later
+	// time, and the caption and filename should agree.
+	now := cfg.clock().Now()
+	if cfg != nil && cfg.Caption != CaptionOff {
+		if text := captionText(cfg.Caption, opts.Title, now); text != "" {
+			captioned, err := addCaption(data, text)
+			if err != nil {
+				return "", err
+			}
+			data = captioned
+		}
+	}
+	if cfg != nil && cfg.StripMetadata {
+		stripped, err := stripImageMetadata(data)
+		if err != nil {
+			return "", err
+		}
+		data = stripped
+	}
+
+	filename := fmt.Sprintf("img_%d%s", now.UnixMilli(), imageExt)
+	if sessionID := filenameSafe(opts.SessionID); sessionID != "" {
+		filename = fmt.Sprintf("img_%d_%s%s", now.UnixMilli(), sessionID, imageExt)
+	}
+	filePath := filepath.Join(outputDir, filename)
+
+	if err := os.WriteFile(filePath, data, 0o644); err != nil {
+		return "", fmt.Errorf("failed to save image: %w", err)
+	}
+
+	Infof("image saved: %s", filePath)
+	return filename, nil
+}
+
+// filenameSafe drops every character of s other than ASCII letters, digits
+// and '-', so it can be embedded in an image filename.
+func filenameSafe(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return -1
+	}, s)
+}
+
+// imageSession returns the session ID recorded in an image filename by
+// saveImage, or "" for images saved without one.
+func imageSession(filename string) string {
+	name := strings.TrimSuffix(strings.TrimPrefix(filename, "img_"), filepath.Ext(filename))
+	if _, session, ok := strings.Cut(name, "_"); ok {
+		return session
+	}
+	return ""
+}
+
+// clearImages removes every image file directly in dir, favorites and contact
+// sheets included, and returns how many were removed. Other files, such as
+// the favorites list, and subdirectories are left alone.
+func clearImages(dir string) (int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, e := range entries {
+		if !e.Type().IsRegular() || !isImageFile(e.Name()) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, e.Name())); err != nil {
+			Warnf("warning: could not remove %s: %v", e.Name(), err)
+			continue
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// cleanupOldImages removes the oldest images when the number of images exceeds maxImages.
+// With maxPerSession > 0 it first removes the oldest images of each session
+// beyond maxPerSession, so a busy session can't push out another session's
+// images; images without a session are capped as one group.
+// Favorited images and contact sheets are never removed and do not count
+// toward either limit. It returns the names of the removed images.
+func cleanupOldImages(outputDir string, maxImages, maxPerSession int) []string {
+	entries, err := os.ReadDir(outputDir)
+	if err != nil {
+		Debugf("cleanup: failed to read directory: %v", err)
+		return nil
+	}
+
+	// Collect only regular image files
+	type fileWithTime struct {
+		name    string
+		modTime time.Time
+	}
+	favorites := loadFavorites(outputDir)
+	var files []fileWithTime
+	for _, e := range entries {
+		if e.IsDir() || !isImageFile(e.Name()) || isContactSheet(e.Name()) {
+			continue
+		}
+		if _, ok := favorites[e.Name()]; ok {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, fileWithTime{name: e.Name(), modTime: info.ModTime()})
+	}
+
+	// Sort by modification time ascending (oldest first)
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.Before(files[j].modTime)
+	})
+
+	remove := func(name string) bool {
+		path := filepath.Join(outputDir, name)
+		if err := os.Remove(path); err != nil {
+			Debugf("cleanup: failed to remove %s: %v", path, err)
+			return false
+		}
+		Debugf("cleanup: removed old image %s", name)
+		return true
+	}
+
+	var removed []string
+	if maxPerSession > 0 {
+		// Walk newest first, keeping the first maxPerSession of each session.
+		perSession := make(map[string]int)
+		kept := make([]fileWithTime, 0, len(files))
+		for i := len(files) - 1; i >= 0; i-- {
+			session := imageSession(files[i].name)
+			if perSession[session] < maxPerSession {
+				perSession[session]++
+				kept = append(kept, files[i])
+			} else if remove(files[i].name) {
+				removed = append(removed, files[i].name)
+			}
+		}
+		slices.Reverse(kept)
+		files = kept
+	}
+
+	for i := 0; i < len(files)-maxImages; i++ {
+		if remove(files[i].name) {
+			removed = append(removed, files[i].name)
+		}
+	}
+	if len(removed) > 0 {
+		Infof("cleanup: removed %d old image(s), keeping %d", len(removed), min(len(files), maxImages))
+	}
+	return removed
+}
+
+// imageCleanup is embedded by the image generators to remove old images
+// after saving one and report what was removed.
+type imageCleanup struct {
+	onCleanup func(removed []string)
+}
+
+// SetCleanupHandler registers fn to be called with the names of the images
+// removed by each cleanup.
+func (c *imageCleanup) SetCleanupHandler(fn func(removed []string)) {
+	c.onCleanup = fn
+}
+
+// cleanup removes old images from outputDir as cleanupOldImages does, unless
+// cfg.KeepAllImages is set.
+func (c *imageCleanup) cleanup(cfg *Config, outputDir string, maxImages int) {
+	if cfg.KeepAllImages {
+		return
+	}
+	removed := cleanupOldImages(outputDir, maxImages, cfg.MaxImagesPerSession)
+	if len(removed) > 0 && c.onCleanup != nil {
+		c.onCleanup(removed)
+	}
+}
+
+// SDImageGenerator generates images using the Stable Diffusion WebUI API.
+type SDImageGenerator struct {
+	imageCleanup
+	cfg            *Config
+	outputDir      string
+	maxImages      int
+	steps          int
+	width          int
+	height         int
+	cfgScale       float64
+	samplerName    string
+	scheduler      string
+	extraPrompt    string
+	extraNegPrompt string
+	hires          SDHiresConfig
+	restoreFaces   bool
+	adetailerModel string
+	maxTokens      int
+	mu             sync.Mutex
+	generating     bool
+}
+
+type txt2imgRequest struct {
+	Prompt         string  `json:"prompt"`
+	NegativePrompt string  `json:"negative_prompt"`
+	Steps          int     `json:"steps"`
+	Width          int     `json:"width"`
+	Height         int     `json:"height"`
+	CfgScale       float64 `json:"cfg_scale"`
+	SamplerName    string  `json:"sampler_name"`
+	// Scheduler is omitted unless set, since older WebUIs don't accept it.
+	Scheduler string `json:"scheduler,omitempty"`
+	Seed      *int64 `json:"seed,omitempty"`
+
+	// Hires fix fields; omitted unless hires fix is enabled.
+	EnableHR          bool    `json:"enable_hr,omitempty"`
+	HRScale           float64 `json:"hr_scale,omitempty"`
+	HRUpscaler        string  `json:"hr_upscaler,omitempty"`
+	DenoisingStrength float64 `json:"denoising_strength,omitempty"`
+
+	// Face fixing; omitted unless enabled.
+	RestoreFaces    bool           `json:"restore_faces,omitempty"`
+	AlwaysonScripts map[string]any `json:"alwayson_scripts,omitempty"`
+
+	// OverrideSettings switches WebUI settings (e.g. the checkpoint) for this
+	// request only.
+	OverrideSettings map[string]any `json:"override_settings,omitempty"`
+}
+
+type txt2imgResponse struct {
+	Images []string `json:"images"`
+}
+
+type SDImageGeneratorConfig struct {
+	Cfg            *Config
+	OutputDir      string
+	Steps          int
+	Width          int
+	Height         int
+	CfgScale       float64
+	SamplerName    string
+	Scheduler      string
+	ExtraPrompt    string
+	ExtraNegPrompt string
+	Hires          SDHiresConfig
+	RestoreFaces   bool
+	// ADetailerModel enables the ADetailer extension with this detection
+	// model (e.g. "face_yolov8n.pt"). The extension must be installed.
+	ADetailerModel string
+	// MaxPromptTokens trims the prompt, keeping the character description,
+	// when its estimated CLIP token count exceeds this (0 disables trimming).
+	MaxPromptTokens int
+}
+
+// SDHiresConfig holds the AUTOMATIC1111 hires fix parameters.
+type SDHiresConfig struct {
+	Enabled   bool
+	Scale     float64
+	Upscaler  string
+	Denoising float64
+}
+
+// outputScale is how many times larger each side of the final image is than
+// the generated one: Scale with the hires fix enabled, 1 otherwise.
+func (h SDHiresConfig) outputScale() float64 {
+	if !h.Enabled {
+		return 1
+	}
+	return max(h.Scale, 1)
+}
+
+func NewSDImageGenerator(igCfg SDImageGeneratorConfig) (*SDImageGenerator, error) {
+	if err := os.MkdirAll(igCfg.OutputDir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create output directory: %w", err)
+	}
+	return &SDImageGenerator{
+		cfg:            igCfg.Cfg,
+		outputDir:      igCfg.OutputDir,
+		maxImages:      defaultMaxImages,
+		steps:          igCfg.Steps,
+		width:          igCfg.Width,
+		height:         igCfg.Height,
+		cfgScale:       igCfg.CfgScale,
+		samplerName:    igCfg.SamplerName,
+		scheduler:      igCfg.Scheduler,
+		extraPrompt:    igCfg.ExtraPrompt,
+		extraNegPrompt: igCfg.ExtraNegPrompt,
+		hires:          igCfg.Hires,
+		restoreFaces:   igCfg.RestoreFaces,
+		adetailerModel: igCfg.ADetailerModel,
+		maxTokens:      igCfg.MaxPromptTokens,
+	}, nil
+}
+
+// CheckConnection verifies that the Stable Diffusion WebUI server is reachable.
+// It returns nil on success, or an error describing what went wrong.
+func (ig *SDImageGenerator) CheckConnection(ctx context.Context) error {
+	url := strings.TrimRight(ig.cfg.GetSDBaseURL(), "/") + "/sdapi/v1/samplers"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	addHeaders(req, ig.cfg.SDHeaders)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("cannot connect to Stable Diffusion at %s: %w", ig.cfg.GetSDBaseURL(), err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Stable Diffusion returned status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// Generate sends the prompt to Stable Diffusion and saves the resulting image.
+// Returns the filename of the saved image. If generation is already in progress,
+// it returns ("", nil) to indicate the request was skipped.
+func (ig *SDImageGenerator) Generate(prompt string) (string, error) {
+	return ig.GenerateWithOptions(prompt, ImageOptions{})
+}
+
+// GenerateWithOptions is Generate with per-generation overrides; a Model
+// renders with that checkpoint instead of the WebUI's current one, and a
+// SessionID is recorded in the image filename.
+func (ig *SDImageGenerator) GenerateWithOptions(prompt string, opts ImageOptions) (string, error) {
+	ig.mu.Lock()
+	if ig.generating {
+		ig.mu.Unlock()
+		Infof("image generation already in progress, skipping")
+		return "", nil
+	}
+	ig.generating = true
+	ig.mu.Unlock()
+
+	defer func() {
+		ig.mu.Lock()
+		ig.generating = false
+		ig.mu.Unlock()
+	}()
+
+	if ig.maxTokens > 0 {
+		// The extra prompt is always sent, so it counts against the budget.
+		budget := ig.maxTokens
+		if ig.extraPrompt != "" {
+			budget = max(budget-estimateTokens(ig.extraPrompt)-1, 1)
+		}
+		if fitted, kept, total := fitPromptTokens(prompt, budget); fitted != prompt {
+			Infof("SD prompt exceeds ~%d tokens, kept %d of %d phrases (character first)", ig.maxTokens, kept, total)
+			Debugf("trimmed SD prompt: %s", fitted)
+			prompt = fitted
+		}
+	}
+
+	fullPrompt := prompt
+	if ig.extraPrompt != "" {
+		trimmed := strings.TrimRight(fullPrompt, " ")
+		if !strings.HasSuffix(trimmed, ",") {
+			fullPrompt = trimmed + ", "
+		}
+		fullPrompt += ig.extraPrompt
+	}
+	negativePrompt := normalizeNegativePrompt(ig.extraNegPrompt)
+
+	reqBody := txt2imgRequest{
+		Prompt:         fullPrompt,
+		NegativePrompt: negativePrompt,
+		Steps:          ig.steps,
+		Width:          ig.width,
+		Height:         ig.height,
+		CfgScale:       ig.cfgScale,
+		SamplerName:    ig.samplerName,
+		Scheduler:      ig.scheduler,
+	}
+	if ig.cfg.Seed >= 0 && !opts.RandomSeed {
+		seed := ig.cfg.Seed
+		reqBody.Seed = &seed
+	}
+	if ig.hires.Enabled {
+		reqBody.EnableHR = true
+		reqBody.HRScale = ig.hires.Scale
+		reqBody.HRUpscaler = ig.hires.Upscaler
+		reqBody.DenoisingStrength = ig.hires.Denoising
+	}
+	reqBody.RestoreFaces = ig.restoreFaces
+	if opts.Model != "" {
+		reqBody.OverrideSettings = map[string]any{"sd_model_checkpoint": opts.Model}
+	}
+	if ig.adetailerModel != "" {
+		reqBody.AlwaysonScripts = map[string]any{
+			"ADetailer": map[string]any{
+				"args": []any{
+					true,  // enable
+					false, // skip img2img
+					map[string]any{"ad_model": ig.adetailerModel},
+				},
+			},
+		}
+	}
+
+	jsonData, err := json.Marshal(reqBody)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	url := ig.cfg.GetSDBaseURL() + "/sdapi/v1/txt2img"
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(jsonData))
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	addHeaders(req, ig.cfg.SDHeaders)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("Stable Diffusion API error: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("Stable Diffusion returned %d: %s", resp.StatusCode, string(body))
+	}
+
+	var result txt2imgResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	if len(result.Images) == 0 {
+		return "", fmt.Errorf("no images in response")
+	}
+
+	imgData, err := base64.StdEncoding.DecodeString(result.Images[0])
+	if err != nil {
+		return "", fmt.Errorf("failed to decode base64 image: %w", err)
+	}
+
+	filename, err := saveImage(ig.cfg, ig.outputDir, imgData, opts)
+	if err != nil {
+		return "", err
+	}
+
+	ig.cleanup(ig.cfg, ig.outputDir, ig.maxImages)
+
+	return filename, nil
+}
@@ -0,0 +1,241 @@
+package imagechat
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReproducibleFilenames(t *testing.T) {
+	t.Setenv("PROMPT_GENERATOR", "ollama")
+	t.Setenv("IMAGE_GENERATOR", "sd")
+	t.Setenv("IMGCHAT_REPRODUCIBLE", "1")
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cfg.timerClock().(realClock); !ok {
+		t.Errorf("timerClock() = %T, want the wall clock", cfg.timerClock())
+	}
+
+	dir := t.TempDir()
+	data := pngWithChunks(t)
+	want := []string{
+		"img_1704067200000_abc-123.png",
+		"img_1704067201000_abc-123.png",
+		"img_1704067202000.png",
+	}
+	sessions := []string{"abc-123", "abc-123", ""}
+	for i, session := range sessions {
+		name, err := saveImage(cfg, dir, data, ImageOptions{SessionID: session})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name != want[i] {
+			t.Errorf("image %d saved as %s, want %s", i, name, want[i])
+		}
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+// writeImages creates the named files in dir, each a second newer than the
+// one before.
+func writeImages(t *testing.T, dir string, names ...string) {
+	t.Helper()
+	base := time.Now().Add(-time.Hour)
+	for i, name := range names {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("x"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		mtime := base.Add(time.Duration(i) * time.Second)
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// remainingFiles lists the files left in dir.
+func remainingFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+func TestCleanupOldImagesPerSession(t *testing.T) {
+	tests := []struct {
+		name          string
+		images        []string // oldest first
+		maxImages     int
+		maxPerSession int
+		want          []string // sorted
+	}{
+		{
+			name: "busy session does not evict a quiet one",
+			images: []string{
+				"img_1_quiet.png",
+				"img_2_busy.png", "img_3_busy.png", "img_4_busy.png", "img_5_busy.png", "img_6_busy.png",
+			},
+			maxImages: 10, maxPerSession: 2,
+			want: []string{"img_1_quiet.png", "img_5_busy.png", "img_6_busy.png"},
+		},
+		{
+			name: "each session pruned independently",
+			images: []string{
+				"img_1_a.png", "img_2_b.png", "img_3_a.png", "img_4_b.png", "img_5_a.png", "img_6_b.png",
+			},
+			maxImages: 10, maxPerSession: 1,
+			want: []string{"img_5_a.png", "img_6_b.png"},
+		},
+		{
+			name:      "images without a session capped as one group",
+			images:    []string{"img_1.png", "img_2.png", "img_3.png", "img_4_a.png"},
+			maxImages: 10, maxPerSession: 2,
+			want: []string{"img_2.png", "img_3.png", "img_4_a.png"},
+		},
+		{
+			name:      "global cap applies after the session caps",
+			images:    []string{"img_1_a.png", "img_2_b.png", "img_3_c.png", "img_4_c.png", "img_5_c.png"},
+			maxImages: 3, maxPerSession: 2,
+			want: []string{"img_2_b.png", "img_4_c.png", "img_5_c.png"},
+		},
+		{
+			name:      "no session cap",
+			images:    []string{"img_1_a.png", "img_2_a.png", "img_3_a.png"},
+			maxImages: 2, maxPerSession: 0,
+			want: []string{"img_2_a.png", "img_3_a.png"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeImages(t, dir, tt.images...)
+			removed := cleanupOldImages(dir, tt.maxImages, tt.maxPerSession)
+			got := remainingFiles(t, dir)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("kept %q, want %q", got, tt.want)
+			}
+			if len(removed)+len(got) != len(tt.images) {
+				t.Errorf("reported %d removed, but %d of %d images are gone", len(removed), len(tt.images)-len(got), len(tt.images))
+			}
+		})
+	}
+}
+
+func TestCleanupOldImagesMixedFormats(t *testing.T) {
+	dir := t.TempDir()
+	writeImages(t, dir,
+		"img_1.png", "img_2.jpg", "img_3.JPEG", "img_4.webp", "img_5.png", "img_6.jpg",
+		"notes.txt", contactSheetPrefix+"1.png",
+	)
+	if err := os.WriteFile(filepath.Join(dir, favoritesFile), []byte(`["img_1.png"]`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every format counts toward the cap; favorites, contact sheets and
+	// other files are left alone.
+	removed := cleanupOldImages(dir, 2, 0)
+	slices.Sort(removed)
+	if want := []string{"img_2.jpg", "img_3.JPEG", "img_4.webp"}; !slices.Equal(removed, want) {
+		t.Errorf("removed %q, want %q", removed, want)
+	}
+	want := []string{favoritesFile, contactSheetPrefix + "1.png", "img_1.png", "img_5.png", "img_6.jpg", "notes.txt"}
+	slices.Sort(want)
+	if got := remainingFiles(t, dir); !slices.Equal(got, want) {
+		t.Errorf("kept %q, want %q", got, want)
+	}
+}
+
+func TestIsImageFile(t *testing.T) {
+	for name, want := range map[string]bool{
+		"a.png": true, "a.jpg": true, "a.jpeg": true, "a.webp": true, "A.PNG": true,
+		"a.gif": false, "a.txt": false, "favorites.json": false, "png": false,
+	} {
+		if got := isImageFile(name); got != want {
+			t.Errorf("isImageFile(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+// fakeSD serves a Stable Diffusion WebUI txt2img endpoint that answers with
+// a small PNG and records the requests.
+type fakeSD struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests []txt2imgRequest
+}
+
+func newFakeSD(t *testing.T) *fakeSD {
+	t.Helper()
+	png := base64.StdEncoding.EncodeToString(pngWithChunks(t))
+	sd := &fakeSD{}
+	sd.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req txt2imgRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		sd.mu.Lock()
+		sd.requests = append(sd.requests, req)
+		sd.mu.Unlock()
+		json.NewEncoder(w).Encode(txt2imgResponse{Images: []string{png}})
+	}))
+	t.Cleanup(sd.Close)
+	return sd
+}
+
+func (sd *fakeSD) lastRequest(t *testing.T) txt2imgRequest {
+	t.Helper()
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	if len(sd.requests) == 0 {
+		t.Fatal("no txt2img request")
+	}
+	return sd.requests[len(sd.requests)-1]
+}
+
+func TestSDImageGeneratorNegativePrompt(t *testing.T) {
+	tests := []struct {
+		extra string
+		want  string
+	}{
+		{"", ""},
+		{", lowres,, blurry ,", "lowres, blurry"},
+		{"(worst quality:1.4),", "(worst quality:1.4)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.extra, func(t *testing.T) {
+			sd := newFakeSD(t)
+			ig, err := NewSDImageGenerator(SDImageGeneratorConfig{
+				Cfg:            &Config{SDBaseURL: sd.URL, Seed: -1},
+				OutputDir:      t.TempDir(),
+				ExtraNegPrompt: tt.extra,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := ig.Generate("1girl"); err != nil {
+				t.Fatal(err)
+			}
+			if got := sd.lastRequest(t).NegativePrompt; got != tt.want {
+				t.Errorf("negative_prompt = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package imagechat
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	_ "image/jpeg" // register JPEG decoder for re-encoding
+	"image/png"
+)
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// pngKeepChunks lists the PNG chunks needed to render the image correctly.
+// Everything else (tEXt, zTXt, iTXt, eXIf, tIME, private chunks, ...) is dropped.
+var pngKeepChunks = map[string]bool{
+	"IHDR": true, "PLTE": true, "IDAT": true, "IEND": true,
+	"tRNS": true, "gAMA": true, "cHRM": true, "sRGB": true,
+	"sBIT": true, "pHYs": true, "bKGD": true,
+}
+
+// stripImageMetadata returns the image with all metadata removed. PNG input
+// has its non-essential chunks dropped without touching pixel data; any other
+// format is decoded and re-encoded as a plain PNG.
+func stripImageMetadata(data []byte) ([]byte, error) {
+	if bytes.HasPrefix(data, pngSignature) {
+		if out, err := stripPNGChunks(data); err == nil {
+			return out, nil
+		}
+		// Malformed chunk stream; fall back to a full re-encode.
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image for metadata stripping: %w", err)
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, fmt.Errorf("failed to re-encode image: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// stripPNGChunks copies only the chunks in pngKeepChunks.
+func stripPNGChunks(data []byte) ([]byte, error) {
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(pngSignature)
+
+	pos := len(pngSignature)
+	for pos < len(data) {
+		if pos+8 > len(data) {
+			return nil, fmt.Errorf("truncated chunk header")
+		}
+		length := int(binary.BigEndian.Uint32(data[pos : pos+4]))
+		chunkType := string(data[pos+4 : pos+8])
+		end := pos + 12 + length // header + data + CRC
+		if length < 0 || end > len(data) {
+			return nil, fmt.Errorf("truncated %s chunk", chunkType)
+		}
+		if pngKeepChunks[chunkType] {
+			out.Write(data[pos:end])
+		}
+		pos = end
+		if chunkType == "IEND" {
+			break
+		}
+	}
+	return out.Bytes(), nil
+}
@@ -0,0 +1,119 @@
+package imagechat
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testImage() image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, 2, 2))
+	img.Set(0, 0, color.RGBA{R: 0xff, A: 0xff})
+	return img
+}
+
+// pngChunk encodes a PNG chunk with its length and CRC.
+func pngChunk(typ string, data []byte) []byte {
+	var b bytes.Buffer
+	binary.Write(&b, binary.BigEndian, uint32(len(data)))
+	b.WriteString(typ)
+	b.Write(data)
+	binary.Write(&b, binary.BigEndian, crc32.ChecksumIEEE(append([]byte(typ), data...)))
+	return b.Bytes()
+}
+
+// pngWithChunks returns a PNG with extra chunks inserted before IEND.
+func pngWithChunks(t *testing.T, chunks ...[]byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, testImage()); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	iend := len(data) - 12
+	out := append([]byte(nil), data[:iend]...)
+	for _, c := range chunks {
+		out = append(out, c...)
+	}
+	return append(out, data[iend:]...)
+}
+
+// pngChunkTypes lists the chunk types of a PNG in order.
+func pngChunkTypes(t *testing.T, data []byte) []string {
+	t.Helper()
+	if !bytes.HasPrefix(data, pngSignature) {
+		t.Fatal("not a PNG")
+	}
+	var types []string
+	for pos := len(pngSignature); pos+8 <= len(data); {
+		length := int(binary.BigEndian.Uint32(data[pos : pos+4]))
+		types = append(types, string(data[pos+4:pos+8]))
+		pos += 12 + length
+	}
+	return types
+}
+
+func TestStripImageMetadata(t *testing.T) {
+	var jpg bytes.Buffer
+	if err := jpeg.Encode(&jpg, testImage(), nil); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"png tEXt", pngWithChunks(t, pngChunk("tEXt", []byte("parameters\x00a secret prompt")))},
+		{"png all text chunks", pngWithChunks(t,
+			pngChunk("tEXt", []byte("parameters\x00a secret prompt")),
+			pngChunk("zTXt", []byte("comment\x00\x00x")),
+			pngChunk("iTXt", []byte("prompt\x00\x00\x00\x00\x00a secret prompt")),
+			pngChunk("eXIf", []byte("MM\x00*")),
+			pngChunk("tIME", []byte{0x07, 0xea, 1, 1, 0, 0, 0}),
+		)},
+		{"jpeg", jpg.Bytes()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := stripImageMetadata(tt.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, typ := range pngChunkTypes(t, out) {
+				if !pngKeepChunks[typ] {
+					t.Errorf("chunk %s survived stripping", typ)
+				}
+			}
+			if bytes.Contains(out, []byte("a secret prompt")) {
+				t.Error("prompt text survived stripping")
+			}
+			if _, err := png.Decode(bytes.NewReader(out)); err != nil {
+				t.Errorf("stripped image does not decode: %v", err)
+			}
+		})
+	}
+}
+
+func TestSaveImageStripMetadata(t *testing.T) {
+	dir := t.TempDir()
+	data := pngWithChunks(t, pngChunk("tEXt", []byte("parameters\x00a secret prompt")))
+	name, err := saveImage(&Config{StripMetadata: true}, dir, data, ImageOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, typ := range pngChunkTypes(t, saved) {
+		if typ == "tEXt" || typ == "zTXt" || typ == "iTXt" {
+			t.Errorf("saved image has a %s chunk", typ)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package imagechattest_test
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/egawata/dev-image-chat/imagechat"
+	"github.com/egawata/dev-image-chat/imagechat/imagechattest"
+)
+
+// Example runs the pipeline offline: a session file event goes in, the fake
+// backends turn it into a prompt and an image, and the image is broadcast.
+func Example() {
+	// Any backend that needs no API key; the fakes replace it.
+	os.Setenv("PROMPT_GENERATOR", "ollama")
+	os.Setenv("IMAGE_GENERATOR", "sd")
+	os.Setenv("GENERATE_INTERVAL", "1")
+	cfg, err := imagechat.LoadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	dir, err := os.MkdirTemp("", "imagechattest")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	promptGen := imagechattest.NewPromptGenerator("1girl, reading a book, library")
+	imageGen, err := imagechattest.NewImageGenerator(dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	events := make(chan imagechat.FileEvent)
+	images := make(chan imagechat.SessionImage)
+	p := imagechat.NewPipeline(imagechat.PipelineConfig{
+		Config:    cfg,
+		Events:    events,
+		PromptGen: promptGen,
+		ImageGen:  imageGen,
+		Clock:     imagechattest.NewClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)),
+		Broadcast: func(si imagechat.SessionImage) { images <- si },
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go p.Run(ctx)
+
+	events <- imagechat.FileEvent{
+		Path: "/home/me/.claude/projects/-home-me-app/5f2c.jsonl",
+		NewData: []byte(`{"type":"user","message":{"role":"user","content":"Fix the parser"}}
+{"type":"assistant","uuid":"u1","message":{"id":"m1","role":"assistant","content":[{"type":"text","text":"Done, the parser handles empty lines now."}]}}
+`),
+	}
+	si := <-images
+
+	req := promptGen.Requests()[0]
+	fmt.Println("messages:", len(req.Messages))
+	fmt.Println("prompt:", imageGen.Prompts()[0])
+	fmt.Println("image:", si.Filename, "for session", si.SessionID)
+	if _, err := os.Stat(filepath.Join(dir, si.Filename)); err == nil {
+		fmt.Println("written to disk")
+	}
+	// Output:
+	// messages: 2
+	// prompt: 1girl, reading a book, library
+	// image: fake_1.png for session 5f2c
+	// written to disk
+}
@@ -0,0 +1,164 @@
+// Package imagechattest provides fake backends and a manual clock for running
+// the imagechat pipeline and server offline, without Stable Diffusion, Gemini
+// or Ollama.
+package imagechattest
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/egawata/dev-image-chat/imagechat"
+)
+
+// PromptGenerator is an imagechat.PromptGenerator that returns a canned
+// prompt and records every request.
+type PromptGenerator struct {
+	// Prompt is returned by Generate.
+	Prompt string
+	// Err, if set, is returned instead of Prompt.
+	Err error
+
+	mu       sync.Mutex
+	requests []imagechat.PromptRequest
+}
+
+func NewPromptGenerator(prompt string) *PromptGenerator {
+	return &PromptGenerator{Prompt: prompt}
+}
+
+func (g *PromptGenerator) Generate(ctx context.Context, req imagechat.PromptRequest) (string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.requests = append(g.requests, req)
+	if g.Err != nil {
+		return "", g.Err
+	}
+	return g.Prompt, nil
+}
+
+// Requests returns the requests received so far.
+func (g *PromptGenerator) Requests() []imagechat.PromptRequest {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return append([]imagechat.PromptRequest(nil), g.requests...)
+}
+
+// ImageGenerator is an imagechat.ImageGenerator that writes a 1x1 PNG into
+// Dir for every prompt and records the prompts.
+type ImageGenerator struct {
+	Dir string
+	// Err, if set, is returned instead of writing an image.
+	Err error
+
+	mu      sync.Mutex
+	prompts []string
+}
+
+func NewImageGenerator(dir string) (*ImageGenerator, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create output directory: %w", err)
+	}
+	return &ImageGenerator{Dir: dir}, nil
+}
+
+func (g *ImageGenerator) Generate(prompt string) (string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.prompts = append(g.prompts, prompt)
+	if g.Err != nil {
+		return "", g.Err
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, 1, 1))
+	img.Set(0, 0, color.RGBA{R: 0xff, A: 0xff})
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return "", err
+	}
+	filename := fmt.Sprintf("fake_%d.png", len(g.prompts))
+	if err := os.WriteFile(filepath.Join(g.Dir, filename), buf.Bytes(), 0o644); err != nil {
+		return "", fmt.Errorf("failed to save image: %w", err)
+	}
+	return filename, nil
+}
+
+// Prompts returns the prompts received so far.
+func (g *ImageGenerator) Prompts() []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return append([]string(nil), g.prompts...)
+}
+
+// Clock is a manually advanced imagechat.Clock. Timers fire synchronously
+// inside Advance, in deadline order.
+type Clock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*timer
+}
+
+type timer struct {
+	c       *Clock
+	at      time.Time
+	f       func()
+	stopped bool
+}
+
+func (t *timer) Stop() bool {
+	t.c.mu.Lock()
+	defer t.c.mu.Unlock()
+	wasActive := !t.stopped
+	t.stopped = true
+	return wasActive
+}
+
+func NewClock(start time.Time) *Clock {
+	return &Clock{now: start}
+}
+
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *Clock) AfterFunc(d time.Duration, f func()) imagechat.Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &timer{c: c, at: c.now.Add(d), f: f}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// Advance moves the clock forward by d and runs every timer that became due.
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	var due, pending []*timer
+	for _, t := range c.timers {
+		switch {
+		case t.stopped:
+		case !t.at.After(c.now):
+			t.stopped = true
+			due = append(due, t)
+		default:
+			pending = append(pending, t)
+		}
+	}
+	c.timers = pending
+	c.mu.Unlock()
+
+	sort.Slice(due, func(i, j int) bool { return due[i].at.Before(due[j].at) })
+	for _, t := range due {
+		t.f()
+	}
+}
@@ -0,0 +1,77 @@
+package imagechat
+
+import (
+	"log"
+	"strings"
+)
+
+// LogLevel controls which messages are logged. Each level includes the ones
+// before it.
+type LogLevel int
+
+const (
+	LogLevelError LogLevel = iota
+	LogLevelWarn
+	LogLevelInfo
+	LogLevelDebug
+)
+
+var logLevelNames = []string{"error", "warn", "info", "debug"}
+
+func (l LogLevel) String() string {
+	if l < LogLevelError || l > LogLevelDebug {
+		return "unknown"
+	}
+	return logLevelNames[l]
+}
+
+// ParseLogLevel parses a level name (error, warn, info or debug). "warning"
+// is accepted for warn.
+func ParseLogLevel(s string) (LogLevel, bool) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "warning" {
+		s = "warn"
+	}
+	for i, name := range logLevelNames {
+		if s == name {
+			return LogLevel(i), true
+		}
+	}
+	return LogLevelInfo, false
+}
+
+// logLevel is the current level; messages above it are dropped. Until
+// InitLogger is called (e.g. while loading the configuration) it is info.
+var logLevel = LogLevelInfo
+
+// InitLogger sets the log level.
+func InitLogger(level LogLevel) {
+	logLevel = level
+}
+
+func logAt(level LogLevel, format string, args ...any) {
+	if level <= logLevel {
+		log.Printf(format, args...)
+	}
+}
+
+// Errorf logs a failure that needs attention.
+func Errorf(format string, args ...any) {
+	logAt(LogLevelError, format, args...)
+}
+
+// Warnf logs a problem the app works around, such as an invalid setting
+// replaced by its default. Messages start with "warning: ".
+func Warnf(format string, args ...any) {
+	logAt(LogLevelWarn, format, args...)
+}
+
+// Infof logs routine progress, such as a saved image or a connected client.
+func Infof(format string, args ...any) {
+	logAt(LogLevelInfo, format, args...)
+}
+
+// Debugf logs a message only at the debug level.
+func Debugf(format string, args ...any) {
+	logAt(LogLevelDebug, format, args...)
+}
@@ -1,4 +1,4 @@
-package main
+package imagechat
 
 import (
 	"bytes"
@@ -32,20 +32,19 @@ type ollamaChatMessage struct {
 
 type ollamaChatOptions struct {
 	Temperature float64 `json:"temperature"`
+	Seed        *int64  `json:"seed,omitempty"`
 }
 
 type ollamaChatResponse struct {
 	Message ollamaChatMessage `json:"message"`
 }
 
-func NewOllamaPromptGenerator(baseURL string, cfg *Config, characterSettings []string) *OllamaPromptGenerator {
+func NewOllamaPromptGenerator(baseURL string, cfg *Config, characters []Character) *OllamaPromptGenerator {
 	return &OllamaPromptGenerator{
-		promptGeneratorBase: promptGeneratorBase{
-			characterSettings: characterSettings,
-		},
-		baseURL:     baseURL,
-		cfg:         cfg,
-		temperature: 0.8,
+		promptGeneratorBase: newPromptGeneratorBase(cfg, characters),
+		baseURL:             baseURL,
+		cfg:                 cfg,
+		temperature:         0.8,
 	}
 }
 
@@ -58,6 +57,7 @@ func (pg *OllamaPromptGenerator) CheckConnection(ctx context.Context) error {
 	if err != nil {
 		return fmt.Errorf("failed to create request: %w", err)
 	}
+	addHeaders(req, pg.cfg.OllamaHeaders)
 
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
@@ -95,16 +95,12 @@ func (pg *OllamaPromptGenerator) CheckConnection(ctx context.Context) error {
 	return fmt.Errorf("model %q not found in Ollama (available: %s)", pg.cfg.GetOllamaModel(), strings.Join(available, ", "))
 }
 
-func (pg *OllamaPromptGenerator) Generate(ctx context.Context, messages []Message, sessionPath string) (string, error) {
-	charIdx := pg.selectCharacterIndex(sessionPath)
-	systemPrompt := pg.buildSystemPrompt(charIdx)
-	pg.logDebugInfo(sessionPath, charIdx, messages)
-
-	userPrompt, err := pg.buildUserPrompt(messages)
-	if err != nil {
-		return "", err
-	}
+func (pg *OllamaPromptGenerator) Generate(ctx context.Context, req PromptRequest) (string, error) {
+	return pg.generateWith(ctx, pg, req)
+}
 
+// complete sends a single system+user prompt pair to Ollama and returns the text reply.
+func (pg *OllamaPromptGenerator) complete(ctx context.Context, systemPrompt, userPrompt string) (string, error) {
 	reqBody := ollamaChatRequest{
 		Model: pg.cfg.GetOllamaModel(),
 		Messages: []ollamaChatMessage{
@@ -114,6 +110,13 @@ func (pg *OllamaPromptGenerator) Generate(ctx context.Context, messages []Messag
 		Stream:  false,
 		Options: ollamaChatOptions{Temperature: pg.temperature},
 	}
+	if pg.cfg.Reproducible {
+		reqBody.Options.Temperature = 0
+		if pg.cfg.Seed >= 0 {
+			seed := pg.cfg.Seed
+			reqBody.Options.Seed = &seed
+		}
+	}
 
 	jsonData, err := json.Marshal(reqBody)
 	if err != nil {
@@ -126,6 +129,7 @@ func (pg *OllamaPromptGenerator) Generate(ctx context.Context, messages []Messag
 		return "", fmt.Errorf("failed to create ollama request: %w", err)
 	}
 	req.Header.Set("Content-Type", "application/json")
+	addHeaders(req, pg.cfg.OllamaHeaders)
 
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
@@ -148,5 +152,5 @@ func (pg *OllamaPromptGenerator) Generate(ctx context.Context, messages []Messag
 		return "", fmt.Errorf("empty response from ollama")
 	}
 
-	return extractPromptFromResponse(text), nil
+	return text, nil
 }
@@ -0,0 +1,135 @@
+package imagechat
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+)
+
+// Outcome is the notable result of the tool runs in the assistant's current
+// turn, such as a test run, given to the prompt generator as a hint about the
+// mood of the scene.
+type Outcome string
+
+const (
+	OutcomeNone           Outcome = ""
+	OutcomeTestsPassed    Outcome = "tests_passed"
+	OutcomeTestsFailed    Outcome = "tests_failed"
+	OutcomeBuildSucceeded Outcome = "build_succeeded"
+	OutcomeBuildFailed    Outcome = "build_failed"
+	OutcomeFileCreated    Outcome = "file_created"
+)
+
+// outcomeHints describe each outcome to the prompt generator.
+var outcomeHints = map[Outcome]string{
+	OutcomeTestsPassed:    "the tests just passed, a moment of success and relief",
+	OutcomeTestsFailed:    "the tests just failed, a setback to puzzle over",
+	OutcomeBuildSucceeded: "the build just succeeded, a small win",
+	OutcomeBuildFailed:    "the build just failed with errors, a frustrating snag",
+	OutcomeFileCreated:    "a new file was just created, the start of something new",
+}
+
+// Hint returns the description of o for the prompt generator, or "" for
+// OutcomeNone.
+func (o Outcome) Hint() string {
+	return outcomeHints[o]
+}
+
+// outcomePatterns recognize outcomes in tool output, checked in order so
+// failures win over the successes often reported alongside them
+// ("3 passed, 1 failed").
+var outcomePatterns = []struct {
+	outcome Outcome
+	re      *regexp.Regexp
+}{
+	{OutcomeTestsFailed, regexp.MustCompile(`(?im)^(--- )?FAIL\b|\b[1-9]\d* (tests? )?failed\b|\btests? failed\b|✗|✘`)},
+	{OutcomeBuildFailed, regexp.MustCompile(`(?im)\b(build|compilation) failed\b|^\S*:\d+:\d+: |^error(\[\w+\])?: |\berror TS\d+:|\bSyntaxError\b`)},
+	{OutcomeTestsPassed, regexp.MustCompile(`(?im)^(--- )?PASS\b|^ok\s+\S+\s+[\d.]+s|\b[1-9]\d* (tests? )?passed\b|\ball tests passed\b|✓|✔`)},
+	{OutcomeBuildSucceeded, regexp.MustCompile(`(?i)\bbuild succeeded\b|\bbuild successful\b|\bcompiled successfully\b|\bfinished .*release|\bbuilt in [\d.]+m?s\b`)},
+	{OutcomeFileCreated, regexp.MustCompile(`(?i)\bfile created successfully\b|\bcreated (new )?file\b`)},
+}
+
+// classifyToolResult returns the outcome reported by one tool result.
+func classifyToolResult(text string) Outcome {
+	for _, p := range outcomePatterns {
+		if p.re.MatchString(text) {
+			return p.outcome
+		}
+	}
+	return OutcomeNone
+}
+
+// classifyOutcome returns the outcome of the most recent tool result that
+// reports one, newest first.
+func classifyOutcome(results []string) Outcome {
+	for i := len(results) - 1; i >= 0; i-- {
+		if o := classifyToolResult(results[i]); o != OutcomeNone {
+			return o
+		}
+	}
+	return OutcomeNone
+}
+
+// toolResultBlock is a tool_result element of a user entry's content array.
+// Its content is either a string or an array of text blocks.
+type toolResultBlock struct {
+	Type    string          `json:"type"`
+	Content json.RawMessage `json:"content"`
+}
+
+// currentToolResults returns the text of the tool results logged in data
+// since the user's last typed message, oldest first.
+func currentToolResults(data []byte) []string {
+	var results []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		var entry rawEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil || entry.Type != "user" || entry.Message == nil {
+			continue
+		}
+		var msg rawMessage
+		if err := json.Unmarshal(entry.Message, &msg); err != nil {
+			continue
+		}
+		var typed string
+		if json.Unmarshal(msg.Content, &typed) == nil {
+			results = results[:0]
+			continue
+		}
+		var blocks []toolResultBlock
+		if err := json.Unmarshal(msg.Content, &blocks); err != nil {
+			continue
+		}
+		for _, b := range blocks {
+			if b.Type != "tool_result" {
+				continue
+			}
+			if text := toolResultText(b.Content); text != "" {
+				results = append(results, text)
+			}
+		}
+	}
+	return results
+}
+
+// toolResultText returns the text of a tool_result's content.
+func toolResultText(raw json.RawMessage) string {
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		return s
+	}
+	var blocks []contentBlock
+	if err := json.Unmarshal(raw, &blocks); err != nil {
+		return ""
+	}
+	var parts []string
+	for _, b := range blocks {
+		if b.Type == "text" {
+			parts = append(parts, b.Text)
+		}
+	}
+	return strings.Join(parts, "\n")
+}
@@ -0,0 +1,76 @@
+package imagechat
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+)
+
+func TestClassifyToolResult(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   Outcome
+	}{
+		{"go test ok", "ok  \tgithub.com/me/app/pkg\t0.412s\n", OutcomeTestsPassed},
+		{"go test fail", "--- FAIL: TestParse (0.00s)\n    parse_test.go:12: got 1, want 2\nFAIL\n", OutcomeTestsFailed},
+		{"jest passed", "Tests:       12 passed, 12 total\nTime:        1.9 s", OutcomeTestsPassed},
+		{"vitest check marks", " ✓ src/app.test.ts (3)\n", OutcomeTestsPassed},
+		{"pytest failed", "===== 2 failed, 10 passed in 0.31s =====", OutcomeTestsFailed},
+		{"go build error", "./main.go:12:5: undefined: foo\n", OutcomeBuildFailed},
+		{"rust error", "error[E0308]: mismatched types\n", OutcomeBuildFailed},
+		{"tsc error", "src/app.ts(3,7): error TS2322: Type 'string' is not assignable", OutcomeBuildFailed},
+		{"cargo release", "    Finished release [optimized] target(s) in 4.20s", OutcomeBuildSucceeded},
+		{"webpack", "webpack 5.90.0 compiled successfully in 1234 ms", OutcomeBuildSucceeded},
+		{"file created", "File created successfully at: /home/me/app/new.go", OutcomeFileCreated},
+		{"plain output", "total 8\ndrwxr-xr-x  2 me me 4096 Jan  1 00:00 .\n", OutcomeNone},
+		{"error in prose", "no errors found", OutcomeNone},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := classifyToolResult(tt.output); got != tt.want {
+				t.Errorf("classifyToolResult(%q) = %q, want %q", tt.output, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClassifyOutcome(t *testing.T) {
+	tests := []struct {
+		name    string
+		results []string
+		want    Outcome
+	}{
+		{"none", nil, OutcomeNone},
+		{"newest wins", []string{"--- FAIL: TestX", "ok  \tapp\t0.1s"}, OutcomeTestsPassed},
+		{"newest without outcome is skipped", []string{"Build failed", "README.md"}, OutcomeBuildFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := classifyOutcome(tt.results); got != tt.want {
+				t.Errorf("classifyOutcome(%q) = %q, want %q", tt.results, got, tt.want)
+			}
+		})
+	}
+}
+
+// toolResultEntry returns a user log entry carrying one tool result.
+func toolResultEntry(content string) string {
+	return fmt.Sprintf(`{"type":"user","message":{"role":"user","content":[{"type":"tool_result","tool_use_id":"t1","content":%s}]}}`+"\n", content)
+}
+
+func TestCurrentToolResults(t *testing.T) {
+	log := toolResultEntry(`"old result"`) +
+		`{"type":"user","message":{"role":"user","content":"run the tests"}}` + "\n" +
+		`{"type":"assistant","message":{"role":"assistant","content":[{"type":"tool_use","name":"Bash"}]}}` + "\n" +
+		toolResultEntry(`"FAIL"`) +
+		toolResultEntry(`[{"type":"text","text":"ok  \tapp\t0.1s"},{"type":"image"}]`)
+
+	got := currentToolResults([]byte(log))
+	if want := []string{"FAIL", "ok  \tapp\t0.1s"}; !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if o := classifyOutcome(got); o != OutcomeTestsPassed {
+		t.Errorf("outcome = %q, want %q", o, OutcomeTestsPassed)
+	}
+}
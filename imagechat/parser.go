@@ -0,0 +1,509 @@
+package imagechat
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Message struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+	// Timestamp is when the message was logged; zero if unknown. It is not
+	// sent to the prompt generator.
+	Timestamp time.Time `json:"-"`
+	// ID is the uuid of the log entry the message was parsed from (the last
+	// one for a streamed turn), stable across re-reads; "" if unknown. It is
+	// not sent to the prompt generator.
+	ID string `json:"-"`
+}
+
+// SessionImage is the JSON structure sent over WebSocket to the browser.
+type SessionImage struct {
+	Filename  string `json:"filename"`
+	SessionID string `json:"sessionId"`
+	Title     string `json:"title"`
+	Project   string `json:"project,omitempty"`
+	Character string `json:"character,omitempty"`
+	UpdatedAt string `json:"updatedAt"`
+	// PreviousFilename is the session's image before this one, so the UI
+	// can animate the transition. Set by the server; empty for the first.
+	PreviousFilename string `json:"previousFilename,omitempty"`
+}
+
+// PromptWithSession carries a prompt along with session metadata through the pipeline.
+type PromptWithSession struct {
+	Prompt    string
+	SessionID string
+	Title     string
+	Project   string
+	Character string
+	// ImageModel overrides the image model for this prompt ("" = default).
+	ImageModel string
+}
+
+// rawEntry represents a single line in the JSONL log.
+type rawEntry struct {
+	Type      string          `json:"type"`
+	Message   json.RawMessage `json:"message"`
+	Timestamp string          `json:"timestamp"`
+	UUID      string          `json:"uuid"`
+	// Content is the text of a "system" entry.
+	Content json.RawMessage `json:"content"`
+	// Summary is the text of a "summary" entry.
+	Summary string `json:"summary"`
+}
+
+// rawMessage is the message field inside a rawEntry.
+type rawMessage struct {
+	// ID identifies an assistant message. A streamed turn is logged as
+	// several entries sharing the same ID.
+	ID      string          `json:"id"`
+	Content json.RawMessage `json:"content"`
+	// StopReason is why an assistant message ended ("end_turn",
+	// "tool_use", ...); streamed chunks log it as null.
+	StopReason string `json:"stop_reason"`
+}
+
+// contentBlock represents one element of the assistant's content array.
+type contentBlock struct {
+	Type     string `json:"type"`
+	Text     string `json:"text"`
+	Thinking string `json:"thinking"` // reasoning text for thinking blocks
+	Name     string `json:"name"`     // tool name for tool_use blocks
+}
+
+// ParseOptions controls optional parsing behavior.
+type ParseOptions struct {
+	// ToolUseScenes turns assistant turns that contain only tool calls into a
+	// synthetic "working" message instead of dropping them.
+	ToolUseScenes bool
+	// IncludeTypes are the log entry types to parse, each of which must have
+	// an entry in entryHandlers. Nil means DefaultIncludeTypes.
+	IncludeTypes []string
+	// IncludeThinking keeps the text of assistant "thinking" blocks, ahead
+	// of the reply they lead to. redacted_thinking blocks carry no readable
+	// text and are always dropped.
+	IncludeThinking bool
+}
+
+// DefaultIncludeTypes are the log entry types parsed by default: the
+// conversation itself.
+var DefaultIncludeTypes = []string{"user", "assistant"}
+
+// entryHandler turns a log entry into a message, or returns nil to skip it.
+type entryHandler func(entry rawEntry, opts ParseOptions) *Message
+
+// entryHandlers maps each log entry type that can be included in the context
+// to its handler. Messages from types other than user and assistant are
+// context only: they never trigger generation.
+var entryHandlers = map[string]entryHandler{
+	"user": func(entry rawEntry, _ ParseOptions) *Message {
+		return parseUserEntry(entry.Message)
+	},
+	"assistant": func(entry rawEntry, opts ParseOptions) *Message {
+		return parseAssistantEntry(entry.Message, opts)
+	},
+	"system":  parseSystemEntry,
+	"summary": parseSummaryEntry,
+}
+
+// EntryTypes returns the log entry types that can be included, sorted.
+func EntryTypes() []string {
+	types := make([]string, 0, len(entryHandlers))
+	for t := range entryHandlers {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// ParseJSONL parses JSONL bytes and extracts user/assistant conversation messages.
+func ParseJSONL(data []byte) []Message {
+	return ParseJSONLWithOptions(data, ParseOptions{})
+}
+
+// ParseJSONLWithOptions is like ParseJSONL but with optional behavior enabled by opts.
+func ParseJSONLWithOptions(data []byte, opts ParseOptions) []Message {
+	include := opts.IncludeTypes
+	if include == nil {
+		include = DefaultIncludeTypes
+	}
+	handlers := make(map[string]entryHandler, len(include))
+	for _, t := range include {
+		if h, ok := entryHandlers[t]; ok {
+			handlers[t] = h
+		}
+	}
+
+	var messages []Message
+	// lastID is the assistant message ID of the last entry in messages.
+	var lastID string
+
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		var entry rawEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			continue
+		}
+
+		handler, ok := handlers[entry.Type]
+		if !ok {
+			continue
+		}
+		msg := handler(entry, opts)
+		if msg == nil {
+			continue
+		}
+		var id string
+		if entry.Type == "assistant" {
+			id = assistantMessageID(entry.Message)
+		}
+		if ts, err := time.Parse(time.RFC3339Nano, entry.Timestamp); err == nil {
+			msg.Timestamp = ts
+		}
+		msg.ID = entry.UUID
+		if id != "" && id == lastID {
+			// Continuation of a streamed turn: one logical message.
+			last := &messages[len(messages)-1]
+			last.Content = mergeContinuation(last.Content, msg.Content)
+			if !msg.Timestamp.IsZero() {
+				last.Timestamp = msg.Timestamp
+			}
+			if msg.ID != "" {
+				last.ID = msg.ID
+			}
+			continue
+		}
+		messages = append(messages, *msg)
+		lastID = id
+	}
+
+	return messages
+}
+
+func parseUserEntry(raw json.RawMessage) *Message {
+	if raw == nil {
+		return nil
+	}
+
+	var msg rawMessage
+	if err := json.Unmarshal(raw, &msg); err != nil {
+		return nil
+	}
+
+	// content is a plain string → user's direct input
+	var strContent string
+	if err := json.Unmarshal(msg.Content, &strContent); err == nil {
+		strContent = strings.TrimSpace(strContent)
+		if strContent != "" {
+			return &Message{Role: "user", Content: strContent}
+		}
+		return nil
+	}
+
+	// content is an array → likely tool_result, skip
+	return nil
+}
+
+func parseAssistantEntry(raw json.RawMessage, opts ParseOptions) *Message {
+	if raw == nil {
+		return nil
+	}
+
+	var msg rawMessage
+	if err := json.Unmarshal(raw, &msg); err != nil {
+		return nil
+	}
+
+	// content should be an array of blocks
+	var blocks []contentBlock
+	if err := json.Unmarshal(msg.Content, &blocks); err != nil {
+		return nil
+	}
+
+	var textParts []string
+	var tools []string
+	for _, b := range blocks {
+		switch {
+		case b.Type == "text" && strings.TrimSpace(b.Text) != "":
+			textParts = append(textParts, strings.TrimSpace(b.Text))
+		case b.Type == "thinking" && opts.IncludeThinking && strings.TrimSpace(b.Thinking) != "":
+			textParts = append(textParts, strings.TrimSpace(b.Thinking))
+		case b.Type == "tool_use" && b.Name != "":
+			tools = append(tools, b.Name)
+		}
+	}
+
+	if len(textParts) == 0 {
+		// No text: the turn is either empty or pure tool use.
+		if opts.ToolUseScenes && len(tools) > 0 {
+			return &Message{Role: "assistant", Content: workingMessage(tools)}
+		}
+		return nil
+	}
+
+	return &Message{
+		Role:    "assistant",
+		Content: strings.Join(textParts, "\n"),
+	}
+}
+
+// parseSystemEntry returns a "system" entry, a note such as a hook result or
+// a compaction marker, as a system message.
+func parseSystemEntry(entry rawEntry, _ ParseOptions) *Message {
+	var content string
+	if err := json.Unmarshal(entry.Content, &content); err != nil {
+		return nil
+	}
+	content = strings.TrimSpace(content)
+	if content == "" {
+		return nil
+	}
+	return &Message{Role: "system", Content: content}
+}
+
+// parseSummaryEntry returns a "summary" entry, Claude Code's one-line summary
+// of the conversation, as a summary message.
+func parseSummaryEntry(entry rawEntry, _ ParseOptions) *Message {
+	summary := strings.TrimSpace(entry.Summary)
+	if summary == "" {
+		return nil
+	}
+	return &Message{Role: "summary", Content: summary}
+}
+
+// isTurn reports whether m is a user or assistant message, as opposed to one
+// included from another entry type for context.
+func isTurn(m Message) bool {
+	return m.Role == "user" || m.Role == "assistant"
+}
+
+// lastTurn returns the last user or assistant message of msgs, or false if
+// there is none.
+func lastTurn(msgs []Message) (Message, bool) {
+	for i := len(msgs) - 1; i >= 0; i-- {
+		if isTurn(msgs[i]) {
+			return msgs[i], true
+		}
+	}
+	return Message{}, false
+}
+
+// assistantMessageID returns the ID of an assistant entry's message, or "".
+func assistantMessageID(raw json.RawMessage) string {
+	var msg rawMessage
+	if raw == nil || json.Unmarshal(raw, &msg) != nil {
+		return ""
+	}
+	return msg.ID
+}
+
+// mergeContinuation combines the content of two entries of one streamed
+// assistant turn. An entry may repeat the text logged so far, and synthetic
+// "working" text gives way to real text.
+func mergeContinuation(prev, next string) string {
+	switch {
+	case isWorkingMessage(next) && !isWorkingMessage(prev):
+		return prev
+	case isWorkingMessage(prev), strings.HasPrefix(next, prev):
+		return next
+	case strings.Contains(prev, next):
+		return prev
+	}
+	return prev + "\n" + next
+}
+
+// isWorkingMessage reports whether s was produced by workingMessage.
+func isWorkingMessage(s string) bool {
+	return strings.HasPrefix(s, workingPrefix) && strings.HasSuffix(s, ")")
+}
+
+const workingPrefix = "(The assistant is working: ran "
+
+// workingMessage describes an assistant turn that only ran tools.
+func workingMessage(tools []string) string {
+	seen := make(map[string]bool, len(tools))
+	var unique []string
+	for _, t := range tools {
+		if !seen[t] {
+			seen[t] = true
+			unique = append(unique, t)
+		}
+	}
+	return workingPrefix + strings.Join(unique, ", ") + ")"
+}
+
+// TailMessages returns the last n messages from the slice.
+func TailMessages(msgs []Message, n int) []Message {
+	if len(msgs) <= n {
+		return msgs
+	}
+	return msgs[len(msgs)-n:]
+}
+
+// WithLatestUserMessage returns recent (a tail of msgs) with the latest user
+// message from msgs prepended if recent contains no user message, so the
+// user's tone is always part of the context.
+func WithLatestUserMessage(msgs, recent []Message) []Message {
+	for _, m := range recent {
+		if m.Role == "user" {
+			return recent
+		}
+	}
+	for i := len(msgs) - len(recent) - 1; i >= 0; i-- {
+		if msgs[i].Role == "user" {
+			out := make([]Message, 0, len(recent)+1)
+			out = append(out, msgs[i])
+			return append(out, recent...)
+		}
+	}
+	return recent
+}
+
+// maxWindowMessages caps how many messages WindowMessages returns, so a long
+// burst of activity cannot produce an oversized prompt.
+const maxWindowMessages = 50
+
+// WindowMessages returns the trailing messages logged at or after
+// now - window. Messages without a timestamp end the window.
+func WindowMessages(msgs []Message, window time.Duration, now time.Time) []Message {
+	cutoff := now.Add(-window)
+	start := len(msgs)
+	for start > 0 {
+		ts := msgs[start-1].Timestamp
+		if ts.IsZero() || ts.Before(cutoff) {
+			break
+		}
+		start--
+	}
+	return TailMessages(msgs[start:], maxWindowMessages)
+}
+
+// Recent-context strategies for selecting the messages sent to the prompt generator.
+const (
+	RecentByCount  = "count"  // last RecentMessages messages
+	RecentByWindow = "window" // messages within RecentWindow
+	RecentByEither = "either" // whichever of the two selects more
+)
+
+// SelectRecentMessages picks the context for a prompt using the given
+// strategy. If the time window selects nothing (e.g. the log has no
+// timestamps), it falls back to the last count messages.
+func SelectRecentMessages(msgs []Message, strategy string, count int, window time.Duration, now time.Time) []Message {
+	byCount := TailMessages(msgs, count)
+	if strategy == RecentByCount || window <= 0 {
+		return byCount
+	}
+	byWindow := WindowMessages(msgs, window, now)
+	if len(byWindow) == 0 {
+		return byCount
+	}
+	if strategy == RecentByEither && len(byCount) > len(byWindow) {
+		return byCount
+	}
+	return byWindow
+}
+
+// Which messages a prompt is generated from.
+const (
+	ContextRoleAll  = "all"  // the conversation, triggered by assistant replies
+	ContextRoleUser = "user" // only the user's messages, triggered by them
+)
+
+// isUserText reports whether m is a message the user typed. User entries
+// starting with '<' are typically system/tool content.
+func isUserText(m Message) bool {
+	return m.Role == "user" && !strings.HasPrefix(m.Content, "<")
+}
+
+// UserMessages returns the messages of msgs the user typed.
+func UserMessages(msgs []Message) []Message {
+	var out []Message
+	for _, m := range msgs {
+		if isUserText(m) {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+// ExtractTitle returns the first real user message's text, truncated to maxLen runes.
+// Messages starting with '<' are skipped as they are typically system/tool content.
+func ExtractTitle(messages []Message, maxLen int) string {
+	for _, m := range messages {
+		if isUserText(m) {
+			return truncateRunes(m.Content, maxLen)
+		}
+	}
+	return ""
+}
+
+// SessionIDFromPath extracts a session ID from a JSONL file path.
+// It returns the basename without the .jsonl extension.
+func SessionIDFromPath(path string) string {
+	base := filepath.Base(path)
+	return strings.TrimSuffix(base, ".jsonl")
+}
+
+// ProjectFromPath derives a project label from a session file path.
+// Claude Code stores sessions under ~/.claude/projects/<encoded cwd>/, where
+// the working directory is encoded by replacing path separators with "-".
+// Since directory names may contain "-" themselves, the path is rebuilt
+// greedily against the local filesystem; the label is the name of the
+// resolved project directory, or the last "-"-separated part when the
+// directory does not exist locally. The label is worked out once per
+// project directory and remembered.
+func ProjectFromPath(path string) string {
+	dir := filepath.Base(filepath.Dir(path))
+	if label, ok := projectLabels.Load(dir); ok {
+		return label.(string)
+	}
+	label := decodeProjectDir(dir)
+	projectLabels.Store(dir, label)
+	return label
+}
+
+// projectLabels caches ProjectFromPath by encoded project directory name,
+// so the filesystem is not probed on every prompt. Sessions come from a
+// handful of projects, so it stays small.
+var projectLabels sync.Map
+
+// decodeProjectDir resolves an encoded project directory name to the label
+// ProjectFromPath returns.
+func decodeProjectDir(dir string) string {
+	encoded := strings.TrimPrefix(dir, "-")
+	if encoded == "" || encoded == "." {
+		return ""
+	}
+	parts := strings.Split(encoded, "-")
+
+	resolved := string(filepath.Separator)
+	cur := ""
+	for i, part := range parts {
+		if cur == "" {
+			cur = part
+		} else {
+			cur += "-" + part
+		}
+		if i == len(parts)-1 {
+			break
+		}
+		if info, err := os.Stat(filepath.Join(resolved, cur)); err == nil && info.IsDir() {
+			resolved = filepath.Join(resolved, cur)
+			cur = ""
+		}
+	}
+	if info, err := os.Stat(filepath.Join(resolved, cur)); err == nil && info.IsDir() && cur != "" {
+		return cur
+	}
+	return parts[len(parts)-1]
+}
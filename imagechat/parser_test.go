@@ -0,0 +1,324 @@
+package imagechat
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// encodeProjectDir encodes a working directory as Claude Code names its
+// project directory.
+func encodeProjectDir(dir string) string {
+	return strings.ReplaceAll(dir, string(filepath.Separator), "-")
+}
+
+func TestProjectFromPath(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"my-app", "plain", filepath.Join("nested", "tool-kit")} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		name string
+		dir  string // encoded project directory
+		want string
+	}{
+		{"existing dir with dash", encodeProjectDir(filepath.Join(root, "my-app")), "my-app"},
+		{"existing dir", encodeProjectDir(filepath.Join(root, "plain")), "plain"},
+		{"nested dir with dash", encodeProjectDir(filepath.Join(root, "nested", "tool-kit")), "tool-kit"},
+		{"missing dir", "-nonexistent-home-someone-web-site", "site"},
+		{"no project dir", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(tt.dir, "0b1e6a5c.jsonl")
+			if got := ProjectFromPath(path); got != tt.want {
+				t.Errorf("ProjectFromPath(%q) = %q, want %q", path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProjectFromPathRemembersLabel(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "cached-app")
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join("/home/me/.claude/projects", encodeProjectDir(dir), "s.jsonl")
+	if got := ProjectFromPath(path); got != "cached-app" {
+		t.Fatalf("ProjectFromPath = %q, want %q", got, "cached-app")
+	}
+	// Without the directory the label would fall back to "app"; the
+	// remembered one is used without probing again.
+	if err := os.Remove(dir); err != nil {
+		t.Fatal(err)
+	}
+	if got := ProjectFromPath(path); got != "cached-app" {
+		t.Errorf("ProjectFromPath after removal = %q, want %q", got, "cached-app")
+	}
+}
+
+// timestampedSession is a session log with messages 10, 6, 4 and 1 minute(s)
+// before windowNow, and one without a timestamp first.
+const timestampedSession = `{"type":"user","message":{"role":"user","content":"untimed"}}
+{"type":"user","timestamp":"2026-01-01T11:50:00Z","message":{"role":"user","content":"m10"}}
+{"type":"assistant","timestamp":"2026-01-01T11:54:00Z","message":{"id":"a1","role":"assistant","content":[{"type":"text","text":"m6"}]}}
+{"type":"user","timestamp":"2026-01-01T11:56:00Z","message":{"role":"user","content":"m4"}}
+{"type":"assistant","timestamp":"2026-01-01T11:59:00Z","message":{"id":"a2","role":"assistant","content":[{"type":"text","text":"m1"}]}}
+`
+
+var windowNow = time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+func contents(msgs []Message) []string {
+	out := []string{}
+	for _, m := range msgs {
+		out = append(out, m.Content)
+	}
+	return out
+}
+
+func TestWindowMessages(t *testing.T) {
+	msgs := ParseJSONL([]byte(timestampedSession))
+	tests := []struct {
+		window time.Duration
+		want   []string
+	}{
+		{30 * time.Second, []string{}},
+		{time.Minute, []string{"m1"}},
+		{5 * time.Minute, []string{"m4", "m1"}},
+		{6 * time.Minute, []string{"m6", "m4", "m1"}},
+		// The untimed message ends the window.
+		{time.Hour, []string{"m10", "m6", "m4", "m1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.window.String(), func(t *testing.T) {
+			got := contents(WindowMessages(msgs, tt.window, windowNow))
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("WindowMessages(%s) = %q, want %q", tt.window, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWindowMessagesCap(t *testing.T) {
+	msgs := make([]Message, maxWindowMessages+10)
+	for i := range msgs {
+		msgs[i] = Message{Role: "user", Content: strconv.Itoa(i), Timestamp: windowNow}
+	}
+	got := WindowMessages(msgs, time.Minute, windowNow)
+	if len(got) != maxWindowMessages || got[len(got)-1].Content != strconv.Itoa(len(msgs)-1) {
+		t.Errorf("got %d messages ending at %q, want the last %d", len(got), got[len(got)-1].Content, maxWindowMessages)
+	}
+}
+
+func TestSelectRecentMessages(t *testing.T) {
+	msgs := ParseJSONL([]byte(timestampedSession))
+	tests := []struct {
+		name     string
+		strategy string
+		count    int
+		window   time.Duration
+		want     []string
+	}{
+		{"count", RecentByCount, 2, 6 * time.Minute, []string{"m4", "m1"}},
+		{"window", RecentByWindow, 1, 6 * time.Minute, []string{"m6", "m4", "m1"}},
+		{"window without window set", RecentByWindow, 2, 0, []string{"m4", "m1"}},
+		{"window selecting nothing", RecentByWindow, 2, 30 * time.Second, []string{"m4", "m1"}},
+		{"either, count larger", RecentByEither, 3, time.Minute, []string{"m6", "m4", "m1"}},
+		{"either, window larger", RecentByEither, 1, 5 * time.Minute, []string{"m4", "m1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := contents(SelectRecentMessages(msgs, tt.strategy, tt.count, tt.window, windowNow))
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// streamEntry returns an assistant log entry of message id with one block.
+func streamEntry(uuid, id, blockType, text string) string {
+	block := fmt.Sprintf(`{"type":"text","text":%q}`, text)
+	switch blockType {
+	case "tool_use":
+		block = fmt.Sprintf(`{"type":"tool_use","name":%q}`, text)
+	case "thinking":
+		block = fmt.Sprintf(`{"type":"thinking","thinking":%q}`, text)
+	}
+	return fmt.Sprintf(`{"type":"assistant","uuid":%q,"message":{"id":%q,"role":"assistant","content":[%s]}}`+"\n", uuid, id, block)
+}
+
+func TestParseJSONLCoalescesStreamedTurn(t *testing.T) {
+	tests := []struct {
+		name    string
+		log     string
+		opts    ParseOptions
+		want    []string
+		wantIDs []string
+	}{
+		{
+			name:    "partial then final",
+			log:     streamEntry("u1", "m1", "text", "Let me") + streamEntry("u2", "m1", "text", "Let me check the parser."),
+			want:    []string{"Let me check the parser."},
+			wantIDs: []string{"u2"},
+		},
+		{
+			name:    "separate blocks",
+			log:     streamEntry("u1", "m1", "text", "First part.") + streamEntry("u2", "m1", "text", "Second part."),
+			want:    []string{"First part.\nSecond part."},
+			wantIDs: []string{"u2"},
+		},
+		{
+			name:    "repeated entry",
+			log:     streamEntry("u1", "m1", "text", "Done.") + streamEntry("u1", "m1", "text", "Done."),
+			want:    []string{"Done."},
+			wantIDs: []string{"u1"},
+		},
+		{
+			name:    "tool use between text",
+			log:     streamEntry("u1", "m1", "text", "Reading it.") + streamEntry("u2", "m1", "tool_use", "Read") + streamEntry("u3", "m1", "text", "Found it."),
+			want:    []string{"Reading it.\nFound it."},
+			wantIDs: []string{"u3"},
+		},
+		{
+			name:    "working text gives way to real text",
+			log:     streamEntry("u1", "m1", "tool_use", "Bash") + streamEntry("u2", "m1", "text", "Tests pass."),
+			opts:    ParseOptions{ToolUseScenes: true},
+			want:    []string{"Tests pass."},
+			wantIDs: []string{"u2"},
+		},
+		{
+			name:    "different messages stay apart",
+			log:     streamEntry("u1", "m1", "text", "One.") + streamEntry("u2", "m2", "text", "Two."),
+			want:    []string{"One.", "Two."},
+			wantIDs: []string{"u1", "u2"},
+		},
+		{
+			name: "user message in between",
+			log: streamEntry("u1", "m1", "text", "One.") +
+				`{"type":"user","uuid":"u2","message":{"role":"user","content":"ok"}}` + "\n" +
+				streamEntry("u3", "m1", "text", "Two."),
+			want:    []string{"One.", "ok", "Two."},
+			wantIDs: []string{"u1", "u2", "u3"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msgs := ParseJSONLWithOptions([]byte(tt.log), tt.opts)
+			if got := contents(msgs); !slices.Equal(got, tt.want) {
+				t.Errorf("contents = %q, want %q", got, tt.want)
+			}
+			var ids []string
+			for _, m := range msgs {
+				ids = append(ids, m.ID)
+			}
+			if !slices.Equal(ids, tt.wantIDs) {
+				t.Errorf("IDs = %q, want %q", ids, tt.wantIDs)
+			}
+		})
+	}
+}
+
+func TestParseJSONLIncludeTypes(t *testing.T) {
+	log := `{"type":"summary","summary":"Fixing the login bug","leafUuid":"u3"}` + "\n" +
+		`{"type":"user","uuid":"u1","message":{"role":"user","content":"Why does login fail?"}}` + "\n" +
+		`{"type":"system","uuid":"s1","content":"PostToolUse hook blocked the edit","level":"warning"}` + "\n" +
+		`{"type":"file-history-snapshot","snapshot":{}}` + "\n" +
+		streamEntry("u3", "m1", "text", "The token expired.")
+
+	tests := []struct {
+		name    string
+		include []string
+		want    []string
+	}{
+		{
+			name: "default",
+			want: []string{"user: Why does login fail?", "assistant: The token expired."},
+		},
+		{
+			name:    "system",
+			include: []string{"user", "assistant", "system"},
+			want:    []string{"user: Why does login fail?", "system: PostToolUse hook blocked the edit", "assistant: The token expired."},
+		},
+		{
+			name:    "summary",
+			include: []string{"user", "assistant", "summary"},
+			want:    []string{"summary: Fixing the login bug", "user: Why does login fail?", "assistant: The token expired."},
+		},
+		{
+			name:    "assistant only",
+			include: []string{"assistant"},
+			want:    []string{"assistant: The token expired."},
+		},
+		{
+			name:    "unknown type",
+			include: []string{"user", "assistant", "file-history-snapshot"},
+			want:    []string{"user: Why does login fail?", "assistant: The token expired."},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, m := range ParseJSONLWithOptions([]byte(log), ParseOptions{IncludeTypes: tt.include}) {
+				got = append(got, m.Role+": "+m.Content)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLastTurnSkipsIncludedTypes(t *testing.T) {
+	msgs := []Message{
+		{Role: "user", Content: "question"},
+		{Role: "system", Content: "hook ran"},
+		{Role: "summary", Content: "Debugging"},
+	}
+	got, ok := lastTurn(msgs)
+	if !ok || got.Content != "question" {
+		t.Errorf("lastTurn = %q, %v; want %q", got.Content, ok, "question")
+	}
+	if _, ok := lastTurn(msgs[1:]); ok {
+		t.Error("lastTurn found a turn among system and summary messages")
+	}
+}
+
+func TestParseJSONLThinking(t *testing.T) {
+	entry := func(blocks string) string {
+		return `{"type":"assistant","uuid":"u1","message":{"id":"m1","role":"assistant","content":[` + blocks + `]}}` + "\n"
+	}
+	const (
+		thinking = `{"type":"thinking","thinking":"  The user wants a cat, so draw one.  ","signature":"sig"}`
+		redacted = `{"type":"redacted_thinking","data":"EuYBCkQYAiJA"}`
+		text     = `{"type":"text","text":"Here is your cat."}`
+	)
+
+	tests := []struct {
+		name    string
+		log     string
+		include bool
+		want    []string
+	}{
+		{"off", entry(thinking + "," + redacted + "," + text), false, []string{"Here is your cat."}},
+		{"on", entry(thinking + "," + redacted + "," + text), true, []string{"The user wants a cat, so draw one.\nHere is your cat."}},
+		{"thinking only, off", entry(thinking), false, nil},
+		{"thinking only, on", entry(thinking), true, []string{"The user wants a cat, so draw one."}},
+		{"redacted only", entry(redacted), true, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := contents(ParseJSONLWithOptions([]byte(tt.log), ParseOptions{IncludeThinking: tt.include}))
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,152 @@
+package imagechat
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// How the passthrough generator picks a source image.
+const (
+	PassthroughRoundRobin = "roundrobin" // each image in turn
+	PassthroughHash       = "hash"       // by a hash of the prompt, so a prompt always gets the same image
+)
+
+// PassthroughImageGenerator "generates" images by copying existing ones from
+// a directory, for UI demos and for running the whole pipeline without any
+// model.
+type PassthroughImageGenerator struct {
+	imageCleanup
+	cfg       *Config
+	sourceDir string
+	outputDir string
+	mode      string
+	maxImages int
+	mu        sync.Mutex
+	next      int
+}
+
+type PassthroughImageGeneratorConfig struct {
+	Cfg *Config
+	// SourceDir holds the PNG or JPEG images to hand out.
+	SourceDir string
+	OutputDir string
+	// Mode is PassthroughRoundRobin or PassthroughHash.
+	Mode string
+}
+
+func NewPassthroughImageGenerator(igCfg PassthroughImageGeneratorConfig) (*PassthroughImageGenerator, error) {
+	g := &PassthroughImageGenerator{
+		cfg:       igCfg.Cfg,
+		sourceDir: igCfg.SourceDir,
+		outputDir: igCfg.OutputDir,
+		mode:      igCfg.Mode,
+		maxImages: defaultMaxImages,
+	}
+	names, err := g.sourceImages()
+	if err != nil {
+		return nil, err
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no images in passthrough directory %s", g.sourceDir)
+	}
+	if err := os.MkdirAll(igCfg.OutputDir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create output directory: %w", err)
+	}
+	return g, nil
+}
+
+// Generate copies a source image for the prompt into the output directory.
+// Returns the filename of the saved image.
+func (g *PassthroughImageGenerator) Generate(prompt string) (string, error) {
+	return g.GenerateWithOptions(prompt, ImageOptions{})
+}
+
+// GenerateWithOptions is Generate with per-generation overrides. SessionID
+// and Title are used as for other generators; Model is ignored.
+func (g *PassthroughImageGenerator) GenerateWithOptions(prompt string, opts ImageOptions) (string, error) {
+	// The directory is listed on every call so images can be added while
+	// the app runs.
+	names, err := g.sourceImages()
+	if err != nil {
+		return "", err
+	}
+	if len(names) == 0 {
+		return "", fmt.Errorf("no images in passthrough directory %s", g.sourceDir)
+	}
+
+	var idx int
+	if g.mode == PassthroughHash {
+		h := fnv.New32a()
+		h.Write([]byte(prompt))
+		idx = int(h.Sum32() % uint32(len(names)))
+	} else {
+		g.mu.Lock()
+		idx = g.next % len(names)
+		g.next = idx + 1
+		g.mu.Unlock()
+	}
+
+	src := filepath.Join(g.sourceDir, names[idx])
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return "", fmt.Errorf("failed to read passthrough image: %w", err)
+	}
+	if data, err = toPNG(data); err != nil {
+		return "", fmt.Errorf("passthrough image %s: %w", src, err)
+	}
+	Debugf("passthrough: using %s", src)
+
+	filename, err := saveImage(g.cfg, g.outputDir, data, opts)
+	if err != nil {
+		return "", err
+	}
+
+	g.cleanup(g.cfg, g.outputDir, g.maxImages)
+
+	return filename, nil
+}
+
+// sourceImages returns the names of the PNG and JPEG files in the source
+// directory, sorted.
+func (g *PassthroughImageGenerator) sourceImages() ([]string, error) {
+	entries, err := os.ReadDir(g.sourceDir)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read passthrough directory: %w", err)
+	}
+	var names []string
+	for _, e := range entries {
+		switch strings.ToLower(filepath.Ext(e.Name())) {
+		case ".png", ".jpg", ".jpeg":
+			if !e.IsDir() {
+				names = append(names, e.Name())
+			}
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// toPNG returns data unchanged if it is a PNG, or re-encoded as PNG since
+// saved images always get the .png extension.
+func toPNG(data []byte) ([]byte, error) {
+	if bytes.HasPrefix(data, pngSignature) {
+		return data, nil
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %w", err)
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, fmt.Errorf("failed to encode image: %w", err)
+	}
+	return buf.Bytes(), nil
+}
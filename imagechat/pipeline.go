@@ -0,0 +1,1121 @@
+package imagechat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PipelineConfig holds the dependencies of a Pipeline.
+type PipelineConfig struct {
+	Config *Config
+	// Events delivers new data appended to session files (usually Watcher.Events()).
+	Events     <-chan FileEvent
+	PromptGen  PromptGenerator
+	Summarizer *Summarizer // optional
+	// Backends selects the image generator per session. When nil, ImageGen
+	// is used for every session.
+	Backends *ImageBackendSelector
+	ImageGen ImageGenerator
+	// HasClients reports whether anyone is watching; generation is skipped
+	// otherwise. Nil means always generate.
+	HasClients func() bool
+	// Broadcast delivers each generated image. Required.
+	Broadcast func(SessionImage)
+	// Clock drives rate limiting; nil means Config.Clock, or the wall clock
+	// in reproducible mode.
+	Clock Clock
+	// Approvals, when set, holds each prompt until the user approves it (or
+	// Config.PromptApprovalTimeout passes). AnnouncePrompt publishes the
+	// prompt and its state changes to the user.
+	Approvals      *PromptApprovals
+	AnnouncePrompt func(PromptApproval)
+	// AnnounceIdle is called when generation pauses for Config.IdleTimeout
+	// (idle true) and when activity resumes it. Optional.
+	AnnounceIdle func(idle bool)
+	// Status, when set, records the outcome of each backend call.
+	Status *StatusTracker
+}
+
+// Pipeline turns session file events into prompts, prompts into images, and
+// images into broadcasts.
+type Pipeline struct {
+	cfg          *Config
+	events       <-chan FileEvent
+	promptGen    PromptGenerator
+	summarizer   *Summarizer
+	backends     *ImageBackendSelector
+	hasClients   func() bool
+	broadcast    func(SessionImage)
+	clock        Clock
+	approvals    *PromptApprovals
+	announce     func(PromptApproval)
+	announceIdle func(bool)
+	status       *StatusTracker
+
+	// recentPrompts holds recent prompts for near-duplicate detection; nil
+	// when Config.PromptDedupThreshold is 0.
+	recentPrompts *promptHistory
+
+	promptCh chan PromptWithSession
+	imageCh  chan SessionImage
+	regenCh  chan regenRequest
+	stats    QueueStats
+
+	// activity is when each session last logged a new message, for
+	// ActiveSessions. Guarded by activityMu.
+	activityMu sync.Mutex
+	activity   map[string]time.Time
+
+	// lastPrompts is the last prompt rendered for each session, for
+	// RegenerateLast. Guarded by lastPromptsMu.
+	lastPromptsMu sync.Mutex
+	lastPrompts   map[string]PromptWithSession
+
+	// pinnedFocus is the session ID focus mode is pinned to with PinFocus,
+	// or "" to follow activity. Guarded by focusMu.
+	focusMu     sync.Mutex
+	pinnedFocus string
+}
+
+// maxLastPrompts caps the number of sessions whose last prompt is kept.
+const maxLastPrompts = 50
+
+// errNoLastPrompt is returned by RegenerateLast for a session that has no
+// image yet.
+var errNoLastPrompt = errors.New("no image has been generated for this session yet")
+
+// errGenerationBusy is returned by RegenerateLast when the image generator
+// is already generating.
+var errGenerationBusy = errors.New("image generation already in progress")
+
+// errBackendUnavailable is returned when the image generator selected for a
+// session was not created.
+var errBackendUnavailable = errors.New("image generator not available")
+
+// regenRequest asks the image stage to render a session's last prompt again.
+// The stage sends the outcome on result before queueing the image for
+// broadcast.
+type regenRequest struct {
+	ps     PromptWithSession
+	result chan regenResult
+}
+
+type regenResult struct {
+	si  SessionImage
+	err error
+}
+
+func NewPipeline(pc PipelineConfig) *Pipeline {
+	p := &Pipeline{
+		cfg:          pc.Config,
+		events:       pc.Events,
+		promptGen:    pc.PromptGen,
+		summarizer:   pc.Summarizer,
+		backends:     pc.Backends,
+		hasClients:   pc.HasClients,
+		broadcast:    pc.Broadcast,
+		clock:        pc.Clock,
+		approvals:    pc.Approvals,
+		announce:     pc.AnnouncePrompt,
+		announceIdle: pc.AnnounceIdle,
+		status:       pc.Status,
+		promptCh:     make(chan PromptWithSession, 4),
+		imageCh:      make(chan SessionImage, 4),
+		regenCh:      make(chan regenRequest),
+		activity:     make(map[string]time.Time),
+		lastPrompts:  make(map[string]PromptWithSession),
+	}
+	if p.clock == nil {
+		p.clock = p.cfg.timerClock()
+	}
+	if p.cfg.PromptDedupThreshold > 0 {
+		p.recentPrompts = newPromptHistory(p.cfg.PromptDedupWindow)
+	}
+	if p.backends == nil {
+		p.backends = NewImageBackendSelector(p.cfg, map[string]ImageGenerator{
+			p.cfg.GetImageGeneratorType(): pc.ImageGen,
+		})
+	}
+	if p.announce == nil {
+		p.announce = func(PromptApproval) {}
+	}
+	if p.announceIdle == nil {
+		p.announceIdle = func(bool) {}
+	}
+	if p.hasClients == nil {
+		p.hasClients = func() bool { return true }
+	}
+	return p
+}
+
+// QueueStats returns a snapshot of the prompt queue counters.
+func (p *Pipeline) QueueStats() QueueStatsSnapshot {
+	return p.stats.Snapshot(len(p.promptCh))
+}
+
+// ActiveSessions returns how many sessions logged a new message within the
+// last window.
+func (p *Pipeline) ActiveSessions(window time.Duration) int {
+	now := p.clock.Now()
+	p.activityMu.Lock()
+	defer p.activityMu.Unlock()
+	n := 0
+	for path, t := range p.activity {
+		if now.Sub(t) < window {
+			n++
+		} else {
+			delete(p.activity, path)
+		}
+	}
+	return n
+}
+
+// Run processes events until ctx is cancelled or the events channel closes.
+func (p *Pipeline) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		p.runPrompts(ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		p.runImages(ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		p.runBroadcast(ctx)
+	}()
+	wg.Wait()
+}
+
+// immediateModeInterval is the generate interval at or below which prompts
+// are generated on every qualifying message without any deferral.
+const immediateModeInterval = time.Second
+
+// runPrompts is the conversation parser + prompt generation stage.
+// Maintains per-file full message history for accurate context.
+// Rate-limited: generates at most once per GenerateInterval, with a
+// trailing-edge timer so the final message in a burst is always processed.
+func (p *Pipeline) runPrompts(ctx context.Context) {
+	defer close(p.promptCh)
+
+	cfg := p.cfg
+	parseOpts := cfg.ParseOptions()
+
+	// Track full file content per path for re-parsing
+	fileData := make(map[string][]byte)
+	// Cache session titles so we only compute them once per session.
+	// Capped to maxSessionTitles entries to prevent unbounded growth.
+	const maxSessionTitles = 50
+	sessionTitles := make(map[string]string)
+
+	// Rate limiting state
+	var lastGenTime time.Time
+	var pendingRecent []Message
+	var pendingPath string
+	var pendingID string
+	// lastGenerated is the ID of the message each session last generated
+	// for, so a re-read of the same message does not produce another image.
+	lastGenerated := make(map[string]string)
+	var deferredTimer Timer
+	timerCh := make(chan struct{}, 1)
+	// Characters of conversation text that arrived since the last
+	// generation, and how many messages of each file have been counted.
+	newChars := 0
+	countedMsgs := make(map[string]int)
+
+	// Idle detection: when each session last logged a new message, and
+	// whether generation is paused because none has for cfg.IdleTimeout.
+	lastActivity := make(map[string]time.Time)
+	idle := false
+	var idleTimer Timer
+	idleCh := make(chan struct{}, 1)
+	armIdleTimer := func(d time.Duration) {
+		if idleTimer != nil {
+			idleTimer.Stop()
+		}
+		idleTimer = p.clock.AfterFunc(d, func() {
+			select {
+			case idleCh <- struct{}{}:
+			default:
+			}
+		})
+	}
+
+	// Scheduled generation: with cfg.ScheduleInterval, a prompt is also
+	// generated from the most recently active session (latestPath) at that
+	// cadence, independent of new messages.
+	var latestPath string
+	var scheduleTimer Timer
+	scheduleCh := make(chan struct{}, 1)
+	armSchedule := func() {
+		scheduleTimer = p.clock.AfterFunc(cfg.ScheduleInterval, func() {
+			select {
+			case scheduleCh <- struct{}{}:
+			default:
+			}
+		})
+	}
+	if cfg.ScheduleInterval > 0 {
+		armSchedule()
+	}
+
+	// Focus mode: only the focused session generates. Focus moves to
+	// another session with new messages once the focused one has had none
+	// for cfg.FocusSwitchAfter, unless PinFocus pinned a session.
+	var focusPath string
+	var focusActive time.Time
+	inFocus := func(path string, active bool) bool {
+		if pinned := p.pinnedFocusSession(); pinned != "" {
+			return SessionIDFromPath(path) == pinned
+		}
+		if !active {
+			return path == focusPath
+		}
+		now := p.clock.Now()
+		if path != focusPath && focusPath != "" && now.Sub(focusActive) < cfg.FocusSwitchAfter {
+			return false
+		}
+		if path != focusPath {
+			Infof("focus moved to session %s", SessionIDFromPath(path))
+			focusPath = path
+		}
+		focusActive = now
+		return true
+	}
+	// focusedPath returns the file of the focused session, or "" if it is
+	// not known yet.
+	focusedPath := func() string {
+		pinned := p.pinnedFocusSession()
+		if pinned == "" {
+			return focusPath
+		}
+		for path := range fileData {
+			if SessionIDFromPath(path) == pinned {
+				return path
+			}
+		}
+		return ""
+	}
+
+	// Prompt workers: with cfg.PromptWorkers > 1, prompts for different
+	// sessions are generated concurrently, one at a time per session. A
+	// request for a busy session, or arriving while every worker is busy,
+	// waits in queued, replacing any older request for the same session.
+	workers := max(cfg.PromptWorkers, 1)
+	var workerWG sync.WaitGroup
+	defer workerWG.Wait() // runs before close(p.promptCh)
+	finished := make(chan string, workers)
+	inFlight := make(map[string]bool)
+	queued := make(map[string]promptJob)
+	var queueOrder []string
+	startJob := func(job promptJob) {
+		inFlight[job.sessionPath] = true
+		workerWG.Add(1)
+		go func() {
+			defer workerWG.Done()
+			p.generatePrompt(ctx, job)
+			finished <- job.sessionPath
+		}()
+	}
+	startQueued := func() {
+		for i := 0; i < len(queueOrder) && len(inFlight) < workers; {
+			path := queueOrder[i]
+			if inFlight[path] {
+				i++
+				continue
+			}
+			job := queued[path]
+			delete(queued, path)
+			queueOrder = append(queueOrder[:i], queueOrder[i+1:]...)
+			startJob(job)
+		}
+	}
+
+	// selectRecent picks the messages to generate from, as cfg.ContextRole
+	// asks.
+	selectRecent := func(messages []Message) []Message {
+		if cfg.ContextRole == ContextRoleUser {
+			return SelectRecentMessages(UserMessages(messages), cfg.RecentStrategy, cfg.RecentMessages, cfg.RecentWindow, p.clock.Now())
+		}
+		recent := SelectRecentMessages(messages, cfg.RecentStrategy, cfg.RecentMessages, cfg.RecentWindow, p.clock.Now())
+		return WithLatestUserMessage(messages, recent)
+	}
+
+	generatePrompt := func(recent []Message, sessionPath, messageID string) {
+		sessionID := SessionIDFromPath(sessionPath)
+		if messageID != "" {
+			lastGenerated[sessionPath] = messageID
+		}
+		title, ok := sessionTitles[sessionID]
+		if !ok {
+			allMsgs := ParseJSONLWithOptions(fileData[sessionPath], parseOpts)
+			title = ExtractTitle(allMsgs, 30)
+			if len(sessionTitles) >= maxSessionTitles {
+				// Evict an arbitrary entry to keep the cache bounded
+				for k := range sessionTitles {
+					delete(sessionTitles, k)
+					break
+				}
+			}
+			sessionTitles[sessionID] = title
+		}
+
+		job := promptJob{
+			req:         PromptRequest{Messages: recent, SessionPath: sessionPath, Title: title},
+			sessionPath: sessionPath,
+			title:       title,
+		}
+		if cfg.ProjectHint {
+			job.req.Project = ProjectFromPath(sessionPath)
+		}
+		if cfg.OutcomeHints {
+			job.req.Outcome = classifyOutcome(currentToolResults(fileData[sessionPath]))
+			if job.req.Outcome != OutcomeNone {
+				Debugf("session %s outcome: %s", sessionID, job.req.Outcome)
+			}
+		}
+		if latest, _ := lastTurn(recent); cfg.CodeHeavy == CodeHeavyAbstract && latest.Role == "assistant" && isCodeHeavy(latest.Content) {
+			Debugf("latest message in session %s is mostly code, asking for an abstract scene", sessionID)
+			job.req.Guidance = abstractSceneGuidance
+		}
+		if cfg.ContextRole == ContextRoleUser {
+			job.req.Guidance = userContextGuidance
+		}
+		if p.summarizer != nil {
+			job.allMsgs = ParseJSONLWithOptions(fileData[sessionPath], parseOpts)
+		}
+
+		if workers == 1 {
+			p.generatePrompt(ctx, job)
+			return
+		}
+		if inFlight[sessionPath] || len(inFlight) >= workers {
+			if _, ok := queued[sessionPath]; !ok {
+				queueOrder = append(queueOrder, sessionPath)
+			}
+			queued[sessionPath] = job
+			Debugf("prompt workers busy, queued generation for session %s", sessionID)
+			return
+		}
+		startJob(job)
+	}
+
+	// Turn completion: with cfg.WaitTurnComplete, generation waits until the
+	// assistant's turn is logged as finished, or until cfg.TurnQuietPeriod
+	// passes without another write when the log doesn't say.
+	type settleTimer struct {
+		timer Timer
+		seq   int // tells a stale firing from the current timer's
+	}
+	settleTimers := make(map[string]settleTimer)
+	settleSeq := 0
+	settledCh := make(chan settleEvent, 1)
+	turnSettled := func(path string) bool {
+		if st, ok := settleTimers[path]; ok {
+			st.timer.Stop()
+			delete(settleTimers, path)
+		}
+		switch turnStatus(fileData[path]) {
+		case turnComplete:
+			return true
+		case turnInProgress:
+			Debugf("turn in session %s not finished yet, waiting", SessionIDFromPath(path))
+			return false
+		}
+		Debugf("waiting %s for the turn in session %s to settle", cfg.TurnQuietPeriod, SessionIDFromPath(path))
+		settleSeq++
+		seq := settleSeq
+		settleTimers[path] = settleTimer{seq: seq, timer: p.clock.AfterFunc(cfg.TurnQuietPeriod, func() {
+			select {
+			case settledCh <- settleEvent{path: path, seq: seq}:
+			case <-ctx.Done():
+			}
+		})}
+		return false
+	}
+
+	// handleEvent handles new data appended to a session file. settled is
+	// set when it is called again, without new data, after
+	// cfg.TurnQuietPeriod passed with the turn's end not logged.
+	handleEvent := func(ev FileEvent, settled bool) {
+		if ev.Reset {
+			// The file was truncated and is being read again from its
+			// start; what we had of it no longer matches.
+			delete(fileData, ev.Path)
+			delete(countedMsgs, ev.Path)
+		}
+		// Append new data to the stored data for this file
+		fileData[ev.Path] = append(fileData[ev.Path], ev.NewData...)
+
+		// Parse the entire file's accumulated data
+		messages := ParseJSONLWithOptions(fileData[ev.Path], parseOpts)
+		added := 0
+		if n := countedMsgs[ev.Path]; n <= len(messages) {
+			added = len(messages) - n
+			for _, m := range messages[n:] {
+				newChars += len(m.Content)
+			}
+		}
+		countedMsgs[ev.Path] = len(messages)
+		if len(messages) == 0 {
+			return
+		}
+		if added > 0 {
+			latestPath = ev.Path
+			p.activityMu.Lock()
+			p.activity[ev.Path] = p.clock.Now()
+			p.activityMu.Unlock()
+		}
+
+		if cfg.IdleTimeout > 0 {
+			now := p.clock.Now()
+			if added == 0 {
+				// A write without new messages (e.g. a tool result)
+				// doesn't count as activity.
+				if last, ok := lastActivity[ev.Path]; !ok || now.Sub(last) >= cfg.IdleTimeout {
+					Debugf("session %s idle, ignoring write", SessionIDFromPath(ev.Path))
+					return
+				}
+			} else {
+				lastActivity[ev.Path] = now
+				armIdleTimer(cfg.IdleTimeout)
+				if idle {
+					idle = false
+					Infof("new activity in session %s, resuming image generation", SessionIDFromPath(ev.Path))
+					p.announceIdle(false)
+				}
+			}
+		}
+
+		if cfg.FocusMode && !inFocus(ev.Path, added > 0) {
+			Debugf("session %s is not in focus, skipping", SessionIDFromPath(ev.Path))
+			return
+		}
+
+		// Entries included for context only (see IncludeTypes) never
+		// trigger generation.
+		last, ok := lastTurn(messages)
+		if !ok {
+			return
+		}
+		if cfg.ContextRole == ContextRoleUser {
+			// Only generate for a message the user typed, from what
+			// the user has said.
+			if !isUserText(last) {
+				return
+			}
+		} else {
+			// Only generate when the last message is from the assistant
+			if last.Role != "assistant" {
+				return
+			}
+
+			if cfg.CodeHeavy == CodeHeavySkip && isCodeHeavy(last.Content) {
+				Debugf("latest message in session %s is mostly code, skipping image generation", SessionIDFromPath(ev.Path))
+				return
+			}
+
+			if cfg.WaitTurnComplete && !settled && !turnSettled(ev.Path) {
+				return
+			}
+		}
+		recent := selectRecent(messages)
+
+		if !cfg.ForceRegenerate && last.ID != "" && lastGenerated[ev.Path] == last.ID {
+			Debugf("message %s in session %s already generated an image, skipping", last.ID, SessionIDFromPath(ev.Path))
+			return
+		}
+
+		// Skip generation when no WebSocket clients are connected
+		if !p.hasClients() {
+			Debugf("no WebSocket clients connected, skipping image generation")
+			return
+		}
+
+		now := p.clock.Now()
+		genInterval := cfg.GetGenerateInterval()
+		if cfg.PromptInterval > 0 {
+			genInterval = cfg.PromptInterval
+		}
+		if cfg.AdaptiveInterval {
+			genInterval = adaptiveInterval(genInterval, newChars, cfg)
+			Debugf("adaptive interval: %s for %d new chars", genInterval, newChars)
+		}
+		// Capped at one interval in case the clock went backwards.
+		since := now.Sub(lastGenTime)
+		remaining := min(genInterval-since, genInterval)
+		if genInterval <= immediateModeInterval || remaining <= 0 {
+			// Immediate mode or enough time has passed — generate now
+			if deferredTimer != nil {
+				deferredTimer.Stop()
+				deferredTimer = nil
+			}
+			pendingRecent = nil
+			pendingPath = ""
+			pendingID = ""
+			lastGenTime = now
+			newChars = 0
+			Debugf("immediate generation (%.0fs since last)", since.Seconds())
+			generatePrompt(recent, ev.Path, last.ID)
+		} else {
+			// Too soon — defer to when the interval elapses
+			pendingRecent = make([]Message, len(recent))
+			copy(pendingRecent, recent)
+			pendingPath = ev.Path
+			pendingID = last.ID
+			if deferredTimer != nil {
+				deferredTimer.Stop()
+			}
+			Debugf("deferring generation (%.0fs remaining)", remaining.Seconds())
+			deferredTimer = p.clock.AfterFunc(remaining, func() {
+				select {
+				case timerCh <- struct{}{}:
+				default:
+				}
+			})
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			if deferredTimer != nil {
+				deferredTimer.Stop()
+			}
+			if idleTimer != nil {
+				idleTimer.Stop()
+			}
+			if scheduleTimer != nil {
+				scheduleTimer.Stop()
+			}
+			for _, st := range settleTimers {
+				st.timer.Stop()
+			}
+			return
+
+		case path := <-finished:
+			delete(inFlight, path)
+			startQueued()
+
+		case <-idleCh:
+			if idle {
+				continue
+			}
+			now := p.clock.Now()
+			var latest time.Time
+			for path, t := range lastActivity {
+				if now.Sub(t) >= cfg.IdleTimeout {
+					// Stale sessions count as idle whether tracked or not.
+					delete(lastActivity, path)
+				} else if t.After(latest) {
+					latest = t
+				}
+			}
+			if !latest.IsZero() {
+				armIdleTimer(cfg.IdleTimeout - now.Sub(latest))
+				continue
+			}
+			idle = true
+			Infof("no new messages for %s, pausing image generation", cfg.IdleTimeout)
+			p.announceIdle(true)
+
+		case <-scheduleCh:
+			armSchedule()
+			path := latestPath
+			if cfg.FocusMode {
+				path = focusedPath()
+			}
+			if path == "" || idle {
+				continue
+			}
+			if !p.hasClients() {
+				Debugf("no WebSocket clients connected, skipping scheduled generation")
+				continue
+			}
+			// Single-flight: don't stack a scheduled prompt on one still
+			// being generated or waiting for this session.
+			if _, ok := queued[path]; inFlight[path] || ok || pendingPath == path {
+				Debugf("session %s busy, skipping scheduled generation", SessionIDFromPath(path))
+				continue
+			}
+			messages := ParseJSONLWithOptions(fileData[path], parseOpts)
+			recent := selectRecent(messages)
+			if len(recent) == 0 {
+				continue
+			}
+			Debugf("scheduled generation for session %s", SessionIDFromPath(path))
+			generatePrompt(recent, path, "")
+
+		case <-timerCh:
+			// Deferred timer fired — generate with the latest pending data
+			if pendingRecent != nil {
+				if !p.hasClients() {
+					Debugf("no WebSocket clients connected, skipping deferred generation")
+					pendingRecent = nil
+					pendingPath = ""
+					pendingID = ""
+					continue
+				}
+				Debugf("deferred generation triggered")
+				lastGenTime = p.clock.Now()
+				newChars = 0
+				recent := pendingRecent
+				sessPath := pendingPath
+				msgID := pendingID
+				pendingRecent = nil
+				pendingPath = ""
+				pendingID = ""
+				generatePrompt(recent, sessPath, msgID)
+			}
+
+		case ev, ok := <-p.events:
+			if !ok {
+				return
+			}
+			handleEvent(ev, false)
+
+		case se := <-settledCh:
+			if st, ok := settleTimers[se.path]; !ok || st.seq != se.seq {
+				continue // superseded by a later write
+			}
+			delete(settleTimers, se.path)
+			handleEvent(FileEvent{Path: se.path}, true)
+		}
+	}
+}
+
+// settleEvent reports that a session's turn went quiet for
+// Config.TurnQuietPeriod; seq identifies the timer that fired.
+type settleEvent struct {
+	path string
+	seq  int
+}
+
+// promptJob is one prompt generation request prepared by runPrompts.
+type promptJob struct {
+	req         PromptRequest
+	sessionPath string
+	title       string
+	// allMsgs is the whole session, for the summarizer (nil without one).
+	allMsgs []Message
+}
+
+// generatePrompt generates the prompt for job and queues it for the image
+// stage. It only touches job and concurrency-safe dependencies, so it may run
+// on several prompt workers at once.
+func (p *Pipeline) generatePrompt(ctx context.Context, job promptJob) {
+	genCtx := ctx
+	if p.cfg.PromptTimeout > 0 {
+		var cancel context.CancelFunc
+		genCtx, cancel = context.WithTimeout(ctx, p.cfg.PromptTimeout)
+		defer cancel()
+	}
+
+	req := job.req
+	if p.summarizer != nil {
+		summary, err := p.summarizer.Update(genCtx, SessionIDFromPath(job.sessionPath), job.allMsgs, len(req.Messages))
+		if err != nil {
+			Errorf("summary error: %v", err)
+		}
+		req.Summary = summary
+	}
+	prompt, err := p.promptGen.Generate(genCtx, req)
+	if errors.Is(err, errBackendCoolingDown) {
+		Debugf("prompt generator cooling down, skipping generation")
+		return
+	}
+	statusName := "prompt:" + p.cfg.PromptGeneratorType
+	if err != nil && errors.Is(genCtx.Err(), context.DeadlineExceeded) {
+		Warnf("warning: prompt generation timed out after %s, dropping this prompt", p.cfg.PromptTimeout)
+		p.status.recordError(statusName, err)
+		return
+	}
+	if err != nil {
+		Errorf("prompt generation error: %v", err)
+		p.status.recordError(statusName, err)
+		return
+	}
+	p.status.recordSuccess(statusName)
+
+	Debugf("generated prompt (%d chars): %q", len(prompt), prompt)
+
+	sessionID := SessionIDFromPath(job.sessionPath)
+	if p.recentPrompts != nil {
+		prompt = p.distinctPrompt(genCtx, req, sessionID, prompt)
+		p.recentPrompts.add(sessionID, prompt)
+	}
+
+	charIdx := characterIndexFor(p.promptGen, job.sessionPath)
+	select {
+	case p.promptCh <- PromptWithSession{
+		Prompt:    prompt,
+		SessionID: sessionID,
+		Title:     job.title,
+		Project:   ProjectFromPath(job.sessionPath),
+		Character: p.cfg.CharacterName(charIdx),
+		// Characters may declare the image model to render them with.
+		ImageModel: p.cfg.CharacterImageModel(charIdx),
+	}:
+	case <-ctx.Done():
+	}
+}
+
+// distinctPrompt regenerates prompt once, asking for something visually
+// distinct, when it nearly repeats a recent prompt from another session. It
+// returns the prompt to use; the original if regeneration fails.
+func (p *Pipeline) distinctPrompt(ctx context.Context, req PromptRequest, sessionID, prompt string) string {
+	similar, score := p.recentPrompts.mostSimilar(sessionID, prompt)
+	if score < p.cfg.PromptDedupThreshold {
+		return prompt
+	}
+	Infof("prompt is %.0f%% similar to a recent prompt from another session, regenerating", score*100)
+	req.Guidance = strings.TrimSpace(req.Guidance + " " + fmt.Sprintf(distinctPromptGuidance, similar))
+	regenerated, err := p.promptGen.Generate(ctx, req)
+	if err != nil {
+		Warnf("warning: prompt regeneration error, keeping the similar prompt: %v", err)
+		return prompt
+	}
+	Debugf("regenerated prompt (%d chars): %q", len(regenerated), regenerated)
+	return regenerated
+}
+
+// adaptiveInterval scales the base interval inversely with the amount of new
+// text: AdaptiveIntervalChars characters give exactly base, more text shortens
+// the wait and less lengthens it, within the configured bounds.
+func adaptiveInterval(base time.Duration, newChars int, cfg *Config) time.Duration {
+	if newChars <= 0 {
+		return cfg.AdaptiveIntervalMax
+	}
+	d := time.Duration(float64(base) * float64(cfg.AdaptiveIntervalChars) / float64(newChars))
+	if d < cfg.AdaptiveIntervalMin {
+		return cfg.AdaptiveIntervalMin
+	}
+	if d > cfg.AdaptiveIntervalMax {
+		return cfg.AdaptiveIntervalMax
+	}
+	return d
+}
+
+// runImages is the image generation stage.
+func (p *Pipeline) runImages(ctx context.Context) {
+	defer close(p.imageCh)
+
+	// With cfg.ImageInterval, a prompt arriving sooner than that after the
+	// last image is held, replacing any older held prompt, and rendered
+	// when the interval has elapsed.
+	var lastImageTime time.Time
+	var held *PromptWithSession
+	var holdTimer Timer
+	holdCh := make(chan struct{}, 1)
+
+	for {
+		select {
+		case <-ctx.Done():
+			if holdTimer != nil {
+				holdTimer.Stop()
+			}
+			return
+		case <-holdCh:
+			holdTimer = nil
+			if held == nil {
+				continue
+			}
+			ps := *held
+			held = nil
+			lastImageTime = p.clock.Now()
+			if !p.renderImage(ctx, ps) {
+				return
+			}
+		case req := <-p.regenCh:
+			// Asked for by the user, so not held for ImageInterval.
+			p.stats.processed.Add(1)
+			lastImageTime = p.clock.Now()
+			si, err := p.generate(req.ps, true)
+			req.result <- regenResult{si, err}
+			if err == nil && !p.queueImage(ctx, si) {
+				return
+			}
+		case ps, ok := <-p.promptCh:
+			if !ok {
+				return
+			}
+			// Depth after this receive: prompts still waiting behind this one.
+			depth := len(p.promptCh)
+			p.stats.observeDepth(depth)
+			p.stats.processed.Add(1)
+			Debugf("image queue: %d waiting, %d dropped so far", depth, p.stats.dropped.Load())
+
+			now := p.clock.Now()
+			if interval := p.cfg.ImageInterval; interval > 0 && !lastImageTime.IsZero() {
+				if wait := interval - now.Sub(lastImageTime); wait > 0 {
+					if held != nil {
+						p.stats.dropped.Add(1) // replaced by a newer prompt
+					}
+					held = &ps
+					if holdTimer == nil {
+						holdTimer = p.clock.AfterFunc(wait, func() {
+							select {
+							case holdCh <- struct{}{}:
+							default:
+							}
+						})
+					}
+					Debugf("image interval: holding prompt for %.0fs", wait.Seconds())
+					continue
+				}
+			}
+			lastImageTime = now
+			if !p.renderImage(ctx, ps) {
+				return
+			}
+		}
+	}
+}
+
+// renderImage generates the image for ps and queues it for broadcast. It
+// returns false if ctx was cancelled.
+func (p *Pipeline) renderImage(ctx context.Context, ps PromptWithSession) bool {
+	if p.approvals != nil {
+		var approved bool
+		ps, approved = p.awaitApproval(ctx, ps)
+		if !approved {
+			p.stats.dropped.Add(1)
+			return true
+		}
+	}
+
+	si, err := p.generate(ps, false)
+	switch {
+	case err == nil:
+		return p.queueImage(ctx, si)
+	case errors.Is(err, errGenerationBusy):
+		// Skipped due to concurrent generation
+	case errors.Is(err, errBackendUnavailable):
+		Warnf("warning: %v, skipping", err)
+	case errors.Is(err, errBackendCoolingDown), errors.Is(err, errDiskUnavailable):
+		Debugf("%v, skipping", err)
+	default:
+		Errorf("image generation error: %v", err)
+	}
+	return true
+}
+
+// generate renders ps with the image generator selected for its session,
+// with a random seed if randomSeed is set. Attempts that yield no image for
+// a reason other than a generator error count as dropped.
+func (p *Pipeline) generate(ps PromptWithSession, randomSeed bool) (SessionImage, error) {
+	genType, imageGen, exists := p.backends.Select(ps.SessionID, ps.Project)
+	if !exists {
+		p.stats.dropped.Add(1)
+		return SessionImage{}, fmt.Errorf("%w: %s", errBackendUnavailable, genType)
+	}
+
+	filename, err := generateImage(imageGen, ps.Prompt, ImageOptions{Model: ps.ImageModel, SessionID: ps.SessionID, Title: ps.Title, RandomSeed: randomSeed})
+	switch {
+	case errors.Is(err, errBackendCoolingDown), errors.Is(err, errDiskUnavailable):
+		p.stats.dropped.Add(1)
+		return SessionImage{}, err
+	case err != nil:
+		p.status.recordError("image:"+genType, err)
+		return SessionImage{}, err
+	case filename == "":
+		p.stats.dropped.Add(1)
+		return SessionImage{}, errGenerationBusy
+	}
+	p.status.recordSuccess("image:" + genType)
+	p.rememberPrompt(ps)
+	return p.sessionImage(ps, filename), nil
+}
+
+// queueImage hands si to the broadcast stage. It returns false if ctx was
+// cancelled.
+func (p *Pipeline) queueImage(ctx context.Context, si SessionImage) bool {
+	select {
+	case p.imageCh <- si:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// sessionImage returns the SessionImage announcing filename, generated for ps.
+func (p *Pipeline) sessionImage(ps PromptWithSession, filename string) SessionImage {
+	return SessionImage{
+		Filename:  filename,
+		SessionID: ps.SessionID,
+		Title:     ps.Title,
+		Project:   ps.Project,
+		Character: ps.Character,
+		UpdatedAt: p.cfg.clock().Now().Format(time.RFC3339),
+	}
+}
+
+// rememberPrompt records ps as the last prompt rendered for its session.
+func (p *Pipeline) rememberPrompt(ps PromptWithSession) {
+	p.lastPromptsMu.Lock()
+	defer p.lastPromptsMu.Unlock()
+	if _, ok := p.lastPrompts[ps.SessionID]; !ok && len(p.lastPrompts) >= maxLastPrompts {
+		// Evict an arbitrary entry to keep the map bounded
+		for k := range p.lastPrompts {
+			delete(p.lastPrompts, k)
+			break
+		}
+	}
+	p.lastPrompts[ps.SessionID] = ps
+}
+
+// PinFocus pins focus mode (Config.FocusMode) to a session: only it
+// generates images until PinFocus is called with "" to follow activity again.
+func (p *Pipeline) PinFocus(sessionID string) {
+	p.focusMu.Lock()
+	defer p.focusMu.Unlock()
+	p.pinnedFocus = sessionID
+}
+
+func (p *Pipeline) pinnedFocusSession() string {
+	p.focusMu.Lock()
+	defer p.focusMu.Unlock()
+	return p.pinnedFocus
+}
+
+// RegenerateLast renders the last prompt of a session again, with a new seed
+// and without calling the prompt generator. The image goes through the
+// image and broadcast stages like any other, so MinDisplayInterval may hold
+// it back. It fails with errGenerationBusy if the image stage is busy.
+func (p *Pipeline) RegenerateLast(sessionID string) (SessionImage, error) {
+	p.lastPromptsMu.Lock()
+	ps, ok := p.lastPrompts[sessionID]
+	p.lastPromptsMu.Unlock()
+	if !ok {
+		return SessionImage{}, errNoLastPrompt
+	}
+
+	req := regenRequest{ps: ps, result: make(chan regenResult, 1)}
+	select {
+	case p.regenCh <- req:
+	default:
+		// The image stage is generating, waiting for an approval or not
+		// running.
+		p.stats.dropped.Add(1)
+		return SessionImage{}, errGenerationBusy
+	}
+	res := <-req.result
+	if res.err == nil {
+		Infof("regenerated image for session %s: %s", sessionID, res.si.Filename)
+	}
+	return res.si, res.err
+}
+
+// awaitApproval publishes a prompt for approval and blocks until the user
+// approves or rejects it, the timeout auto-approves it, or ctx is cancelled.
+// It returns the (possibly edited) prompt and whether to generate it.
+func (p *Pipeline) awaitApproval(ctx context.Context, ps PromptWithSession) (PromptWithSession, bool) {
+	id, decision := p.approvals.add()
+	defer p.approvals.remove(id)
+
+	state := PromptApproval{
+		ID:        id,
+		State:     approvalPending,
+		Prompt:    ps.Prompt,
+		SessionID: ps.SessionID,
+		Title:     ps.Title,
+	}
+	p.announce(state)
+
+	var timeoutCh chan struct{}
+	if timeout := p.cfg.PromptApprovalTimeout; timeout > 0 {
+		timeoutCh = make(chan struct{})
+		t := p.clock.AfterFunc(timeout, func() { close(timeoutCh) })
+		defer t.Stop()
+	}
+
+	select {
+	case <-ctx.Done():
+		return ps, false
+	case <-timeoutCh:
+		Debugf("prompt %s auto-approved after timeout", id)
+		state.State = approvalExpired
+	case d := <-decision:
+		if !d.approved {
+			Debugf("prompt %s rejected", id)
+			state.State = approvalRejected
+			p.announce(state)
+			return ps, false
+		}
+		if d.prompt != "" {
+			ps.Prompt = d.prompt
+			state.Prompt = d.prompt
+		}
+		Debugf("prompt %s approved", id)
+		state.State = approvalApproved
+	}
+	p.announce(state)
+	return ps, true
+}
+
+// runBroadcast is the broadcast stage. With MinDisplayInterval set, an image
+// arriving too soon after the previous one is held back; if another arrives
+// meanwhile it replaces the held one, so the freshest image is shown next.
+func (p *Pipeline) runBroadcast(ctx context.Context) {
+	var lastShown time.Time
+	var held *SessionImage
+	var holdTimer Timer
+	holdCh := make(chan struct{}, 1)
+
+	show := func(si SessionImage) {
+		Debugf("broadcasting new image: %s (session=%s)", si.Filename, si.SessionID)
+		p.broadcast(si)
+		lastShown = p.clock.Now()
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			if holdTimer != nil {
+				holdTimer.Stop()
+			}
+			return
+		case <-holdCh:
+			holdTimer = nil
+			if held != nil {
+				show(*held)
+				held = nil
+			}
+		case si, ok := <-p.imageCh:
+			if !ok {
+				if holdTimer != nil {
+					holdTimer.Stop()
+				}
+				if held != nil {
+					show(*held)
+				}
+				return
+			}
+			minInterval := p.cfg.MinDisplayInterval
+			// Capped at one interval in case the clock went backwards.
+			remaining := min(minInterval-p.clock.Now().Sub(lastShown), minInterval)
+			if held == nil && remaining <= 0 {
+				show(si)
+				continue
+			}
+			if held != nil {
+				Debugf("display interval: replacing held image %s with %s", held.Filename, si.Filename)
+			}
+			held = &si
+			if holdTimer == nil {
+				holdTimer = p.clock.AfterFunc(remaining, func() {
+					select {
+					case holdCh <- struct{}{}:
+					default:
+					}
+				})
+			}
+		}
+	}
+}
@@ -0,0 +1,572 @@
+package imagechat_test
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/egawata/dev-image-chat/imagechat"
+	"github.com/egawata/dev-image-chat/imagechat/imagechattest"
+)
+
+// userLine and assistantLine return session log entries as Claude Code
+// writes them. id is both the entry's uuid and the message ID.
+func userLine(text string) string {
+	return fmt.Sprintf(`{"type":"user","message":{"role":"user","content":%q}}`+"\n", text)
+}
+
+func assistantLine(id, text, stopReason string) string {
+	stop := "null"
+	if stopReason != "" {
+		stop = fmt.Sprintf("%q", stopReason)
+	}
+	return fmt.Sprintf(`{"type":"assistant","uuid":%q,"message":{"id":%q,"role":"assistant","content":[{"type":"text","text":%q}],"stop_reason":%s}}`+"\n", id, id, text, stop)
+}
+
+// testPipeline runs a Pipeline on the imagechattest fakes.
+type testPipeline struct {
+	*imagechat.Pipeline
+	clock     *imagechattest.Clock
+	promptGen *imagechattest.PromptGenerator
+	imageGen  *imagechattest.ImageGenerator
+	events    chan imagechat.FileEvent
+	images    chan imagechat.SessionImage
+}
+
+// startPipeline loads the config from env on top of the defaults the tests
+// need and runs a pipeline until the test ends. opts adjust the
+// PipelineConfig before the pipeline is created.
+func startPipeline(t *testing.T, env map[string]string, opts ...func(*imagechat.PipelineConfig)) *testPipeline {
+	t.Helper()
+	t.Setenv("PROMPT_GENERATOR", "ollama")
+	t.Setenv("IMAGE_GENERATOR", "sd")
+	t.Setenv("GENERATE_INTERVAL", "1")
+	for k, v := range env {
+		t.Setenv(k, v)
+	}
+	cfg, err := imagechat.LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	imageGen, err := imagechattest.NewImageGenerator(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tp := &testPipeline{
+		clock:     imagechattest.NewClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)),
+		promptGen: imagechattest.NewPromptGenerator("a cat"),
+		imageGen:  imageGen,
+		events:    make(chan imagechat.FileEvent),
+		images:    make(chan imagechat.SessionImage, 16),
+	}
+	pc := imagechat.PipelineConfig{
+		Config:    cfg,
+		Events:    tp.events,
+		PromptGen: tp.promptGen,
+		ImageGen:  tp.imageGen,
+		Clock:     tp.clock,
+		Broadcast: func(si imagechat.SessionImage) { tp.images <- si },
+	}
+	for _, opt := range opts {
+		opt(&pc)
+	}
+	tp.Pipeline = imagechat.NewPipeline(pc)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		tp.Run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return tp
+}
+
+// send delivers an event and gives the pipeline time to handle it, so the
+// timers it arms are in place before the test advances the clock.
+func (tp *testPipeline) send(ev imagechat.FileEvent) {
+	tp.events <- ev
+	time.Sleep(50 * time.Millisecond)
+}
+
+func (tp *testPipeline) nextImage(t *testing.T) imagechat.SessionImage {
+	t.Helper()
+	select {
+	case si := <-tp.images:
+		return si
+	case <-time.After(2 * time.Second):
+		t.Fatal("no image broadcast")
+		return imagechat.SessionImage{}
+	}
+}
+
+func (tp *testPipeline) noImage(t *testing.T) {
+	t.Helper()
+	select {
+	case si := <-tp.images:
+		t.Fatalf("unexpected image %s", si.Filename)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestPipelineDropsDataOnReset(t *testing.T) {
+	tp := startPipeline(t, nil)
+	const path = "/projects/-home-me-app/session.jsonl"
+
+	tp.send(imagechat.FileEvent{Path: path, NewData: []byte(userLine("q") + assistantLine("m1", "before truncation", ""))})
+	tp.nextImage(t)
+
+	tp.clock.Advance(time.Minute)
+	tp.send(imagechat.FileEvent{Path: path, NewData: []byte(userLine("q") + assistantLine("m2", "after rewrite", "")), Reset: true})
+	tp.nextImage(t)
+
+	reqs := tp.promptGen.Requests()
+	if len(reqs) != 2 {
+		t.Fatalf("got %d prompt requests, want 2", len(reqs))
+	}
+	for _, m := range reqs[1].Messages {
+		if m.Content == "before truncation" {
+			t.Fatalf("request after reset still has the truncated message: %+v", reqs[1].Messages)
+		}
+	}
+}
+
+func TestPipelineSkipsRereadMessage(t *testing.T) {
+	tests := []struct {
+		name  string
+		force string
+		want  int
+	}{
+		{"deduplicated", "", 1},
+		{"forced", "1", 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tp := startPipeline(t, map[string]string{"IMGCHAT_FORCE_REGENERATE": tt.force})
+
+			tp.send(turn("m1", "answer"))
+			tp.nextImage(t)
+
+			// The watcher lost its offset and delivers the whole file again.
+			tp.clock.Advance(time.Minute)
+			ev := turn("m1", "answer")
+			ev.Reset = true
+			tp.send(ev)
+			if tt.want == 1 {
+				tp.noImage(t)
+			} else {
+				tp.nextImage(t)
+			}
+			if got := len(tp.promptGen.Requests()); got != tt.want {
+				t.Fatalf("got %d prompt requests, want %d", got, tt.want)
+			}
+
+			// A new message after the re-read still generates.
+			tp.clock.Advance(time.Minute)
+			tp.send(imagechat.FileEvent{Path: ev.Path, NewData: []byte(assistantLine("m2", "more", ""))})
+			tp.nextImage(t)
+			if got := lastRequestText(t, tp); got != "more" {
+				t.Errorf("prompt generated from %q, want %q", got, "more")
+			}
+		})
+	}
+}
+
+// turn returns a user question and the assistant's answer with message ID id.
+func turn(id, answer string) imagechat.FileEvent {
+	return imagechat.FileEvent{
+		Path:    "/projects/-home-me-app/session.jsonl",
+		NewData: []byte(userLine("q") + assistantLine(id, answer, "")),
+	}
+}
+
+func lastRequestText(t *testing.T, tp *testPipeline) string {
+	t.Helper()
+	reqs := tp.promptGen.Requests()
+	if len(reqs) == 0 {
+		t.Fatal("no prompt requests")
+	}
+	msgs := reqs[len(reqs)-1].Messages
+	return msgs[len(msgs)-1].Content
+}
+
+func TestPipelineGeneratesImmediatelyAfterInterval(t *testing.T) {
+	tp := startPipeline(t, map[string]string{"GENERATE_INTERVAL": "60"})
+
+	tp.send(turn("m1", "first"))
+	tp.nextImage(t)
+
+	tp.clock.Advance(61 * time.Second)
+	tp.send(turn("m2", "second"))
+	tp.nextImage(t)
+	if got := lastRequestText(t, tp); got != "second" {
+		t.Errorf("prompt generated from %q, want %q", got, "second")
+	}
+}
+
+func TestPipelineDefersWithinInterval(t *testing.T) {
+	tp := startPipeline(t, map[string]string{"GENERATE_INTERVAL": "60"})
+
+	tp.send(turn("m1", "first"))
+	tp.nextImage(t)
+
+	tp.clock.Advance(10 * time.Second)
+	tp.send(turn("m2", "second"))
+	tp.noImage(t)
+	// A newer message replaces the deferred one without moving the deadline.
+	tp.send(turn("m3", "third"))
+	tp.clock.Advance(49 * time.Second)
+	tp.noImage(t)
+
+	tp.clock.Advance(time.Second)
+	tp.nextImage(t)
+	if n := len(tp.promptGen.Requests()); n != 2 {
+		t.Fatalf("got %d prompt requests, want 2", n)
+	}
+	if got := lastRequestText(t, tp); got != "third" {
+		t.Errorf("deferred prompt generated from %q, want %q", got, "third")
+	}
+}
+
+func TestPipelineSkips(t *testing.T) {
+	tests := []struct {
+		name    string
+		clients bool
+		events  []imagechat.FileEvent
+	}{
+		{"no clients", false, []imagechat.FileEvent{turn("m1", "answer")}},
+		{"user spoke last", true, []imagechat.FileEvent{{
+			Path:    "/projects/-home-me-app/session.jsonl",
+			NewData: []byte(userLine("just a question")),
+		}}},
+		{"message already generated", true, []imagechat.FileEvent{
+			turn("m1", "answer"),
+			{Path: "/projects/-home-me-app/session.jsonl", NewData: []byte(assistantLine("m1", "answer", ""))},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tp := startPipeline(t, nil, func(pc *imagechat.PipelineConfig) {
+				pc.HasClients = func() bool { return tt.clients }
+			})
+			want := 0
+			for i, ev := range tt.events {
+				tp.send(ev)
+				if i == 0 && len(tt.events) > 1 {
+					tp.nextImage(t)
+					want = 1
+				}
+				tp.clock.Advance(time.Minute)
+			}
+			tp.noImage(t)
+			if n := len(tp.promptGen.Requests()); n != want {
+				t.Errorf("got %d prompt requests, want %d", n, want)
+			}
+		})
+	}
+}
+
+// blockingPromptGenerator holds every request until release is signalled,
+// recording how many run at once overall and per session.
+type blockingPromptGenerator struct {
+	release chan struct{}
+
+	mu            sync.Mutex
+	active        int
+	maxActive     int
+	perSession    map[string]int
+	maxPerSession int
+	sessions      []string
+}
+
+func newBlockingPromptGenerator() *blockingPromptGenerator {
+	return &blockingPromptGenerator{release: make(chan struct{}), perSession: make(map[string]int)}
+}
+
+func (g *blockingPromptGenerator) Generate(ctx context.Context, req imagechat.PromptRequest) (string, error) {
+	g.mu.Lock()
+	g.active++
+	g.maxActive = max(g.maxActive, g.active)
+	g.perSession[req.SessionPath]++
+	g.maxPerSession = max(g.maxPerSession, g.perSession[req.SessionPath])
+	g.sessions = append(g.sessions, req.SessionPath)
+	g.mu.Unlock()
+
+	<-g.release
+
+	g.mu.Lock()
+	g.active--
+	g.perSession[req.SessionPath]--
+	g.mu.Unlock()
+	return "a cat", nil
+}
+
+// started returns the sessions of the requests received so far.
+func (g *blockingPromptGenerator) started() []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return append([]string(nil), g.sessions...)
+}
+
+func TestPipelinePromptWorkers(t *testing.T) {
+	gen := newBlockingPromptGenerator()
+	tp := startPipeline(t, map[string]string{"IMGCHAT_PROMPT_WORKERS": "2"}, func(pc *imagechat.PipelineConfig) {
+		pc.PromptGen = gen
+	})
+	event := func(session, id string) imagechat.FileEvent {
+		return imagechat.FileEvent{
+			Path:    "/projects/-home-me-app/" + session + ".jsonl",
+			NewData: []byte(userLine("q") + assistantLine(id, "answer "+id, "")),
+		}
+	}
+
+	tp.send(event("a", "a1"))
+	tp.send(event("b", "b1"))
+	tp.send(event("c", "c1")) // every worker busy
+	tp.send(event("a", "a2")) // session a busy
+	if got := gen.started(); len(got) != 2 {
+		t.Fatalf("%d prompts started with 2 workers, want 2: %q", len(got), got)
+	}
+
+	for range 4 {
+		gen.release <- struct{}{}
+		tp.nextImage(t)
+	}
+	tp.noImage(t)
+
+	gen.mu.Lock()
+	defer gen.mu.Unlock()
+	if len(gen.sessions) != 4 {
+		t.Errorf("%d prompts generated, want 4: %q", len(gen.sessions), gen.sessions)
+	}
+	if gen.maxActive != 2 {
+		t.Errorf("at most %d prompts ran at once, want 2", gen.maxActive)
+	}
+	if gen.maxPerSession != 1 {
+		t.Errorf("%d prompts ran at once for one session, want 1", gen.maxPerSession)
+	}
+}
+
+func TestPipelineImmediateMode(t *testing.T) {
+	tp := startPipeline(t, map[string]string{"GENERATE_INTERVAL": "1"})
+
+	// Without the clock moving, every message generates right away.
+	for i := range 3 {
+		tp.send(turn(fmt.Sprint("m", i), fmt.Sprint("answer ", i)))
+		tp.nextImage(t)
+	}
+}
+
+func TestPipelineClockGoingBackwards(t *testing.T) {
+	tp := startPipeline(t, map[string]string{"GENERATE_INTERVAL": "60"})
+
+	tp.send(turn("m1", "first"))
+	tp.nextImage(t)
+
+	// The wait is capped at one interval, however far the clock went back.
+	tp.clock.Advance(-time.Hour)
+	tp.send(turn("m2", "second"))
+	tp.clock.Advance(59 * time.Second)
+	tp.noImage(t)
+	tp.clock.Advance(time.Second)
+	tp.nextImage(t)
+}
+
+func TestPipelineCodeHeavy(t *testing.T) {
+	const diff = "diff --git a/main.go b/main.go\n--- a/main.go\n+++ b/main.go\n@@ -1,2 +1,2 @@\n-var x = 1\n+var x = 2\n"
+	tests := []struct {
+		mode         string
+		wantImage    bool
+		wantGuidance bool
+	}{
+		{"off", true, false},
+		{"skip", false, false},
+		{"abstract", true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			tp := startPipeline(t, map[string]string{"IMGCHAT_CODE_HEAVY": tt.mode})
+			tp.send(turn("m1", diff))
+			if !tt.wantImage {
+				tp.noImage(t)
+				if n := len(tp.promptGen.Requests()); n != 0 {
+					t.Fatalf("got %d prompt requests, want none", n)
+				}
+				return
+			}
+			tp.nextImage(t)
+			if got := tp.promptGen.Requests()[0].Guidance; (got != "") != tt.wantGuidance {
+				t.Errorf("Guidance = %q, want guidance %v", got, tt.wantGuidance)
+			}
+		})
+	}
+}
+
+func TestPipelineRegenerateLast(t *testing.T) {
+	tp := startPipeline(t, map[string]string{"IMGCHAT_MIN_DISPLAY_INTERVAL": "60"})
+
+	tp.send(turn("m1", "answer"))
+	first := tp.nextImage(t)
+
+	if _, err := tp.RegenerateLast("no-such-session"); err == nil {
+		t.Error("regenerated an image for a session without one")
+	}
+
+	si, err := tp.RegenerateLast(first.SessionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if si.Filename == first.Filename || si.SessionID != first.SessionID {
+		t.Errorf("regenerated %+v, want a new image for session %s", si, first.SessionID)
+	}
+	if got := len(tp.promptGen.Requests()); got != 1 {
+		t.Errorf("got %d prompt requests, want the cached prompt reused", got)
+	}
+
+	// Too soon after the first image: held back like any other.
+	tp.noImage(t)
+	tp.clock.Advance(time.Minute)
+	if got := tp.nextImage(t); got.Filename != si.Filename {
+		t.Errorf("broadcast %s, want %s", got.Filename, si.Filename)
+	}
+	if got := tp.QueueStats().Processed; got != 2 {
+		t.Errorf("processed = %d, want 2", got)
+	}
+}
+
+// gatedImageGenerator signals started when a generation begins and holds it
+// until release is signalled.
+type gatedImageGenerator struct {
+	imagechat.ImageGenerator
+	started chan struct{}
+	release chan struct{}
+}
+
+func (g *gatedImageGenerator) Generate(prompt string) (string, error) {
+	g.started <- struct{}{}
+	<-g.release
+	return g.ImageGenerator.Generate(prompt)
+}
+
+func TestPipelineRegenerateLastBusy(t *testing.T) {
+	fake, err := imagechattest.NewImageGenerator(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	gen := &gatedImageGenerator{ImageGenerator: fake, started: make(chan struct{}), release: make(chan struct{})}
+	tp := startPipeline(t, nil, func(pc *imagechat.PipelineConfig) { pc.ImageGen = gen })
+
+	go tp.send(turn("m1", "first"))
+	<-gen.started
+	gen.release <- struct{}{}
+	first := tp.nextImage(t)
+
+	tp.clock.Advance(time.Minute)
+	go tp.send(turn("m2", "second"))
+	<-gen.started
+	if _, err := tp.RegenerateLast(first.SessionID); err == nil {
+		t.Error("regenerated while the image stage was busy")
+	}
+	if got := tp.QueueStats().Dropped; got != 1 {
+		t.Errorf("dropped = %d, want 1", got)
+	}
+	gen.release <- struct{}{}
+	tp.nextImage(t)
+}
+
+// toolResultLine returns the user entry logging a tool's output.
+func toolResultLine(output string) string {
+	return fmt.Sprintf(`{"type":"user","message":{"role":"user","content":[{"type":"tool_result","tool_use_id":"t1","content":%q}]}}`+"\n", output)
+}
+
+func TestPipelineWaitsForEndTurn(t *testing.T) {
+	tp := startPipeline(t, map[string]string{"IMGCHAT_WAIT_TURN_COMPLETE": "1", "IMGCHAT_TURN_QUIET_PERIOD": "5"})
+	const path = "/projects/-home-me-app/session.jsonl"
+
+	tp.send(imagechat.FileEvent{Path: path, NewData: []byte(userLine("fix the test") + assistantLine("m1", "Let me run it.", "tool_use"))})
+	tp.noImage(t)
+
+	// A turn known to be in progress is not cut short by the quiet period.
+	tp.clock.Advance(time.Minute)
+	tp.send(imagechat.FileEvent{Path: path, NewData: []byte(toolResultLine("--- FAIL: TestX"))})
+	tp.noImage(t)
+	tp.clock.Advance(time.Minute)
+	tp.noImage(t)
+
+	tp.send(imagechat.FileEvent{Path: path, NewData: []byte(assistantLine("m2", "Fixed, the test passes now.", "end_turn"))})
+	tp.nextImage(t)
+	if got := len(tp.promptGen.Requests()); got != 1 {
+		t.Fatalf("got %d prompt requests, want 1", got)
+	}
+	if got := lastRequestText(t, tp); got != "Fixed, the test passes now." {
+		t.Errorf("prompt generated from %q, want the end of the turn", got)
+	}
+}
+
+func TestPipelineTurnQuietPeriod(t *testing.T) {
+	tp := startPipeline(t, map[string]string{"IMGCHAT_WAIT_TURN_COMPLETE": "1", "IMGCHAT_TURN_QUIET_PERIOD": "5"})
+	const path = "/projects/-home-me-app/session.jsonl"
+
+	// Streamed entries carry no stop_reason, so only quiet ends the turn.
+	tp.send(imagechat.FileEvent{Path: path, NewData: []byte(userLine("explain it") + assistantLine("m1", "First,", ""))})
+	tp.clock.Advance(3 * time.Second)
+	tp.noImage(t)
+
+	// Another write restarts the quiet period.
+	tp.send(imagechat.FileEvent{Path: path, NewData: []byte(assistantLine("m2", "and then the rest.", ""))})
+	tp.clock.Advance(3 * time.Second)
+	tp.noImage(t)
+
+	tp.clock.Advance(2 * time.Second)
+	tp.nextImage(t)
+	if got := len(tp.promptGen.Requests()); got != 1 {
+		t.Fatalf("got %d prompt requests, want 1", got)
+	}
+	if got := lastRequestText(t, tp); got != "and then the rest." {
+		t.Errorf("prompt generated from %q, want the last write", got)
+	}
+}
+
+func TestPipelineUserContext(t *testing.T) {
+	tp := startPipeline(t, map[string]string{"IMGCHAT_CONTEXT_ROLE": "user"})
+	const path = "/projects/-home-me-app/session.jsonl"
+
+	tp.send(imagechat.FileEvent{Path: path, NewData: []byte(userLine("draw a castle"))})
+	tp.nextImage(t)
+
+	// Neither the assistant's reply nor a command entry is something the
+	// user typed.
+	for _, line := range []string{
+		assistantLine("m1", "Here is a castle on a hill.", "end_turn"),
+		userLine("<command-name>/clear</command-name>"),
+	} {
+		tp.clock.Advance(time.Minute)
+		tp.send(imagechat.FileEvent{Path: path, NewData: []byte(line)})
+		tp.noImage(t)
+	}
+
+	tp.clock.Advance(time.Minute)
+	tp.send(imagechat.FileEvent{Path: path, NewData: []byte(userLine("now add a dragon"))})
+	tp.nextImage(t)
+
+	reqs := tp.promptGen.Requests()
+	if len(reqs) != 2 {
+		t.Fatalf("got %d prompt requests, want 2", len(reqs))
+	}
+	var got []string
+	for _, m := range reqs[1].Messages {
+		got = append(got, m.Role+": "+m.Content)
+	}
+	if want := []string{"user: draw a castle", "user: now add a dragon"}; !slices.Equal(got, want) {
+		t.Errorf("request messages = %q, want %q", got, want)
+	}
+	if !strings.Contains(reqs[1].Guidance, "only the user's messages") {
+		t.Errorf("request guidance %q does not say the context is user-only", reqs[1].Guidance)
+	}
+}
@@ -0,0 +1,98 @@
+package imagechat
+
+import (
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// distinctPromptGuidance is added to the request when a prompt is regenerated
+// because it nearly repeats another session's recent prompt (%q).
+const distinctPromptGuidance = "Another session just produced this very similar image prompt: %q. Make this one visually distinct from it: choose a different scene, composition, setting and color palette."
+
+// recentPrompt is one entry of a promptHistory.
+type recentPrompt struct {
+	sessionID string
+	prompt    string
+	tokens    map[string]struct{}
+}
+
+// promptHistory is a bounded buffer of the most recent prompts across all
+// sessions, for spotting near-duplicates. It is safe for concurrent use.
+type promptHistory struct {
+	mu      sync.Mutex
+	size    int
+	prompts []recentPrompt
+}
+
+// newPromptHistory returns a history of the last size prompts. A size outside
+// 1..maxPromptDedupWindow, as from a Config built without LoadConfig, falls
+// back to the default or the maximum.
+func newPromptHistory(size int) *promptHistory {
+	switch {
+	case size < 1:
+		size = defaultPromptDedupWindow
+	case size > maxPromptDedupWindow:
+		size = maxPromptDedupWindow
+	}
+	return &promptHistory{size: size}
+}
+
+// mostSimilar returns the recent prompt from a session other than sessionID
+// that shares the most tokens with prompt, and their overlap (0-1). It
+// returns ("", 0) when there is none.
+func (h *promptHistory) mostSimilar(sessionID, prompt string) (string, float64) {
+	tokens := promptTokens(prompt)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var best string
+	var bestScore float64
+	for _, rp := range h.prompts {
+		if rp.sessionID == sessionID {
+			continue
+		}
+		if score := tokenOverlap(tokens, rp.tokens); score > bestScore {
+			best, bestScore = rp.prompt, score
+		}
+	}
+	return best, bestScore
+}
+
+// add records prompt, dropping the oldest entry when the buffer is full.
+func (h *promptHistory) add(sessionID, prompt string) {
+	rp := recentPrompt{sessionID: sessionID, prompt: prompt, tokens: promptTokens(prompt)}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.prompts) >= h.size && len(h.prompts) > 0 {
+		h.prompts = h.prompts[1:]
+	}
+	h.prompts = append(h.prompts, rp)
+}
+
+// promptTokens returns the set of lowercased words in prompt. SD weighting
+// syntax and punctuation are ignored.
+func promptTokens(prompt string) map[string]struct{} {
+	words := strings.FieldsFunc(strings.ToLower(prompt), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	tokens := make(map[string]struct{}, len(words))
+	for _, w := range words {
+		tokens[w] = struct{}{}
+	}
+	return tokens
+}
+
+// tokenOverlap is the Jaccard similarity of two token sets: the share of
+// their combined tokens that both contain.
+func tokenOverlap(a, b map[string]struct{}) float64 {
+	if len(a) == 0 || len(b) == 0 {
+		return 0
+	}
+	shared := 0
+	for t := range a {
+		if _, ok := b[t]; ok {
+			shared++
+		}
+	}
+	return float64(shared) / float64(len(a)+len(b)-shared)
+}
@@ -0,0 +1,36 @@
+package imagechat
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestPromptHistorySize(t *testing.T) {
+	tests := []struct {
+		size int
+		want int
+	}{
+		{0, defaultPromptDedupWindow},
+		{-1, defaultPromptDedupWindow},
+		{1, 1},
+		{5, 5},
+		{maxPromptDedupWindow + 1, maxPromptDedupWindow},
+	}
+	for _, tt := range tests {
+		h := newPromptHistory(tt.size)
+		for i := range tt.want + 3 {
+			h.add("s", fmt.Sprintf("prompt %d", i))
+		}
+		if len(h.prompts) != tt.want {
+			t.Errorf("size %d: kept %d prompts, want %d", tt.size, len(h.prompts), tt.want)
+		}
+	}
+}
+
+func TestNewPipelineWithoutDedupWindow(t *testing.T) {
+	p := NewPipeline(PipelineConfig{Config: &Config{PromptDedupThreshold: 0.8}})
+	p.recentPrompts.add("s", "a quiet harbor at dawn")
+	if _, score := p.recentPrompts.mostSimilar("other", "a quiet harbor at dawn"); score != 1 {
+		t.Errorf("overlap = %v, want 1", score)
+	}
+}
@@ -0,0 +1,599 @@
+package imagechat
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/genai"
+)
+
+const baseSystemPrompt = `You are an image prompt generator for an anime-style illustration AI.
+Given a conversation between a user and an AI assistant, generate a short English prompt
+describing an anime-style illustration that captures the mood and situation of the latest
+assistant message.
+
+You MUST respond with a JSON object in the following format and nothing else:
+{"prompt": "<your image prompt here>"}
+
+Do NOT include any text outside the JSON object. No explanations, no markdown, no commentary.
+
+Rules for the prompt value inside the JSON:
+- The entire prompt MUST be in English only. Do NOT include any non-English characters, words, or text (no Japanese, Chinese, Korean, etc.). Even for in-scene text like signs, speech bubbles, or whiteboards, describe them in English or omit them.
+- The prompt should describe a single anime girl character reacting to or representing
+  the situation in the conversation.
+- Include emotional expressions, poses, and background elements that match the context.
+- Also weigh the tone of the user's latest message (e.g. frustration, relief, excitement),
+  which often says more about the mood of the session than the assistant's reply.
+- Keep the prompt under 200 words.
+- Do NOT include any negative prompts or technical parameters.`
+
+// PromptGenerator is the interface for prompt generation backends.
+type PromptGenerator interface {
+	Generate(ctx context.Context, req PromptRequest) (string, error)
+}
+
+// PromptRequest carries the conversation context for a single prompt generation.
+type PromptRequest struct {
+	Messages    []Message
+	SessionPath string
+	// Summary is an optional rolling summary of the conversation before Messages.
+	Summary string
+	// Guidance is an optional instruction for this request only, added after
+	// the configured prompt guidance.
+	Guidance string
+	// Project is the name of the project the session works on, given as a
+	// hint about the subject matter ("" = none).
+	Project string
+	// Title is the session title, for IMGCHAT_USER_PROMPT_TEMPLATE.
+	Title string
+	// Outcome is what the tool runs of the current turn reported, given as
+	// a hint about the mood (OutcomeNone = none).
+	Outcome Outcome
+}
+
+// textCompleter is implemented by backends that can answer a single
+// system+user prompt pair with free-form text.
+type textCompleter interface {
+	complete(ctx context.Context, systemPrompt, userPrompt string) (string, error)
+}
+
+// promptGeneratorBase contains shared logic for character selection and system prompt building.
+type promptGeneratorBase struct {
+	cfg        *Config
+	characters []Character
+
+	// Character assignment state: which character each session uses, and when
+	// each character was last handed out. Guarded by mu.
+	mu              sync.Mutex
+	assignments     map[string]*characterAssignment
+	characterLastAt []time.Time
+	// rotateNext is the character CharacterModeRotate hands out next.
+	rotateNext int
+}
+
+// characterAssignment records the character chosen for a session and the last
+// time that session generated a prompt.
+type characterAssignment struct {
+	index    int
+	lastSeen time.Time
+	// locked is set when the user picked the character with lockCharacter;
+	// it then stays for the rest of the run.
+	locked bool
+}
+
+// maxCharacterAssignments caps the number of remembered session assignments.
+const maxCharacterAssignments = 50
+
+func newPromptGeneratorBase(cfg *Config, characters []Character) promptGeneratorBase {
+	return promptGeneratorBase{
+		cfg:             cfg,
+		characters:      characters,
+		assignments:     make(map[string]*characterAssignment),
+		characterLastAt: make([]time.Time, len(characters)),
+	}
+}
+
+// selectCharacterIndex returns the character index for a given session path.
+// A session keeps the character it was first assigned. New sessions get the
+// least-recently-used character that no other active session is using; when
+// every character is taken, it falls back to an FNV-1a hash of the session
+// file basename.
+// In CharacterModeRotate, every call advances to the next character instead.
+// A character locked to the session overrides all of these.
+// Returns -1 if no character settings are available.
+func (b *promptGeneratorBase) selectCharacterIndex(sessionPath string) int {
+	if len(b.characters) == 0 {
+		return -1
+	}
+	basename := filepath.Base(sessionPath)
+	if idx, ok := b.lockedCharacter(basename); ok {
+		return idx
+	}
+	if b.cfg != nil && b.cfg.CharacterMode == CharacterModeRotate {
+		return b.rotateCharacter(basename)
+	}
+	if b.cfg != nil && b.cfg.Reproducible {
+		// Timing-independent selection so runs are repeatable.
+		return hashCharacterIndex(basename, len(b.characters))
+	}
+	now := b.cfg.clock().Now()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if a, ok := b.assignments[basename]; ok {
+		a.lastSeen = now
+		b.characterLastAt[a.index] = now
+		return a.index
+	}
+
+	idx := b.pickUnusedCharacter(now)
+	if idx < 0 {
+		idx = hashCharacterIndex(basename, len(b.characters))
+		Debugf("all characters in use by active sessions, hashing session %q to character '%s'", basename, b.characters[idx].Name)
+	}
+
+	if len(b.assignments) >= maxCharacterAssignments {
+		b.evictOldestAssignment()
+	}
+	b.assignments[basename] = &characterAssignment{index: idx, lastSeen: now}
+	b.characterLastAt[idx] = now
+	Infof("using character '%s' for session %s", b.characters[idx].Name, SessionIDFromPath(basename))
+	return idx
+}
+
+// characterIndexFor returns the character currently assigned to a session
+// without updating any assignment state, or -1 if none is assigned.
+func (b *promptGeneratorBase) characterIndexFor(sessionPath string) int {
+	if len(b.characters) == 0 {
+		return -1
+	}
+	basename := filepath.Base(sessionPath)
+	b.mu.Lock()
+	a, ok := b.assignments[basename]
+	var idx int
+	var locked bool
+	if ok {
+		idx, locked = a.index, a.locked
+	}
+	b.mu.Unlock()
+	if locked {
+		return idx
+	}
+	if b.cfg != nil && b.cfg.Reproducible && b.cfg.CharacterMode != CharacterModeRotate {
+		return hashCharacterIndex(basename, len(b.characters))
+	}
+	if ok {
+		return idx
+	}
+	return -1
+}
+
+// lockedCharacter returns the character locked to a session, marking the
+// session as seen, or false if none is locked.
+func (b *promptGeneratorBase) lockedCharacter(basename string) (int, bool) {
+	now := b.cfg.clock().Now()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	a, ok := b.assignments[basename]
+	if !ok || !a.locked {
+		return -1, false
+	}
+	a.lastSeen = now
+	b.characterLastAt[a.index] = now
+	return a.index, true
+}
+
+// lockCharacter assigns character idx to a session for the rest of the run,
+// overriding automatic assignment, rotation and reproducible mode. An idx of
+// -1 removes the lock, leaving the session on its current character.
+func (b *promptGeneratorBase) lockCharacter(sessionID string, idx int) {
+	basename := sessionID + ".jsonl"
+	now := b.cfg.clock().Now()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	a, ok := b.assignments[basename]
+	if idx < 0 {
+		if ok {
+			a.locked = false
+		}
+		return
+	}
+	if !ok {
+		if len(b.assignments) >= maxCharacterAssignments {
+			b.evictOldestAssignment()
+		}
+		a = &characterAssignment{lastSeen: now}
+		b.assignments[basename] = a
+	}
+	a.index = idx
+	a.locked = true
+	b.characterLastAt[idx] = now
+}
+
+// rotateCharacter hands out the next character in turn and records it as the
+// session's current one, so characterIndexFor reports the character of the
+// prompt just generated.
+func (b *promptGeneratorBase) rotateCharacter(basename string) int {
+	now := b.cfg.clock().Now()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	idx := b.rotateNext
+	b.rotateNext = (idx + 1) % len(b.characters)
+	if a, ok := b.assignments[basename]; ok {
+		a.index = idx
+		a.lastSeen = now
+	} else {
+		if len(b.assignments) >= maxCharacterAssignments {
+			b.evictOldestAssignment()
+		}
+		b.assignments[basename] = &characterAssignment{index: idx, lastSeen: now}
+	}
+	b.characterLastAt[idx] = now
+	Debugf("rotating to character '%s' for session %s", b.characters[idx].Name, SessionIDFromPath(basename))
+	return idx
+}
+
+// activeAssignments returns the sessions active within the configured window,
+// keyed by the index of their character.
+func (b *promptGeneratorBase) activeAssignments() map[int][]string {
+	window := defaultCharacterActiveWindow
+	if b.cfg != nil {
+		window = b.cfg.CharacterActiveWindow
+	}
+	now := b.cfg.clock().Now()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	out := make(map[int][]string)
+	for basename, a := range b.assignments {
+		if now.Sub(a.lastSeen) <= window {
+			out[a.index] = append(out[a.index], SessionIDFromPath(basename))
+		}
+	}
+	for _, sessions := range out {
+		sort.Strings(sessions)
+	}
+	return out
+}
+
+// characterLookup is implemented by prompt generators that assign characters
+// to sessions, and by wrappers around them.
+type characterLookup interface {
+	characterIndexFor(sessionPath string) int
+}
+
+// characterIndexFor returns the character pg assigned to a session, or -1 if
+// pg does not assign characters.
+func characterIndexFor(pg PromptGenerator, sessionPath string) int {
+	if cl, ok := pg.(characterLookup); ok {
+		return cl.characterIndexFor(sessionPath)
+	}
+	return -1
+}
+
+// pickUnusedCharacter returns the least-recently-used character that is not
+// assigned to any session active within the configured window, or -1 if all
+// characters are in use. Caller must hold b.mu.
+func (b *promptGeneratorBase) pickUnusedCharacter(now time.Time) int {
+	window := defaultCharacterActiveWindow
+	if b.cfg != nil {
+		window = b.cfg.CharacterActiveWindow
+	}
+
+	inUse := make([]bool, len(b.characters))
+	for _, a := range b.assignments {
+		if now.Sub(a.lastSeen) <= window {
+			inUse[a.index] = true
+		}
+	}
+
+	best := -1
+	for i := range b.characters {
+		if inUse[i] {
+			continue
+		}
+		if best < 0 || b.characterLastAt[i].Before(b.characterLastAt[best]) {
+			best = i
+		}
+	}
+	return best
+}
+
+// evictOldestAssignment drops the session assignment that was seen least
+// recently. Locked assignments are kept. Caller must hold b.mu.
+func (b *promptGeneratorBase) evictOldestAssignment() {
+	var oldestKey string
+	var oldest time.Time
+	for k, a := range b.assignments {
+		if a.locked {
+			continue
+		}
+		if oldestKey == "" || a.lastSeen.Before(oldest) {
+			oldestKey = k
+			oldest = a.lastSeen
+		}
+	}
+	delete(b.assignments, oldestKey)
+}
+
+// hashCharacterIndex maps a session file basename to a character index using FNV-1a.
+func hashCharacterIndex(basename string, n int) int {
+	h := fnv.New32a()
+	h.Write([]byte(basename))
+	return int(h.Sum32() % uint32(n))
+}
+
+// userContextGuidance is added to prompt requests in ContextRoleUser mode,
+// whose context holds only the user's messages.
+const userContextGuidance = "The conversation above contains only the user's messages. Illustrate what the user is asking for or talking about, not the assistant's answer."
+
+// projectHintPrompt is added to the system prompt when requests carry the
+// project name.
+const projectHintPrompt = "The request may name the project being worked on. If it does, let the scene hint at what is being built (for example a web app, a game or a data pipeline) through props and setting, never through written text."
+
+// buildSystemPrompt constructs the full system prompt with character setting.
+func (b *promptGeneratorBase) buildSystemPrompt(characterIndex int) string {
+	sp := baseSystemPrompt
+	if b.cfg != nil && b.cfg.StyleGuidance != "" {
+		sp += "\n\nArt style:\n" + b.cfg.StyleGuidance
+	}
+	if b.cfg != nil && b.cfg.ProjectHint {
+		sp += "\n\n" + projectHintPrompt
+	}
+	if characterIndex >= 0 && characterIndex < len(b.characters) {
+		sp += "\n\nCharacter setting:\n" + b.characters[characterIndex].Setting
+	}
+	if b.cfg != nil && len(b.cfg.StyleModifiers) > 0 {
+		sp += "\n\nStyle modifiers (apply to every image, on top of the character setting):"
+		for _, m := range b.cfg.StyleModifiers {
+			sp += "\n" + m.Setting
+		}
+	}
+	return sp
+}
+
+// max length of last message printed to log
+const maxLastMsgLen = 200
+
+// logDebugInfo logs the character used and a last message preview when debug mode is enabled.
+func (b *promptGeneratorBase) logDebugInfo(sessionPath string, charIdx int, messages []Message) {
+	if logLevel < LogLevelDebug {
+		return
+	}
+
+	if charIdx >= 0 {
+		Debugf("using character '%s' for session %q", b.characters[charIdx].Name, filepath.Base(sessionPath))
+	}
+
+	if len(messages) > 0 {
+		lastMsg := messages[len(messages)-1]
+		preview := strconv.Quote(truncateRunes(lastMsg.Content, maxLastMsgLen))
+		Debugf("last message content (first %d chars): %s", maxLastMsgLen, preview)
+	}
+}
+
+// buildUserPrompt constructs the user prompt from the request's messages,
+// each cut down to cfg.MaxMessageChars, preceded by the rolling summary, the
+// project name and the outcome hint when available and followed by the
+// configured and per-request prompt guidance. A configured user prompt
+// template replaces all of it but the response format.
+func (b *promptGeneratorBase) buildUserPrompt(req PromptRequest, characterIndex int) (string, error) {
+	messages := req.Messages
+	if b.cfg != nil {
+		// Keep a giant paste from dominating the context or the token budget.
+		messages = truncateMessages(messages, b.cfg.MaxMessageChars)
+	}
+	convJSON, err := json.Marshal(messages)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal messages: %w", err)
+	}
+	var guidance []string
+	if b.cfg != nil && b.cfg.PromptGuidance != "" {
+		guidance = append(guidance, b.cfg.PromptGuidance)
+	}
+	if req.Guidance != "" {
+		guidance = append(guidance, req.Guidance)
+	}
+
+	var sb strings.Builder
+	if b.cfg != nil && b.cfg.userPromptTmpl != nil {
+		data := UserPromptData{
+			Messages:     messages,
+			MessagesJSON: string(convJSON),
+			Title:        req.Title,
+			Project:      req.Project,
+			Summary:      req.Summary,
+			Outcome:      req.Outcome.Hint(),
+			Guidance:     strings.Join(guidance, " "),
+		}
+		if data.Project == "" && req.SessionPath != "" {
+			data.Project = ProjectFromPath(req.SessionPath)
+		}
+		if characterIndex >= 0 && characterIndex < len(b.characters) {
+			data.Character = b.characters[characterIndex].Name
+		}
+		if err := b.cfg.userPromptTmpl.Execute(&sb, data); err != nil {
+			return "", fmt.Errorf("failed to execute user prompt template: %w", err)
+		}
+		sb.WriteString("\n\nRespond with ONLY a JSON object: {\"prompt\": \"<your prompt>\"}")
+		return sb.String(), nil
+	}
+
+	if req.Summary != "" {
+		fmt.Fprintf(&sb, "Summary of the earlier conversation:\n%s\n\n", req.Summary)
+	}
+	if req.Project != "" {
+		fmt.Fprintf(&sb, "Project being worked on: %s\n\n", req.Project)
+	}
+	if hint := req.Outcome.Hint(); hint != "" {
+		fmt.Fprintf(&sb, "What just happened: %s. Let the mood of the scene reflect it.\n\n", hint)
+	}
+	fmt.Fprintf(&sb, "Here is the recent conversation:\n%s\n\nGenerate an anime-style image prompt based on this conversation.", string(convJSON))
+	if len(guidance) > 0 {
+		fmt.Fprintf(&sb, "\n\nAdditional guidance: %s\n\n", strings.Join(guidance, " "))
+	} else {
+		sb.WriteString(" ")
+	}
+	sb.WriteString("Respond with ONLY a JSON object: {\"prompt\": \"<your prompt>\"}")
+	return sb.String(), nil
+}
+
+// generateWith runs the shared prompt-generation flow against a backend.
+func (b *promptGeneratorBase) generateWith(ctx context.Context, backend textCompleter, req PromptRequest) (string, error) {
+	charIdx := b.selectCharacterIndex(req.SessionPath)
+	systemPrompt := b.buildSystemPrompt(charIdx)
+	b.logDebugInfo(req.SessionPath, charIdx, req.Messages)
+
+	userPrompt, err := b.buildUserPrompt(req, charIdx)
+	if err != nil {
+		return "", err
+	}
+
+	text, err := backend.complete(ctx, systemPrompt, userPrompt)
+	if err != nil {
+		return "", err
+	}
+	return extractPromptFromResponse(text), nil
+}
+
+// promptResponse represents the expected JSON response from the LLM.
+type promptResponse struct {
+	Prompt string `json:"prompt"`
+}
+
+// jsonObjectPattern matches a JSON object containing a "prompt" key.
+var jsonObjectPattern = regexp.MustCompile(`\{[^{}]*"prompt"\s*:\s*"[^"]*(?:\\.[^"]*)*"[^{}]*\}`)
+
+// extractPromptFromResponse attempts to extract the image prompt from the LLM response.
+// It first tries to parse the entire response as JSON. If that fails, it searches
+// for a JSON object within the response text. If no JSON is found, it returns
+// the original text as a fallback.
+func extractPromptFromResponse(text string) string {
+	text = strings.TrimSpace(text)
+
+	// Try parsing the whole response as JSON
+	var resp promptResponse
+	if err := json.Unmarshal([]byte(text), &resp); err == nil && resp.Prompt != "" {
+		return strings.TrimSpace(resp.Prompt)
+	}
+
+	// Try to find a JSON object embedded in the response
+	if match := jsonObjectPattern.FindString(text); match != "" {
+		if err := json.Unmarshal([]byte(match), &resp); err == nil && resp.Prompt != "" {
+			return strings.TrimSpace(resp.Prompt)
+		}
+	}
+
+	// Fallback: return original text (best effort)
+	Warnf("warning: LLM response was not valid JSON, using raw text")
+	return text
+}
+
+// GeminiPromptGenerator generates prompts using the Gemini API.
+type GeminiPromptGenerator struct {
+	promptGeneratorBase
+	client *genai.Client
+	model  string
+}
+
+// geminiClientConfig returns the client settings for the Gemini backend
+// selected in cfg. apiKey is only used with the Gemini Developer API.
+func geminiClientConfig(cfg *Config, apiKey string) *genai.ClientConfig {
+	if cfg != nil && cfg.GeminiBackend == GeminiBackendVertex {
+		return &genai.ClientConfig{
+			Backend:  genai.BackendVertexAI,
+			Project:  cfg.GoogleCloudProject,
+			Location: cfg.GoogleCloudLocation,
+		}
+	}
+	return &genai.ClientConfig{
+		APIKey:  apiKey,
+		Backend: genai.BackendGeminiAPI,
+	}
+}
+
+func NewGeminiPromptGenerator(apiKey, model string, cfg *Config, characters []Character) (*GeminiPromptGenerator, error) {
+	client, err := genai.NewClient(context.Background(), geminiClientConfig(cfg, apiKey))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Gemini client: %w", err)
+	}
+
+	return &GeminiPromptGenerator{
+		promptGeneratorBase: newPromptGeneratorBase(cfg, characters),
+		client:              client,
+		model:               model,
+	}, nil
+}
+
+const (
+	geminiTemperature     = 0.8
+	geminiMaxOutputTokens = 8192
+)
+
+func (pg *GeminiPromptGenerator) Generate(ctx context.Context, req PromptRequest) (string, error) {
+	return pg.generateWith(ctx, pg, req)
+}
+
+// complete sends a single system+user prompt pair to Gemini and returns the text reply.
+func (pg *GeminiPromptGenerator) complete(ctx context.Context, systemPrompt, userPrompt string) (string, error) {
+	genCfg := &genai.GenerateContentConfig{
+		SystemInstruction: genai.NewContentFromText(systemPrompt, genai.RoleUser),
+		Temperature:       genai.Ptr(float32(geminiTemperature)),
+		MaxOutputTokens:   geminiMaxOutputTokens,
+	}
+	if pg.cfg != nil && pg.cfg.Reproducible {
+		genCfg.Temperature = genai.Ptr(float32(0))
+		if pg.cfg.Seed >= 0 {
+			genCfg.Seed = genai.Ptr(int32(pg.cfg.Seed))
+		}
+	}
+	resp, err := pg.client.Models.GenerateContent(ctx, pg.model, genai.Text(userPrompt), genCfg)
+	if err != nil {
+		return "", fmt.Errorf("Gemini API error: %w", err)
+	}
+
+	if resp != nil && len(resp.Candidates) > 0 {
+		reason := resp.Candidates[0].FinishReason
+		if reason != genai.FinishReasonStop {
+			Warnf("warning: Gemini finish reason: %s", reason)
+		}
+	}
+
+	text := extractTextFromResponse(resp)
+	if text == "" {
+		return "", fmt.Errorf("empty response from Gemini")
+	}
+
+	return text, nil
+}
+
+func extractTextFromResponse(resp *genai.GenerateContentResponse) string {
+	if resp == nil || len(resp.Candidates) == 0 {
+		return ""
+	}
+	candidate := resp.Candidates[0]
+	if candidate.Content == nil || len(candidate.Content.Parts) == 0 {
+		return ""
+	}
+	var parts []string
+	for _, part := range candidate.Content.Parts {
+		if part.Text != "" {
+			parts = append(parts, part.Text)
+		}
+	}
+	return strings.Join(parts, "")
+}
@@ -0,0 +1,58 @@
+package imagechat
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBuildUserPromptHugeMessage(t *testing.T) {
+	huge := "HEAD " + strings.Repeat("log line\n", 500_000/9) + " TAIL"
+	b := newPromptGeneratorBase(&Config{MaxMessageChars: 2000}, nil)
+	prompt, err := b.buildUserPrompt(PromptRequest{Messages: []Message{
+		{Role: "user", Content: huge},
+		{Role: "assistant", Content: "That log shows a timeout."},
+	}}, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(prompt) > 5000 {
+		t.Errorf("prompt is %d bytes, want the pasted log cut to about 2000 characters", len(prompt))
+	}
+	for _, want := range []string{"HEAD", "TAIL", "characters omitted", "That log shows a timeout."} {
+		if !strings.Contains(prompt, want) {
+			t.Errorf("prompt lacks %q", want)
+		}
+	}
+}
+
+func TestBuildUserPromptOutcome(t *testing.T) {
+	tests := []struct {
+		outcome Outcome
+		want    string
+	}{
+		{OutcomeNone, ""},
+		{OutcomeTestsPassed, "What just happened: the tests just passed, a moment of success and relief."},
+		{OutcomeBuildFailed, "What just happened: the build just failed with errors, a frustrating snag."},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.outcome), func(t *testing.T) {
+			b := newPromptGeneratorBase(&Config{}, nil)
+			prompt, err := b.buildUserPrompt(PromptRequest{
+				Messages: []Message{{Role: "assistant", Content: "Running the tests."}},
+				Outcome:  tt.outcome,
+			}, -1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.want == "" {
+				if strings.Contains(prompt, "What just happened") {
+					t.Errorf("prompt has an outcome hint:\n%s", prompt)
+				}
+				return
+			}
+			if !strings.Contains(prompt, tt.want) {
+				t.Errorf("prompt lacks %q:\n%s", tt.want, prompt)
+			}
+		})
+	}
+}
@@ -0,0 +1,49 @@
+package imagechat
+
+import (
+	"fmt"
+	"io"
+	"text/template"
+)
+
+// UserPromptData is what IMGCHAT_USER_PROMPT_TEMPLATE is executed with.
+type UserPromptData struct {
+	// Messages are the recent messages, each cut down to MaxMessageChars.
+	Messages []Message
+	// MessagesJSON is Messages encoded as the default prompt shows them.
+	MessagesJSON string
+	// Title is the session title: its first user message, shortened.
+	Title string
+	// Character is the name of the character chosen for the session.
+	Character string
+	// Project is the name of the project the session works on.
+	Project string
+	// Summary is the rolling summary of the earlier conversation, if enabled.
+	Summary string
+	// Outcome describes what the current turn's tool runs reported, such as
+	// tests passing, if IMGCHAT_OUTCOME_HINTS is enabled.
+	Outcome string
+	// Guidance joins IMGCHAT_PROMPT_GUIDANCE and per-request guidance.
+	Guidance string
+}
+
+// parseUserPromptTemplate parses a user prompt template and executes it once
+// against sample data, so a misspelled field fails at startup rather than on
+// every prompt.
+func parseUserPromptTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("user prompt").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	sample := UserPromptData{
+		Messages:     []Message{{Role: "user", Content: "hello"}, {Role: "assistant", Content: "hi"}},
+		MessagesJSON: `[{"role":"user","content":"hello"},{"role":"assistant","content":"hi"}]`,
+		Title:        "hello",
+		Character:    "hero",
+		Project:      "my-app",
+	}
+	if err := tmpl.Execute(io.Discard, sample); err != nil {
+		return nil, fmt.Errorf("template does not apply to the prompt data: %w", err)
+	}
+	return tmpl, nil
+}
@@ -0,0 +1,58 @@
+package imagechat
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+// recentImagesFile is the name of the catch-up image list stored in the
+// image directory when IMGCHAT_PERSIST_RECENT is set.
+const recentImagesFile = ".recent.json"
+
+// loadRecentImages reads the catch-up image list saved in imageDir, dropping
+// images that no longer exist (removed by cleanup while the app was down)
+// and keeping at most the last n. A missing or unreadable list yields none.
+func loadRecentImages(imageDir string, n int) []SessionImage {
+	data, err := os.ReadFile(filepath.Join(imageDir, recentImagesFile))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			Warnf("warning: could not read recent images: %v", err)
+		}
+		return nil
+	}
+	var saved []SessionImage
+	if err := json.Unmarshal(data, &saved); err != nil {
+		Warnf("warning: ignoring corrupt recent images list: %v", err)
+		return nil
+	}
+	var recent []SessionImage
+	for _, si := range saved {
+		if _, err := os.Stat(filepath.Join(imageDir, si.Filename)); err != nil {
+			Debugf("recent image %s no longer exists, not restoring it", si.Filename)
+			continue
+		}
+		recent = append(recent, si)
+	}
+	if len(recent) > n {
+		recent = recent[len(recent)-n:]
+	}
+	return recent
+}
+
+// saveRecentImages writes the catch-up image list to imageDir.
+func saveRecentImages(imageDir string, recent []SessionImage) error {
+	if recent == nil {
+		recent = []SessionImage{}
+	}
+	data, err := json.Marshal(recent)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(imageDir, recentImagesFile)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,145 @@
+package imagechat
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// EventSource produces session file events for the pipeline. Watcher is the
+// live source; ReplaySource plays back a saved session.
+type EventSource interface {
+	Events() <-chan FileEvent
+	// Run produces events until done is closed.
+	Run(done <-chan struct{}) error
+}
+
+// ReplayConfig holds the parameters for a ReplaySource.
+type ReplayConfig struct {
+	// Path is the session .jsonl file to play back.
+	Path string
+	// Speed scales the gaps between the original log timestamps (2 plays
+	// twice as fast). Ignored when Delay is set.
+	Speed float64
+	// Delay, if non-zero, is a fixed pause between lines instead of the
+	// original timing.
+	Delay time.Duration
+	// MaxGap caps any single pause, so long breaks in the original session
+	// don't stall the replay. 0 means no cap.
+	MaxGap time.Duration
+	// Clock paces the replay; nil means the real clock.
+	Clock Clock
+}
+
+// ReplaySource feeds the lines of a saved session file to the pipeline as
+// FileEvents, as if they were being appended live. It never touches the
+// watched directory.
+type ReplaySource struct {
+	cfg    ReplayConfig
+	clock  Clock
+	fileCh chan FileEvent
+}
+
+func NewReplaySource(rc ReplayConfig) *ReplaySource {
+	if rc.Speed <= 0 {
+		rc.Speed = 1
+	}
+	clock := rc.Clock
+	if clock == nil {
+		clock = realClock{}
+	}
+	return &ReplaySource{
+		cfg:    rc,
+		clock:  clock,
+		fileCh: make(chan FileEvent, 16),
+	}
+}
+
+// Events returns the channel on which replayed lines are delivered.
+func (r *ReplaySource) Events() <-chan FileEvent {
+	return r.fileCh
+}
+
+// Run plays the file back one line per event and returns when the last line
+// has been sent or done is closed. The events channel is left open so the
+// pipeline can still flush a deferred generation.
+func (r *ReplaySource) Run(done <-chan struct{}) error {
+	data, err := os.ReadFile(r.cfg.Path)
+	if err != nil {
+		return fmt.Errorf("replay: %w", err)
+	}
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	Infof("replaying %s (%d lines)", r.cfg.Path, len(lines))
+
+	var prev time.Time
+	for i, line := range lines {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		ts := lineTimestamp(line)
+		if i > 0 {
+			if !r.wait(r.gap(prev, ts), done) {
+				return nil
+			}
+		}
+		if !ts.IsZero() {
+			prev = ts
+		}
+		if !bytes.HasSuffix(line, []byte("\n")) {
+			line = append(line, '\n')
+		}
+		select {
+		case r.fileCh <- FileEvent{Path: r.cfg.Path, NewData: line}:
+		case <-done:
+			return nil
+		}
+	}
+	Infof("replay of %s finished", r.cfg.Path)
+	return nil
+}
+
+// gap returns the pause before a line logged at ts, following a line logged
+// at prev.
+func (r *ReplaySource) gap(prev, ts time.Time) time.Duration {
+	d := r.cfg.Delay
+	if d == 0 && !prev.IsZero() && ts.After(prev) {
+		d = time.Duration(float64(ts.Sub(prev)) / r.cfg.Speed)
+	}
+	if r.cfg.MaxGap > 0 && d > r.cfg.MaxGap {
+		d = r.cfg.MaxGap
+	}
+	return d
+}
+
+// wait pauses for d on the replay clock. It reports false if done was closed
+// first.
+func (r *ReplaySource) wait(d time.Duration, done <-chan struct{}) bool {
+	if d <= 0 {
+		return true
+	}
+	ch := make(chan struct{})
+	t := r.clock.AfterFunc(d, func() { close(ch) })
+	select {
+	case <-ch:
+		return true
+	case <-done:
+		t.Stop()
+		return false
+	}
+}
+
+// lineTimestamp returns the timestamp logged on a session line, or the zero
+// time if it has none.
+func lineTimestamp(line []byte) time.Time {
+	var entry rawEntry
+	if err := json.Unmarshal(line, &entry); err != nil {
+		return time.Time{}
+	}
+	ts, err := time.Parse(time.RFC3339Nano, entry.Timestamp)
+	if err != nil {
+		return time.Time{}
+	}
+	return ts
+}
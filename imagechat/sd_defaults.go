@@ -0,0 +1,99 @@
+package imagechat
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// sdOptionsDefaults holds the txt2img defaults a WebUI reports in
+// /sdapi/v1/options. Zero fields were not reported.
+type sdOptionsDefaults struct {
+	Width    int
+	Height   int
+	CfgScale float64
+}
+
+// fetchSDOptionsDefaults reads the txt2img defaults from the WebUI's options.
+// Forge reports the width, height and CFG scale of its active UI preset
+// ("sd", "xl" or "flux") as <preset>_t2i_*; AUTOMATIC1111 reports none, so
+// everything is left zero there.
+func fetchSDOptionsDefaults(ctx context.Context, baseURL string, headers http.Header) (sdOptionsDefaults, error) {
+	var d sdOptionsDefaults
+	url := strings.TrimRight(baseURL, "/") + "/sdapi/v1/options"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return d, fmt.Errorf("failed to create request: %w", err)
+	}
+	addHeaders(req, headers)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return d, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return d, fmt.Errorf("Stable Diffusion returned status %d", resp.StatusCode)
+	}
+
+	var opts map[string]any
+	if err := json.NewDecoder(resp.Body).Decode(&opts); err != nil {
+		return d, fmt.Errorf("failed to decode options: %w", err)
+	}
+	preset, _ := opts["forge_preset"].(string)
+	if preset == "" || preset == "all" {
+		preset = "sd"
+	}
+	if v, ok := opts[preset+"_t2i_width"].(float64); ok && v > 0 {
+		d.Width = int(v)
+	}
+	if v, ok := opts[preset+"_t2i_height"].(float64); ok && v > 0 {
+		d.Height = int(v)
+	}
+	if v, ok := opts[preset+"_t2i_cfg"].(float64); ok && v > 0 {
+		d.CfgScale = v
+	}
+	return d, nil
+}
+
+// inheritServerDefaults fills the parameters left zero by
+// IMGCHAT_SD_INHERIT_DEFAULTS from the WebUI's options, then falls back to
+// the built-in defaults for anything the WebUI did not report, and logs the
+// parameters that will be used.
+func (ig *SDImageGenerator) inheritServerDefaults(ctx context.Context) {
+	d, err := fetchSDOptionsDefaults(ctx, ig.cfg.GetSDBaseURL(), ig.cfg.SDHeaders)
+	if err != nil {
+		Warnf("warning: could not read Stable Diffusion options, using built-in defaults: %v", err)
+	}
+	if ig.width == 0 && d.Width > 0 {
+		ig.width = d.Width
+	}
+	if ig.height == 0 && d.Height > 0 {
+		ig.height = d.Height
+	}
+	if ig.cfgScale == 0 && d.CfgScale > 0 {
+		ig.cfgScale = d.CfgScale
+	}
+
+	if ig.steps == 0 {
+		ig.steps = defaultSDSteps
+	}
+	if ig.width == 0 {
+		ig.width = defaultSDWidth
+	}
+	if ig.height == 0 {
+		ig.height = defaultSDHeight
+	}
+	if ig.cfgScale == 0 {
+		ig.cfgScale = defaultSDCfgScale
+	}
+	if ig.samplerName == "" {
+		ig.samplerName = defaultSDSamplerName
+	}
+	if w, h := clampSDPixels(ig.width, ig.height, ig.hires.outputScale(), ig.cfg.SDMaxPixels); w != ig.width || h != ig.height {
+		Warnf("warning: Stable Diffusion default size %s exceeds IMGCHAT_SD_MAX_PIXELS %d, using %s", sdSizeString(ig.width, ig.height, ig.hires), ig.cfg.SDMaxPixels, sdSizeString(w, h, ig.hires))
+		ig.width, ig.height = w, h
+	}
+	Infof("SD parameters: %dx%d, %d steps, CFG %.1f, sampler %s", ig.width, ig.height, ig.steps, ig.cfgScale, ig.samplerName)
+}
@@ -0,0 +1,129 @@
+package imagechat
+
+import (
+	"strings"
+	"unicode"
+)
+
+// subjectWords mark a prompt phrase as describing the character rather than
+// the scene. Such phrases are kept first when a prompt has to be trimmed.
+var subjectWords = map[string]bool{
+	"1girl": true, "girl": true, "woman": true, "boy": true, "man": true,
+	"she": true, "her": true, "character": true, "solo": true,
+	"hair": true, "eyes": true, "face": true, "expression": true,
+	"smile": true, "smiling": true, "wearing": true, "dressed": true,
+	"outfit": true, "uniform": true, "dress": true, "pose": true,
+}
+
+// estimateTokens roughly approximates how many CLIP tokens s uses: one per
+// punctuation mark, one per short word, and one more for every further six
+// letters of a long word, since BPE splits rare words into pieces.
+func estimateTokens(s string) int {
+	n := 0
+	word := 0
+	flush := func() {
+		if word > 0 {
+			n += 1 + (word-1)/6
+			word = 0
+		}
+	}
+	for _, r := range s {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			word++
+		case unicode.IsSpace(r):
+			flush()
+		default:
+			flush()
+			n++
+		}
+	}
+	flush()
+	return n
+}
+
+// splitPromptPhrases splits a prompt into comma- or sentence-separated
+// phrases, dropping empty ones. Separators inside (), [] or <> are part of
+// the phrase, so weighted phrases such as "(red hair:1.2)" and LoRA tags
+// such as "<lora:name:0.8>" stay whole.
+func splitPromptPhrases(prompt string) []string {
+	var phrases []string
+	add := func(f string) {
+		if f = strings.TrimSpace(f); f != "" {
+			phrases = append(phrases, f)
+		}
+	}
+	depth := 0
+	start := 0
+	for i, r := range prompt {
+		switch r {
+		case '(', '[', '<':
+			depth++
+		case ')', ']', '>':
+			depth = max(depth-1, 0)
+		case ',', '.', ';', '\n':
+			if depth == 0 {
+				add(prompt[start:i])
+				start = i + 1
+			}
+		}
+	}
+	add(prompt[start:])
+	return phrases
+}
+
+// isSubjectPhrase reports whether a phrase describes the character.
+func isSubjectPhrase(phrase string) bool {
+	for _, w := range strings.FieldsFunc(strings.ToLower(phrase), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		if subjectWords[w] {
+			return true
+		}
+	}
+	return false
+}
+
+// fitPromptTokens shortens prompt to roughly maxTokens CLIP tokens. Phrases
+// describing the character are moved to the front, followed by the scene
+// phrases in their original order, and everything from the first phrase that
+// no longer fits is dropped (the first phrase is always kept). It returns the
+// prompt unchanged, with kept equal to total, if it already fits or
+// maxTokens <= 0.
+func fitPromptTokens(prompt string, maxTokens int) (fitted string, kept, total int) {
+	phrases := splitPromptPhrases(prompt)
+	if maxTokens <= 0 || estimateTokens(prompt) <= maxTokens {
+		return prompt, len(phrases), len(phrases)
+	}
+
+	var subject, scene []string
+	for _, p := range phrases {
+		if isSubjectPhrase(p) {
+			subject = append(subject, p)
+		} else {
+			scene = append(scene, p)
+		}
+	}
+
+	var out []string
+	used := 0
+	for _, p := range append(subject, scene...) {
+		cost := estimateTokens(p)
+		if len(out) > 0 {
+			cost++ // separating comma
+		}
+		if used+cost > maxTokens && len(out) > 0 {
+			break
+		}
+		out = append(out, p)
+		used += cost
+	}
+	return strings.Join(out, ", "), len(out), len(phrases)
+}
+
+// normalizeNegativePrompt trims each comma-separated fragment of a negative
+// prompt and drops empty ones, so joined or hand-edited values never reach
+// SD with leading, trailing or doubled commas.
+func normalizeNegativePrompt(s string) string {
+	return joinPromptParts(strings.Split(s, ",")...)
+}
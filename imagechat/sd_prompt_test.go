@@ -0,0 +1,84 @@
+package imagechat
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestSplitPromptPhrases(t *testing.T) {
+	tests := []struct {
+		name   string
+		prompt string
+		want   []string
+	}{
+		{"commas", "1girl, library, books", []string{"1girl", "library", "books"}},
+		{"sentences", "A girl reads. Rain falls; night\nlamps", []string{"A girl reads", "Rain falls", "night", "lamps"}},
+		{"empty phrases", " , a,, b ,", []string{"a", "b"}},
+		{"weight", "1girl, (red hair:1.2), smile", []string{"1girl", "(red hair:1.2)", "smile"}},
+		{"weight with comma", "(red hair, blue eyes:1.1), desk", []string{"(red hair, blue eyes:1.1)", "desk"}},
+		{"nested weight", "((masterpiece:1.3), best quality:1.1), cat", []string{"((masterpiece:1.3), best quality:1.1)", "cat"}},
+		{"de-emphasis", "[blurry:0.5], sharp", []string{"[blurry:0.5]", "sharp"}},
+		{"lora", "1girl, <lora:anime_style:0.8>, night", []string{"1girl", "<lora:anime_style:0.8>", "night"}},
+		{"unbalanced close", "a), b", []string{"a)", "b"}},
+		{"empty", "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := splitPromptPhrases(tt.prompt); !slices.Equal(got, tt.want) {
+				t.Errorf("splitPromptPhrases(%q) = %q, want %q", tt.prompt, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFitPromptTokens(t *testing.T) {
+	tests := []struct {
+		name      string
+		prompt    string
+		maxTokens int
+		want      string
+		kept      int
+		total     int
+	}{
+		{"fits", "1girl, library", 75, "1girl, library", 2, 2},
+		{"disabled", "1girl, library", 0, "1girl, library", 2, 2},
+		{"subject first", "tall bookshelves, dusty library, (red hair:1.2), 1girl", 14,
+			"(red hair:1.2), 1girl, tall bookshelves", 3, 4},
+		{"lora kept whole", "<lora:anime_style:0.8>, warm evening light over the city", 12,
+			"<lora:anime_style:0.8>", 1, 2},
+		{"first phrase always kept", "an extraordinarily long unbreakable description", 2,
+			"an extraordinarily long unbreakable description", 1, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, kept, total := fitPromptTokens(tt.prompt, tt.maxTokens)
+			if got != tt.want || kept != tt.kept || total != tt.total {
+				t.Errorf("fitPromptTokens(%q, %d) = %q, %d, %d; want %q, %d, %d",
+					tt.prompt, tt.maxTokens, got, kept, total, tt.want, tt.kept, tt.total)
+			}
+		})
+	}
+}
+
+func TestNormalizeNegativePrompt(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"", ""},
+		{",", ""},
+		{" , , ", ""},
+		{"lowres", "lowres"},
+		{"lowres,", "lowres"},
+		{", lowres", "lowres"},
+		{"lowres,,blurry", "lowres, blurry"},
+		{"  lowres ,  blurry  ", "lowres, blurry"},
+		{"lowres, , blurry,", "lowres, blurry"},
+		{"(worst quality, low quality:1.4), text", "(worst quality, low quality:1.4), text"},
+	}
+	for _, tt := range tests {
+		if got := normalizeNegativePrompt(tt.in); got != tt.want {
+			t.Errorf("normalizeNegativePrompt(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,1025 @@
+package imagechat
+
+import (
+	"context"
+	"crypto/subtle"
+	"embed"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+//go:embed static/index.html
+var staticFS embed.FS
+
+var upgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+type Server struct {
+	port     string
+	imageDir string
+	cfg      *Config
+	clients  map[*wsClient]struct{}
+	mu       sync.RWMutex
+	done     <-chan struct{}
+
+	// recent holds the last few broadcast images, replayed to clients on
+	// connect. Guarded by mu; capped at cfg.CatchupCount.
+	recent []SessionImage
+	// persistMu serializes saving recent with cfg.PersistRecent, so an
+	// older list never overwrites a newer one.
+	persistMu sync.Mutex
+	// idle is whether generation is paused for inactivity, sent to clients
+	// on connect. Guarded by mu.
+	idle bool
+	// focusPin is the session focus mode is pinned to, sent to clients on
+	// connect. Guarded by mu.
+	focusPin string
+	// sessions holds what the server knows about each session from the
+	// images broadcast for it, served at /api/sessions. The last image is
+	// sent as the next image's PreviousFilename. Capped at maxSessions
+	// entries. Guarded by mu.
+	sessions map[string]*SessionInfo
+
+	favorites *FavoriteStore
+	backends  *ImageBackendSelector
+	approvals *PromptApprovals
+	status    *StatusTracker
+	roster    func() []CharacterInfo
+	pinFocus  func(sessionID string)
+	lock      func(sessionID, character string) (string, error)
+	regen     func(sessionID string) (SessionImage, error)
+
+	// debugInfo holds named providers for the /api/debug endpoint.
+	debugMu   sync.RWMutex
+	debugInfo map[string]func() any
+}
+
+// maxSessions caps the sessions the server remembers for /api/sessions; the
+// one updated longest ago is forgotten first.
+const maxSessions = 50
+
+// clientSendBuffer is how many messages may be queued for a client before it
+// is considered too slow and disconnected.
+const clientSendBuffer = 32
+
+// wsClient is a connected WebSocket client. gorilla/websocket allows only one
+// concurrent writer per connection, so all writes happen in the client's
+// writeLoop goroutine; broadcasters only enqueue onto send.
+type wsClient struct {
+	conn *websocket.Conn
+	send chan wsMessage
+	done chan struct{}
+}
+
+// wsMessage is a queued outgoing message. Catch-up images are queued as
+// SessionImage and encoded by the writer, so registration stays cheap.
+type wsMessage struct {
+	messageType int
+	data        []byte
+	catchup     *SessionImage
+}
+
+// enqueue queues msg without blocking. It reports false if the client's buffer
+// is full.
+func (c *wsClient) enqueue(msg wsMessage) bool {
+	select {
+	case c.send <- msg:
+		return true
+	default:
+		return false
+	}
+}
+
+// WebSocket close reasons sent to clients, so the web UI can tell a server
+// shutdown from a network problem when deciding how to reconnect.
+const (
+	// wsCloseShutdown (1001 Going Away) means the server is stopping; it may
+	// take a while to come back.
+	wsCloseShutdown = "server shutting down"
+	// wsCloseTooSlow (1013 Try Again Later) means the client fell behind;
+	// it can reconnect right away.
+	wsCloseTooSlow = "client too slow"
+)
+
+// wsCloseTimeout bounds writing the close frame to an unresponsive client.
+const wsCloseTimeout = time.Second
+
+// closeWith sends a close frame with code and reason, then closes the
+// connection. It is safe to call concurrently with writeLoop.
+func (c *wsClient) closeWith(code int, reason string) {
+	msg := websocket.FormatCloseMessage(code, reason)
+	if err := c.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(wsCloseTimeout)); err != nil {
+		Debugf("could not send websocket close frame: %v", err)
+	}
+	c.conn.Close()
+}
+
+// writeLoop writes queued messages to the connection until the client is
+// closed or a write fails or exceeds IMGCHAT_WS_WRITE_TIMEOUT.
+func (s *Server) writeLoop(c *wsClient) {
+	for {
+		select {
+		case <-c.done:
+			return
+		case msg := <-c.send:
+			if msg.catchup != nil {
+				var err error
+				msg.messageType, msg.data, err = s.encodeSessionImage(*msg.catchup)
+				if err != nil {
+					Debugf("skipping catch-up image %s: %v", msg.catchup.Filename, err)
+					continue
+				}
+			}
+			// A client that stops reading would otherwise block this write
+			// once the socket buffer fills, holding up shutdown.
+			c.conn.SetWriteDeadline(time.Now().Add(s.cfg.WSWriteTimeout))
+			if err := c.conn.WriteMessage(msg.messageType, msg.data); err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					Warnf("warning: websocket client not reading for %s, disconnecting", s.cfg.WSWriteTimeout)
+				} else {
+					Errorf("websocket write error: %v", err)
+				}
+				// Unblock the read loop so the client is removed.
+				c.conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// WSProtocolVersion is the version of the server→client WebSocket protocol,
+// sent in every envelope. Bump it on incompatible changes to message data.
+const WSProtocolVersion = 1
+
+// Server→client WebSocket message types.
+const (
+	WSTypeImage     = "image"     // SessionImage
+	WSTypeNotice    = "notice"    // Notice
+	WSTypePrompt    = "prompt"    // PromptApproval
+	WSTypeFavorite  = "favorite"  // FavoriteUpdate
+	WSTypeIdle      = "idle"      // IdleState
+	WSTypeCharacter = "character" // CharacterLock
+	WSTypeClear     = "clear"     // ImagesCleared
+	WSTypeFocus     = "focus"     // FocusPin
+	WSTypeCleanup   = "cleanup"   // ImagesCleanedUp
+)
+
+// WSEnvelope wraps every server→client WebSocket message. In inline image
+// mode it is the JSON header of the binary frame.
+type WSEnvelope struct {
+	V    int    `json:"v"`
+	Type string `json:"type"`
+	Data any    `json:"data"`
+}
+
+// encodeEnvelope returns the JSON envelope for a message of the given type.
+func encodeEnvelope(msgType string, data any) ([]byte, error) {
+	return json.Marshal(WSEnvelope{V: WSProtocolVersion, Type: msgType, Data: data})
+}
+
+// SessionInfo is the /api/sessions entry for a session that has had an image.
+type SessionInfo struct {
+	SessionID string `json:"sessionId"`
+	Title     string `json:"title"`
+	Project   string `json:"project,omitempty"`
+	// Character is the character the session's latest image was drawn with.
+	Character string `json:"character,omitempty"`
+	LastImage string `json:"lastImage"`
+	UpdatedAt string `json:"updatedAt"`
+}
+
+// FavoriteUpdate tells WebSocket clients that an image's favorite state changed.
+type FavoriteUpdate struct {
+	Filename string `json:"filename"`
+	Favorite bool   `json:"favorite"`
+}
+
+// CharacterLock tells WebSocket clients that a session's character was
+// locked, or unlocked when Character is empty.
+type CharacterLock struct {
+	SessionID string `json:"sessionId"`
+	Character string `json:"character"`
+}
+
+// FocusPin tells WebSocket clients which session focus mode is pinned to,
+// or that it follows activity again when SessionID is empty.
+type FocusPin struct {
+	SessionID string `json:"sessionId"`
+}
+
+// IdleState tells WebSocket clients whether generation is paused because the
+// sessions have been inactive.
+type IdleState struct {
+	Idle bool `json:"idle"`
+}
+
+// Notice is a short status message pushed to WebSocket clients.
+type Notice struct {
+	Message string `json:"message"`
+}
+
+func NewServer(port, imageDir string, cfg *Config, done <-chan struct{}) *Server {
+	s := &Server{
+		port:      port,
+		imageDir:  imageDir,
+		cfg:       cfg,
+		clients:   make(map[*wsClient]struct{}),
+		sessions:  make(map[string]*SessionInfo),
+		done:      done,
+		debugInfo: make(map[string]func() any),
+		favorites: NewFavoriteStore(imageDir),
+	}
+	if cfg.PersistRecent && cfg.CatchupCount > 0 {
+		s.recent = loadRecentImages(imageDir, cfg.CatchupCount)
+		for _, si := range s.recent {
+			info := s.sessionInfo(si.SessionID)
+			info.Title = si.Title
+			info.Project = si.Project
+			info.Character = si.Character
+			info.LastImage = si.Filename
+			info.UpdatedAt = si.UpdatedAt
+		}
+		if len(s.recent) > 0 {
+			Infof("restored %d recent image(s) for catch-up", len(s.recent))
+		}
+	}
+	return s
+}
+
+// persistRecent saves the catch-up images with cfg.PersistRecent, so they
+// survive a restart.
+func (s *Server) persistRecent() {
+	if !s.cfg.PersistRecent {
+		return
+	}
+	s.persistMu.Lock()
+	defer s.persistMu.Unlock()
+	s.mu.RLock()
+	recent := slices.Clone(s.recent)
+	s.mu.RUnlock()
+	if err := saveRecentImages(s.imageDir, recent); err != nil {
+		Warnf("warning: could not save recent images: %v", err)
+	}
+}
+
+// SetImageBackends gives the server access to the image backend selector so
+// clients can switch backends at runtime.
+func (s *Server) SetImageBackends(b *ImageBackendSelector) {
+	s.backends = b
+}
+
+// SetStatus enables the /api/status endpoint backed by t.
+func (s *Server) SetStatus(t *StatusTracker) {
+	s.status = t
+}
+
+// SetCharacterLocker lets clients lock a session's character over WebSocket.
+// lock returns the locked character's configured name.
+func (s *Server) SetCharacterLocker(lock func(sessionID, character string) (string, error)) {
+	s.lock = lock
+}
+
+// SetFocusPinner lets clients pin focus mode to a session over WebSocket.
+func (s *Server) SetFocusPinner(pin func(sessionID string)) {
+	s.pinFocus = pin
+}
+
+// SetRegenerator enables POST /api/regenerate-last, which calls regen to
+// render a session's last prompt again.
+func (s *Server) SetRegenerator(regen func(sessionID string) (SessionImage, error)) {
+	s.regen = regen
+}
+
+// SetCharacterRoster sets the provider of the /api/characters listing.
+func (s *Server) SetCharacterRoster(roster func() []CharacterInfo) {
+	s.roster = roster
+}
+
+// RegisterDebugInfo adds a named section to the /api/debug response.
+// The provider is called on every request and must be safe for concurrent use.
+func (s *Server) RegisterDebugInfo(name string, provider func() any) {
+	s.debugMu.Lock()
+	defer s.debugMu.Unlock()
+	s.debugInfo[name] = provider
+}
+
+// HasClients returns true if at least one WebSocket client is connected.
+func (s *Server) HasClients() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.clients) > 0
+}
+
+// ClientCount returns the number of connected WebSocket clients.
+func (s *Server) ClientCount() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.clients)
+}
+
+// BroadcastSessionImage sends a SessionImage to all connected WebSocket clients,
+// either as JSON or, in inline mode, as a binary frame carrying the image bytes.
+func (s *Server) BroadcastSessionImage(si SessionImage) {
+	s.mu.Lock()
+	info := s.sessionInfo(si.SessionID)
+	si.PreviousFilename = info.LastImage
+	info.Title = si.Title
+	info.Project = si.Project
+	info.Character = si.Character
+	info.LastImage = si.Filename
+	info.UpdatedAt = si.UpdatedAt
+	s.mu.Unlock()
+
+	messageType, data, err := s.encodeSessionImage(si)
+	if err != nil {
+		Errorf("session image encode error: %v", err)
+		return
+	}
+
+	if n := s.cfg.CatchupCount; n > 0 {
+		s.mu.Lock()
+		s.recent = append(s.recent, si)
+		if len(s.recent) > n {
+			s.recent = append(s.recent[:0:0], s.recent[len(s.recent)-n:]...)
+		}
+		s.mu.Unlock()
+		s.persistRecent()
+	}
+
+	s.broadcastMessage(messageType, data)
+}
+
+// sessionInfo returns the entry of sessionID in s.sessions, adding it, and
+// evicting the least recently updated entry if the map is full, when it is
+// missing. The caller holds mu.
+func (s *Server) sessionInfo(sessionID string) *SessionInfo {
+	if info, ok := s.sessions[sessionID]; ok {
+		return info
+	}
+	if len(s.sessions) >= maxSessions {
+		var oldest *SessionInfo
+		for _, info := range s.sessions {
+			// UpdatedAt is RFC 3339, which sorts chronologically.
+			if oldest == nil || info.UpdatedAt < oldest.UpdatedAt {
+				oldest = info
+			}
+		}
+		delete(s.sessions, oldest.SessionID)
+	}
+	info := &SessionInfo{SessionID: sessionID}
+	s.sessions[sessionID] = info
+	return info
+}
+
+// encodeSessionImage builds the WebSocket message for a SessionImage. By default
+// it is an "image" envelope as a text message. When inline images are enabled
+// it is a binary message: a 4-byte big-endian header length, the envelope as
+// the JSON header, then the raw image bytes.
+func (s *Server) encodeSessionImage(si SessionImage) (int, []byte, error) {
+	header, err := encodeEnvelope(WSTypeImage, si)
+	if err != nil {
+		return 0, nil, err
+	}
+	if !s.cfg.WSInlineImages {
+		return websocket.TextMessage, header, nil
+	}
+	img, err := os.ReadFile(filepath.Join(s.imageDir, si.Filename))
+	if err != nil {
+		return 0, nil, err
+	}
+	frame := make([]byte, 4, 4+len(header)+len(img))
+	binary.BigEndian.PutUint32(frame, uint32(len(header)))
+	frame = append(frame, header...)
+	frame = append(frame, img...)
+	return websocket.BinaryMessage, frame, nil
+}
+
+// SetPromptApprovals lets clients approve or reject prompts over WebSocket.
+func (s *Server) SetPromptApprovals(a *PromptApprovals) {
+	s.approvals = a
+}
+
+// BroadcastPromptApproval publishes a prompt awaiting approval, or its
+// resolution, to WebSocket clients.
+func (s *Server) BroadcastPromptApproval(pa PromptApproval) {
+	s.broadcast(WSTypePrompt, pa)
+}
+
+// BroadcastIdle tells WebSocket clients that generation paused for
+// inactivity (idle true) or resumed, and remembers it for new clients.
+func (s *Server) BroadcastIdle(idle bool) {
+	s.mu.Lock()
+	s.idle = idle
+	s.mu.Unlock()
+	s.broadcast(WSTypeIdle, IdleState{Idle: idle})
+}
+
+// BroadcastNotice sends a notice message to all connected WebSocket clients.
+func (s *Server) BroadcastNotice(message string) {
+	s.broadcast(WSTypeNotice, Notice{Message: message})
+}
+
+// broadcast sends a message of the given type, wrapped in an envelope, to all
+// connected WebSocket clients.
+func (s *Server) broadcast(msgType string, data any) {
+	msg, err := encodeEnvelope(msgType, data)
+	if err != nil {
+		Errorf("json marshal error: %v", err)
+		return
+	}
+	s.broadcastMessage(websocket.TextMessage, msg)
+}
+
+// broadcastMessage queues a pre-encoded message for all connected WebSocket
+// clients. The network writes happen in each client's writeLoop, so a slow
+// client never delays the others; one whose buffer is full is disconnected.
+func (s *Server) broadcastMessage(messageType int, data []byte) {
+	msg := wsMessage{messageType: messageType, data: data}
+	s.mu.RLock()
+	var slow []*wsClient
+	for c := range s.clients {
+		if !c.enqueue(msg) {
+			slow = append(slow, c)
+		}
+	}
+	s.mu.RUnlock()
+
+	for _, c := range slow {
+		Warnf("warning: websocket client too slow, disconnecting")
+		c.closeWith(websocket.CloseTryAgainLater, wsCloseTooSlow)
+	}
+}
+
+// Handler returns the HTTP handler serving the web UI, images, WebSocket and
+// API endpoints, for mounting on an existing server.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+
+	// Serve index.html
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		data, err := staticFS.ReadFile("static/index.html")
+		if err != nil {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(data)
+	})
+
+	// Serve generated images, and nothing else from the image directory
+	// (such as the favorites file)
+	images := http.StripPrefix("/images/", http.FileServer(http.Dir(s.imageDir)))
+	mux.HandleFunc("/images/", func(w http.ResponseWriter, r *http.Request) {
+		if !isImageFile(r.URL.Path) {
+			http.NotFound(w, r)
+			return
+		}
+		images.ServeHTTP(w, r)
+	})
+
+	// WebSocket endpoint
+	mux.HandleFunc("/ws", s.handleWS)
+
+	// Config API endpoints
+	mux.HandleFunc("/api/config", s.handleConfig)
+
+	// Backend health
+	mux.HandleFunc("/api/status", s.handleStatus)
+	mux.HandleFunc("/api/sessions", s.handleSessions)
+	mux.HandleFunc("/api/sessions/{id}/export", s.handleExportSession)
+	mux.HandleFunc("/api/characters", s.handleCharacters)
+	mux.HandleFunc("/api/regenerate-last", s.handleRegenerateLast)
+
+	// Favorite images are kept by cleanup
+	mux.HandleFunc("/api/favorites", s.handleFavorites)
+	mux.HandleFunc("/api/images/{filename}/favorite", s.handleFavorite)
+
+	// Administration, only exposed with an admin token
+	if s.cfg.AdminToken != "" {
+		mux.HandleFunc("/api/images/clear", s.handleClearImages)
+	}
+
+	// Diagnostics, only exposed in debug mode
+	if s.cfg.debugMode() {
+		mux.HandleFunc("/api/debug", s.handleDebug)
+	}
+	// The loaded configuration lives next to /api/config, which is the
+	// runtime settings the web UI edits. Open in debug mode, and to admin
+	// token holders otherwise.
+	if s.cfg.debugMode() || s.cfg.AdminToken != "" {
+		mux.HandleFunc("/api/config/effective", s.handleEffectiveConfig)
+	}
+
+	return mux
+}
+
+// Start begins serving HTTP and WebSocket connections. It blocks until
+// the done channel is closed, then gracefully shuts down the HTTP server.
+func (s *Server) Start() error {
+	httpServer := &http.Server{
+		Addr:    ":" + s.port,
+		Handler: s.Handler(),
+	}
+	if base := s.cfg.BasePath; base != "" {
+		// Everything is served under base/; the bare base redirects there so
+		// the page's relative URLs resolve under it.
+		mux := http.NewServeMux()
+		mux.Handle(base+"/", http.StripPrefix(base, httpServer.Handler))
+		mux.Handle(base, http.RedirectHandler(base+"/", http.StatusMovedPermanently))
+		httpServer.Handler = mux
+	}
+
+	// Shut down the HTTP server when done is closed.
+	go func() {
+		<-s.done
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := httpServer.Shutdown(ctx); err != nil {
+			Errorf("http server shutdown error: %v", err)
+		}
+	}()
+
+	Infof("server listening on :%s", s.port)
+	if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+func (s *Server) handleWS(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		Errorf("websocket upgrade error: %v", err)
+		return
+	}
+
+	client := &wsClient{
+		conn: conn,
+		send: make(chan wsMessage, clientSendBuffer+max(s.cfg.CatchupCount, 0)+1),
+		done: make(chan struct{}),
+	}
+
+	// Register the client and queue the catch-up images together, so no
+	// broadcast is missed or delivered ahead of older images.
+	s.mu.Lock()
+	s.clients[client] = struct{}{}
+	total := len(s.clients)
+	replayed := 0
+	for i := range s.recent {
+		si := s.recent[i]
+		if client.enqueue(wsMessage{catchup: &si}) {
+			replayed++
+		}
+	}
+	if s.idle {
+		data, _ := encodeEnvelope(WSTypeIdle, IdleState{Idle: true})
+		client.enqueue(wsMessage{messageType: websocket.TextMessage, data: data})
+	}
+	if s.focusPin != "" {
+		data, _ := encodeEnvelope(WSTypeFocus, FocusPin{SessionID: s.focusPin})
+		client.enqueue(wsMessage{messageType: websocket.TextMessage, data: data})
+	}
+	s.mu.Unlock()
+
+	go s.writeLoop(client)
+
+	Infof("WebSocket client connected (total: %d, replayed %d recent image(s))", total, replayed)
+
+	// Keep connection alive; remove on close.
+	defer func() {
+		s.mu.Lock()
+		delete(s.clients, client)
+		total := len(s.clients)
+		s.mu.Unlock()
+		close(client.done)
+		conn.Close()
+		Infof("WebSocket client disconnected (total: %d)", total)
+	}()
+
+	// Close the connection when done is signaled so ReadMessage unblocks,
+	// telling the client the server is going away.
+	go func() {
+		select {
+		case <-s.done:
+			client.closeWith(websocket.CloseGoingAway, wsCloseShutdown)
+		case <-client.done:
+		}
+	}()
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			break
+		}
+		var cmd clientCommand
+		if err := json.Unmarshal(data, &cmd); err != nil {
+			Debugf("ignoring malformed WebSocket message: %v", err)
+			continue
+		}
+		s.handleClientCommand(cmd)
+	}
+}
+
+// clientCommand is a control message sent by a WebSocket client.
+type clientCommand struct {
+	Action    string `json:"action"`
+	Backend   string `json:"backend,omitempty"`
+	SessionID string `json:"sessionId,omitempty"`
+	ID        string `json:"id,omitempty"`
+	Prompt    string `json:"prompt,omitempty"`
+	Character string `json:"character,omitempty"`
+}
+
+func (s *Server) handleClientCommand(cmd clientCommand) {
+	switch cmd.Action {
+	case "setBackend":
+		if s.backends == nil {
+			return
+		}
+		if err := s.backends.Set(cmd.SessionID, cmd.Backend); err != nil {
+			s.BroadcastNotice(err.Error())
+			return
+		}
+		scope := "all sessions"
+		if cmd.SessionID != "" {
+			scope = "session " + cmd.SessionID
+		}
+		if cmd.Backend == "" {
+			Infof("image generator override cleared for %s", scope)
+			s.BroadcastNotice("Image generator reset to default for " + scope)
+			return
+		}
+		Infof("image generator set to %s for %s", cmd.Backend, scope)
+		s.BroadcastNotice("Image generator set to " + cmd.Backend + " for " + scope)
+	case "approvePrompt", "rejectPrompt":
+		if s.approvals == nil {
+			return
+		}
+		if err := s.approvals.Decide(cmd.ID, cmd.Action == "approvePrompt", strings.TrimSpace(cmd.Prompt)); err != nil {
+			Debugf("prompt decision ignored: %v", err)
+		}
+	case "lockCharacter":
+		if s.lock == nil {
+			return
+		}
+		name, err := s.lock(cmd.SessionID, strings.TrimSpace(cmd.Character))
+		if err != nil {
+			s.BroadcastNotice(err.Error())
+			return
+		}
+		s.broadcast(WSTypeCharacter, CharacterLock{SessionID: cmd.SessionID, Character: name})
+		if name == "" {
+			Infof("character lock cleared for session %s", cmd.SessionID)
+			s.BroadcastNotice("Character unlocked for session " + cmd.SessionID)
+			return
+		}
+		Infof("character '%s' locked for session %s", name, cmd.SessionID)
+		s.BroadcastNotice("Character " + name + " locked for session " + cmd.SessionID)
+	case "pinFocus":
+		if s.pinFocus == nil {
+			s.BroadcastNotice("Focus mode is not enabled (IMGCHAT_FOCUS_MODE)")
+			return
+		}
+		s.pinFocus(cmd.SessionID)
+		s.mu.Lock()
+		s.focusPin = cmd.SessionID
+		s.mu.Unlock()
+		s.broadcast(WSTypeFocus, FocusPin{SessionID: cmd.SessionID})
+		if cmd.SessionID == "" {
+			Infof("focus unpinned, following the most recently active session")
+			s.BroadcastNotice("Focus follows the most recently active session")
+			return
+		}
+		Infof("focus pinned to session %s", cmd.SessionID)
+		s.BroadcastNotice("Focus pinned to session " + cmd.SessionID)
+	default:
+		Debugf("ignoring unknown WebSocket action %q", cmd.Action)
+	}
+}
+
+func (s *Server) handleConfig(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		rc := s.cfg.GetRuntimeConfig()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rc)
+
+	case http.MethodPut:
+		var rc RuntimeConfig
+		if err := json.NewDecoder(r.Body).Decode(&rc); err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid JSON"})
+			return
+		}
+		if s.backends != nil {
+			if err := s.backends.Validate(rc.ImageGeneratorType); err != nil {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+				return
+			}
+		}
+		if err := s.cfg.SetRuntimeConfig(rc); err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+		Infof("runtime config updated: %+v", rc)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.cfg.GetRuntimeConfig())
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) handleDebug(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.debugMu.RLock()
+	out := make(map[string]any, len(s.debugInfo))
+	for name, provider := range s.debugInfo {
+		out[name] = provider()
+	}
+	s.debugMu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// handleStatus reports the latest success and error of each backend.
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	backends := []BackendStatus{}
+	if s.status != nil {
+		backends = s.status.Snapshot()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"backends": backends})
+}
+
+// handleSessions lists the sessions that have had an image, most recently
+// updated first.
+func (s *Server) handleSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.mu.RLock()
+	sessions := make([]SessionInfo, 0, len(s.sessions))
+	for _, info := range s.sessions {
+		sessions = append(sessions, *info)
+	}
+	s.mu.RUnlock()
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].UpdatedAt > sessions[j].UpdatedAt })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"sessions": sessions})
+}
+
+// handleExportSession streams a zip of every image of the session given in
+// the path that is still in the image directory.
+func (s *Server) handleExportSession(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	sessionID := r.PathValue("id")
+	names, err := sessionImages(s.imageDir, sessionID)
+	if err != nil {
+		Errorf("session export error: %v", err)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "could not read the image directory"})
+		return
+	}
+	if len(names) == 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "no images for this session"})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"session-%s.zip\"", filenameSafe(sessionID)))
+	if err := writeImagesZip(w, s.imageDir, names); err != nil {
+		// The response has started, so the client just gets a truncated zip.
+		Errorf("session export error: %v", err)
+		return
+	}
+	Infof("exported %d image(s) of session %s", len(names), sessionID)
+}
+
+// handleRegenerateLast renders the last prompt of the session given by the
+// sessionId query parameter again, returning the new image.
+func (s *Server) handleRegenerateLast(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	sessionID := r.URL.Query().Get("sessionId")
+	if sessionID == "" || s.regen == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "sessionId is required"})
+		return
+	}
+	si, err := s.regen(sessionID)
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, errNoLastPrompt):
+			status = http.StatusNotFound
+		case errors.Is(err, errGenerationBusy), errors.Is(err, errBackendCoolingDown):
+			status = http.StatusConflict
+		default:
+			Errorf("regenerate error: %v", err)
+		}
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	json.NewEncoder(w).Encode(si)
+}
+
+// ImagesCleared tells clients that every image was deleted, so they reset.
+type ImagesCleared struct {
+	Deleted int `json:"deleted"`
+}
+
+// ImagesCleanedUp tells clients which old images cleanup removed.
+type ImagesCleanedUp struct {
+	Deleted []string `json:"deleted"`
+}
+
+// ImagesRemoved drops images removed by cleanup from the catch-up list and
+// the sessions' last images and, with cfg.CleanupEvents, tells clients.
+func (s *Server) ImagesRemoved(removed []string) {
+	s.mu.Lock()
+	n := len(s.recent)
+	s.recent = slices.DeleteFunc(s.recent, func(si SessionImage) bool {
+		return slices.Contains(removed, si.Filename)
+	})
+	changed := len(s.recent) != n
+	for _, info := range s.sessions {
+		if slices.Contains(removed, info.LastImage) {
+			info.LastImage = ""
+		}
+	}
+	s.mu.Unlock()
+	if changed {
+		s.persistRecent()
+	}
+	if s.cfg.CleanupEvents {
+		s.broadcast(WSTypeCleanup, ImagesCleanedUp{Deleted: removed})
+	}
+}
+
+// authorized reports whether r carries the admin token as a bearer token.
+func (s *Server) authorized(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(s.cfg.AdminToken)) == 1
+}
+
+// handleClearImages deletes every image in the image directory, forgets the
+// images remembered for catch-up and favorites, and tells clients to reset.
+func (s *Server) handleClearImages(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !s.authorized(r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid or missing admin token"})
+		return
+	}
+	deleted, err := clearImages(s.imageDir)
+	if err != nil {
+		Errorf("clear images error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	if err := s.favorites.Clear(); err != nil {
+		Warnf("warning: could not clear favorites: %v", err)
+	}
+
+	s.mu.Lock()
+	s.recent = nil
+	for _, info := range s.sessions {
+		info.LastImage = ""
+	}
+	s.mu.Unlock()
+	s.persistRecent()
+
+	Infof("cleared %d image(s) from %s", deleted, s.imageDir)
+	cleared := ImagesCleared{Deleted: deleted}
+	s.broadcast(WSTypeClear, cleared)
+	json.NewEncoder(w).Encode(cleared)
+}
+
+// handleCharacters lists the loaded characters and the active sessions
+// assigned to each.
+func (s *Server) handleCharacters(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	characters := []CharacterInfo{}
+	if s.roster != nil {
+		characters = s.roster()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"characters": characters})
+}
+
+func (s *Server) handleFavorites(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.favorites.List())
+}
+
+// handleFavorite marks (POST) or unmarks (DELETE) an image as a favorite.
+func (s *Server) handleFavorite(w http.ResponseWriter, r *http.Request) {
+	var favorite bool
+	switch r.Method {
+	case http.MethodPost:
+		favorite = true
+	case http.MethodDelete:
+		favorite = false
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := r.PathValue("filename")
+	if name == "" || filepath.Base(name) != name || !isImageFile(name) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid image filename"})
+		return
+	}
+	if _, err := os.Stat(filepath.Join(s.imageDir, name)); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "image not found"})
+		return
+	}
+
+	if err := s.favorites.Set(name, favorite); err != nil {
+		Errorf("favorite update error: %v", err)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "could not save favorites"})
+		return
+	}
+
+	update := FavoriteUpdate{Filename: name, Favorite: favorite}
+	s.broadcast(WSTypeFavorite, update)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(update)
+}
+
+// handleEffectiveConfig returns the full configuration the process loaded,
+// with secrets redacted.
+func (s *Server) handleEffectiveConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !s.cfg.debugMode() && !s.authorized(r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid or missing admin token"})
+		return
+	}
+	json.NewEncoder(w).Encode(s.cfg.Redacted())
+}
@@ -0,0 +1,74 @@
+package imagechat
+
+import (
+	"archive/zip"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// sessionImages returns the names of the images in dir that saveImage
+// recorded for sessionID, oldest first.
+func sessionImages(dir, sessionID string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	want := filenameSafe(sessionID)
+	var names []string
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !isImageFile(name) || !strings.HasPrefix(name, "img_") {
+			continue
+		}
+		if want != "" && imageSession(name) == want {
+			names = append(names, name)
+		}
+	}
+	// The names start with the save time in milliseconds, all of the same
+	// width, so they sort chronologically.
+	sort.Strings(names)
+	return names, nil
+}
+
+// writeImagesZip writes the named images of dir to w as a zip archive, one
+// file at a time so the archive is never held in memory. The images are
+// stored uncompressed since PNGs already are.
+func writeImagesZip(w io.Writer, dir string, names []string) error {
+	zw := zip.NewWriter(w)
+	for _, name := range names {
+		if err := addFileToZip(zw, filepath.Join(dir, name)); err != nil {
+			if os.IsNotExist(err) {
+				// Removed by cleanup since it was listed.
+				continue
+			}
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+func addFileToZip(zw *zip.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Method = zip.Store
+	fw, err := zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(fw, f)
+	return err
+}
@@ -0,0 +1,43 @@
+package imagechat
+
+import "sync/atomic"
+
+// QueueStats tracks how well image generation keeps up with incoming prompts.
+type QueueStats struct {
+	// processed counts prompts taken off the queue by the image stage.
+	processed atomic.Int64
+	// dropped counts prompts that did not produce an image because the
+	// backend was busy, unavailable, or cooling down.
+	dropped atomic.Int64
+	// maxDepth is the largest queue depth observed.
+	maxDepth atomic.Int64
+}
+
+// QueueStatsSnapshot is a point-in-time view of QueueStats.
+type QueueStatsSnapshot struct {
+	Depth     int   `json:"depth"`
+	MaxDepth  int64 `json:"max_depth"`
+	Processed int64 `json:"processed"`
+	Dropped   int64 `json:"dropped"`
+}
+
+// observeDepth records the current queue depth.
+func (qs *QueueStats) observeDepth(depth int) {
+	d := int64(depth)
+	for {
+		cur := qs.maxDepth.Load()
+		if d <= cur || qs.maxDepth.CompareAndSwap(cur, d) {
+			return
+		}
+	}
+}
+
+// Snapshot returns the current counters along with the given live queue depth.
+func (qs *QueueStats) Snapshot(depth int) QueueStatsSnapshot {
+	return QueueStatsSnapshot{
+		Depth:     depth,
+		MaxDepth:  qs.maxDepth.Load(),
+		Processed: qs.processed.Load(),
+		Dropped:   qs.dropped.Load(),
+	}
+}
@@ -0,0 +1,112 @@
+package imagechat
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxStatusErrorLen caps the length of an error message kept for /api/status.
+const maxStatusErrorLen = 300
+
+// BackendStatus is the recent health of one prompt or image backend.
+type BackendStatus struct {
+	// Name is "prompt:<type>" or "image:<type>", e.g. "image:sd".
+	Name          string `json:"name"`
+	LastSuccessAt string `json:"lastSuccessAt,omitempty"`
+	LastError     string `json:"lastError,omitempty"`
+	LastErrorAt   string `json:"lastErrorAt,omitempty"`
+	// OK is true when the latest outcome was a success.
+	OK bool `json:"ok"`
+	// Successes and Errors count the calls since startup.
+	Successes int64 `json:"successes"`
+	Errors    int64 `json:"errors"`
+}
+
+// StatusTracker records the latest success and error of each backend. It is
+// updated by the pipeline and read by the /api/status endpoint; error
+// messages are stored with secrets redacted.
+type StatusTracker struct {
+	cfg      *Config
+	clock    Clock
+	mu       sync.Mutex
+	backends map[string]*BackendStatus
+}
+
+func NewStatusTracker(cfg *Config) *StatusTracker {
+	return &StatusTracker{
+		cfg:      cfg,
+		clock:    cfg.clock(),
+		backends: make(map[string]*BackendStatus),
+	}
+}
+
+// entry returns the status for name, creating it. Caller must hold t.mu.
+func (t *StatusTracker) entry(name string) *BackendStatus {
+	st, ok := t.backends[name]
+	if !ok {
+		st = &BackendStatus{Name: name}
+		t.backends[name] = st
+	}
+	return st
+}
+
+// recordSuccess notes a successful call to a backend. A nil tracker is a no-op.
+func (t *StatusTracker) recordSuccess(name string) {
+	if t == nil {
+		return
+	}
+	now := t.clock.Now().Format(time.RFC3339)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	st := t.entry(name)
+	st.LastSuccessAt = now
+	st.OK = true
+	st.Successes++
+}
+
+// recordError notes a failed call to a backend. A nil tracker is a no-op.
+func (t *StatusTracker) recordError(name string, err error) {
+	if t == nil || err == nil {
+		return
+	}
+	msg := truncateRunes(t.cfg.redactSecrets(err.Error()), maxStatusErrorLen)
+	now := t.clock.Now().Format(time.RFC3339)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	st := t.entry(name)
+	st.LastError = msg
+	st.LastErrorAt = now
+	st.OK = false
+	st.Errors++
+}
+
+// Snapshot returns the status of every backend seen so far, sorted by name.
+func (t *StatusTracker) Snapshot() []BackendStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := make([]BackendStatus, 0, len(t.backends))
+	for _, st := range t.backends {
+		out = append(out, *st)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// Totals returns the number of prompts and images generated and of backend
+// errors since startup.
+func (t *StatusTracker) Totals() (prompts, images, errors int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for name, st := range t.backends {
+		switch {
+		case strings.HasPrefix(name, "prompt:"):
+			prompts += st.Successes
+		case strings.HasPrefix(name, "image:"):
+			images += st.Successes
+		}
+		errors += st.Errors
+	}
+	return prompts, images, errors
+}
@@ -0,0 +1,85 @@
+package imagechat
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// StylePreset is a named art style. Tags are appended to the Stable Diffusion
+// prompt; Guidance is added to the prompt generator's system prompt.
+type StylePreset struct {
+	Tags     string `json:"tags"`
+	Guidance string `json:"guidance"`
+}
+
+// stylePresets are the built-in styles selectable via IMGCHAT_STYLE.
+var stylePresets = map[string]StylePreset{
+	"watercolor": {
+		Tags:     "watercolor (medium), traditional media, soft colors, paper texture",
+		Guidance: "Depict the scene as a soft watercolor painting with gentle color bleeds and a light, airy palette.",
+	},
+	"cyberpunk": {
+		Tags:     "cyberpunk, neon lights, night city, holograms, high contrast",
+		Guidance: "Set the scene in a neon-lit cyberpunk world with glowing signs, rain-slick streets and futuristic tech.",
+	},
+	"soft-shading": {
+		Tags:     "soft shading, pastel colors, gentle lighting, bloom",
+		Guidance: "Use soft, diffuse lighting and pastel colors with smooth, gentle shading.",
+	},
+	"cel-shading": {
+		Tags:     "cel shading, flat color, clean lineart, anime screencap",
+		Guidance: "Render the scene like a frame from a TV anime with flat cel shading and crisp outlines.",
+	},
+	"chibi": {
+		Tags:     "chibi, super deformed, cute, simple background",
+		Guidance: "Draw the character as a cute chibi with an oversized head and exaggerated expressions.",
+	},
+}
+
+// loadStylePresets returns the built-in presets merged with user presets from
+// dir. Each user preset is a <name>.json file with "tags" and "guidance"
+// fields and replaces a built-in preset of the same name.
+func loadStylePresets(dir string) (map[string]StylePreset, error) {
+	presets := make(map[string]StylePreset, len(stylePresets))
+	for name, p := range stylePresets {
+		presets[name] = p
+	}
+	if dir == "" {
+		return presets, nil
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return presets, err
+	}
+	for _, e := range entries {
+		if e.IsDir() || !strings.EqualFold(filepath.Ext(e.Name()), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return presets, err
+		}
+		var p StylePreset
+		if err := json.Unmarshal(data, &p); err != nil {
+			return presets, fmt.Errorf("%s: %w", e.Name(), err)
+		}
+		name := strings.ToLower(strings.TrimSuffix(e.Name(), filepath.Ext(e.Name())))
+		presets[name] = p
+	}
+	return presets, nil
+}
+
+// styleNames returns the sorted names of the given presets.
+func styleNames(presets map[string]StylePreset) []string {
+	names := make([]string, 0, len(presets))
+	for name := range presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,127 @@
+package imagechat
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+const summarySystemPrompt = `You maintain a running summary of a conversation between a user and an AI coding assistant.
+Given the current summary and some new messages, write an updated summary that keeps the
+overall goal, what has been done so far, and the current mood of the session.
+
+Rules:
+- Respond with the summary text only. No JSON, no markdown, no commentary.
+- Write in English.
+- Keep the summary under 150 words.`
+
+// maxSummaryBatch caps how many new messages are folded into a summary in one call.
+const maxSummaryBatch = 50
+
+// maxSummarySessions caps the number of per-session summaries kept in memory.
+const maxSummarySessions = 50
+
+// sessionSummary is the rolling summary state for a single session.
+type sessionSummary struct {
+	text string
+	// covered is the number of messages (from the start of the session)
+	// already folded into text.
+	covered int
+}
+
+// Summarizer maintains a rolling per-session summary of the conversation that
+// has scrolled out of the recent-message window, so long sessions keep their
+// earlier context without sending the full history to the prompt generator.
+type Summarizer struct {
+	llm      textCompleter
+	mu       sync.Mutex
+	sessions map[string]*sessionSummary
+	// maxMessageChars caps each message sent for summarization (0 = no limit).
+	maxMessageChars int
+}
+
+// NewSummarizer returns a Summarizer that uses the given prompt generator's
+// backend for its summarization calls. It returns an error if the backend
+// does not support free-form completion.
+func NewSummarizer(pg PromptGenerator) (*Summarizer, error) {
+	llm, ok := pg.(textCompleter)
+	if !ok {
+		return nil, fmt.Errorf("prompt generator %T does not support summarization", pg)
+	}
+	return &Summarizer{
+		llm:      llm,
+		sessions: make(map[string]*sessionSummary),
+	}, nil
+}
+
+// SetMaxMessageChars cuts each message sent for summarization down to n
+// runes, keeping its head and tail. 0 means no limit.
+func (s *Summarizer) SetMaxMessageChars(n int) {
+	s.maxMessageChars = n
+}
+
+// Update folds any messages that precede the last recentCount messages and
+// have not been summarized yet into the session's summary, and returns the
+// current summary. On error the previous summary is returned along with the error.
+func (s *Summarizer) Update(ctx context.Context, sessionID string, messages []Message, recentCount int) (string, error) {
+	olderCount := len(messages) - recentCount
+	if olderCount < 0 {
+		olderCount = 0
+	}
+
+	s.mu.Lock()
+	st, ok := s.sessions[sessionID]
+	if !ok {
+		if len(s.sessions) >= maxSummarySessions {
+			for k := range s.sessions {
+				delete(s.sessions, k)
+				break
+			}
+		}
+		st = &sessionSummary{}
+		s.sessions[sessionID] = st
+	}
+	// The session file was truncated or replaced; start over.
+	if st.covered > olderCount {
+		st.text = ""
+		st.covered = 0
+	}
+	prev := st.text
+	covered := st.covered
+	s.mu.Unlock()
+
+	if covered == olderCount {
+		return prev, nil
+	}
+
+	pending := messages[covered:olderCount]
+	if len(pending) > maxSummaryBatch {
+		pending = pending[len(pending)-maxSummaryBatch:]
+	}
+
+	msgJSON, err := json.Marshal(truncateMessages(pending, s.maxMessageChars))
+	if err != nil {
+		return prev, fmt.Errorf("failed to marshal messages: %w", err)
+	}
+	current := prev
+	if current == "" {
+		current = "(none yet)"
+	}
+	userPrompt := fmt.Sprintf("Current summary:\n%s\n\nNew messages:\n%s\n\nWrite the updated summary.", current, string(msgJSON))
+
+	text, err := s.llm.complete(ctx, summarySystemPrompt, userPrompt)
+	if err != nil {
+		return prev, fmt.Errorf("summary update failed: %w", err)
+	}
+	text = strings.TrimSpace(text)
+
+	s.mu.Lock()
+	st.text = text
+	st.covered = olderCount
+	s.mu.Unlock()
+
+	Debugf("updated summary for session %s (%d messages covered): %q", sessionID, olderCount, text)
+	return text, nil
+}
@@ -0,0 +1,77 @@
+package imagechat
+
+import (
+	"fmt"
+	"unicode"
+)
+
+// truncateRunes shortens s to at most n runes, appending "..." only when
+// something was cut. It never splits a combining sequence: if the cut would
+// separate a character from its combining marks, variation selectors, skin
+// tone modifiers or a zero-width-joined emoji part, the whole sequence is
+// dropped instead.
+func truncateRunes(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	cut := n
+	if cut < 0 {
+		cut = 0
+	}
+	for cut > 0 && (isClusterExtender(r[cut]) || r[cut-1] == zeroWidthJoiner) {
+		cut--
+	}
+	return string(r[:cut]) + "..."
+}
+
+// truncateMiddle shortens s to about n runes by keeping its head and tail and
+// replacing the middle with a note of how much was left out. Like
+// truncateRunes, it never splits a combining sequence.
+func truncateMiddle(s string, n int) string {
+	r := []rune(s)
+	if n <= 0 || len(r) <= n {
+		return s
+	}
+	head := (n + 1) / 2
+	for head > 0 && (isClusterExtender(r[head]) || r[head-1] == zeroWidthJoiner) {
+		head--
+	}
+	tail := len(r) - n/2
+	for tail < len(r) && (isClusterExtender(r[tail]) || r[tail-1] == zeroWidthJoiner) {
+		tail++
+	}
+	return fmt.Sprintf("%s\n[... %d characters omitted ...]\n%s", string(r[:head]), tail-head, string(r[tail:]))
+}
+
+// truncateMessages returns msgs with each content cut down to n runes by
+// truncateMiddle. msgs itself is not modified; n <= 0 returns it unchanged.
+func truncateMessages(msgs []Message, n int) []Message {
+	if n <= 0 {
+		return msgs
+	}
+	out := make([]Message, len(msgs))
+	for i, m := range msgs {
+		m.Content = truncateMiddle(m.Content, n)
+		out[i] = m
+	}
+	return out
+}
+
+const zeroWidthJoiner = '\u200d'
+
+// isClusterExtender reports whether r attaches to the preceding character
+// rather than standing on its own.
+func isClusterExtender(r rune) bool {
+	switch {
+	case unicode.Is(unicode.Mn, r), unicode.Is(unicode.Me, r):
+		return true
+	case r == zeroWidthJoiner:
+		return true
+	case r >= 0xfe00 && r <= 0xfe0f: // variation selectors
+		return true
+	case r >= 0x1f3fb && r <= 0x1f3ff: // emoji skin tone modifiers
+		return true
+	}
+	return false
+}
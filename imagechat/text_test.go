@@ -0,0 +1,78 @@
+package imagechat
+
+import "testing"
+
+func TestTruncateRunes(t *testing.T) {
+	tests := []struct {
+		name string
+		s    string
+		n    int
+		want string
+	}{
+		{"ascii short", "hello", 10, "hello"},
+		{"ascii exact", "hello", 5, "hello"},
+		{"ascii cut", "hello world", 5, "hello..."},
+		{"japanese exact", "こんにちは", 5, "こんにちは"},
+		{"japanese cut", "こんにちは世界", 5, "こんにちは..."},
+		{"emoji cut", "🍣🍜🍙🍡", 2, "🍣🍜..."},
+		{"combining mark kept whole", "cafe\u0301 au lait", 4, "caf..."},
+		{"dakuten kept whole", "か\u3099き", 1, "..."},
+		{"skin tone kept whole", "👍🏽👍🏽", 1, "..."},
+		{"variation selector kept whole", "❤\ufe0f!", 1, "..."},
+		{"zwj sequence kept whole", "👩\u200d💻 coding", 2, "..."},
+		{"zero", "abc", 0, "..."},
+		{"negative", "abc", -1, "..."},
+		{"empty", "", 3, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := truncateRunes(tt.s, tt.n); got != tt.want {
+				t.Errorf("truncateRunes(%q, %d) = %q, want %q", tt.s, tt.n, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtractTitle(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"exactly max", "バグを直して", "バグを直して"},
+		{"over max", "バグを直してください", "バグを直して..."},
+		{"emoji", "🐛🐛🐛🐛🐛🐛🐛", "🐛🐛🐛🐛🐛🐛..."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msgs := []Message{{Role: "user", Content: tt.content}}
+			if got := ExtractTitle(msgs, 6); got != tt.want {
+				t.Errorf("ExtractTitle = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTruncateMiddle(t *testing.T) {
+	tests := []struct {
+		name string
+		s    string
+		n    int
+		want string
+	}{
+		{"short", "abcdef", 10, "abcdef"},
+		{"exact", "abcdef", 6, "abcdef"},
+		{"disabled", "abcdef", 0, "abcdef"},
+		{"cut", "abcdefghij", 4, "ab\n[... 6 characters omitted ...]\nij"},
+		{"odd", "abcdefghij", 5, "abc\n[... 5 characters omitted ...]\nij"},
+		{"japanese", "あいうえおかきくけこ", 4, "あい\n[... 6 characters omitted ...]\nけこ"},
+		{"combining mark kept whole", "ae\u0301cdefgh", 4, "a\n[... 6 characters omitted ...]\ngh"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := truncateMiddle(tt.s, tt.n); got != tt.want {
+				t.Errorf("truncateMiddle(%q, %d) = %q, want %q", tt.s, tt.n, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package imagechat
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// turnState is how far the assistant's latest turn in a session file has
+// got, as far as the log tells.
+type turnState int
+
+const (
+	// turnUnknown: the last assistant entry carries no stop_reason, as
+	// streamed chunks don't, so only a quiet period tells the turn is over.
+	turnUnknown turnState = iota
+	// turnInProgress: the assistant stopped to run a tool, or a tool result
+	// was logged since, so more of the reply is coming.
+	turnInProgress
+	// turnComplete: the assistant finished its reply.
+	turnComplete
+)
+
+// turnStatus reports the state of the assistant's latest turn in data, from
+// the stop_reason of the last assistant entry and whatever was logged after
+// it.
+func turnStatus(data []byte) turnState {
+	lines := bytes.Split(data, []byte("\n"))
+	for i := len(lines) - 1; i >= 0; i-- {
+		line := bytes.TrimSpace(lines[i])
+		if len(line) == 0 {
+			continue
+		}
+		var entry rawEntry
+		if err := json.Unmarshal(line, &entry); err != nil || entry.Message == nil {
+			continue
+		}
+		var msg rawMessage
+		if err := json.Unmarshal(entry.Message, &msg); err != nil {
+			continue
+		}
+		switch entry.Type {
+		case "user":
+			var typed string
+			if json.Unmarshal(msg.Content, &typed) == nil {
+				// The user spoke last; there is no assistant turn to wait for.
+				return turnUnknown
+			}
+			// A tool result: the assistant continues once it has read it.
+			return turnInProgress
+		case "assistant":
+			switch msg.StopReason {
+			case "end_turn", "stop_sequence", "max_tokens", "refusal":
+				return turnComplete
+			case "tool_use", "pause_turn":
+				return turnInProgress
+			}
+			return turnUnknown
+		}
+	}
+	return turnUnknown
+}
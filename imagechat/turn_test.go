@@ -0,0 +1,37 @@
+package imagechat
+
+import "testing"
+
+func TestTurnStatus(t *testing.T) {
+	const (
+		user       = `{"type":"user","message":{"role":"user","content":"hi"}}`
+		toolResult = `{"type":"user","message":{"role":"user","content":[{"type":"tool_result","content":"ok"}]}}`
+		system     = `{"type":"system","content":"hook ran"}`
+	)
+	assistant := func(stopReason string) string {
+		return `{"type":"assistant","message":{"role":"assistant","content":[{"type":"text","text":"x"}],"stop_reason":` + stopReason + `}}`
+	}
+
+	tests := []struct {
+		name string
+		log  string
+		want turnState
+	}{
+		{"empty", "", turnUnknown},
+		{"end_turn", user + "\n" + assistant(`"end_turn"`) + "\n", turnComplete},
+		{"max_tokens", assistant(`"max_tokens"`), turnComplete},
+		{"tool_use", assistant(`"tool_use"`) + "\n", turnInProgress},
+		{"tool result after the turn", assistant(`"tool_use"`) + "\n" + toolResult + "\n", turnInProgress},
+		{"streamed chunk", assistant("null") + "\n", turnUnknown},
+		{"user spoke last", assistant(`"end_turn"`) + "\n" + user + "\n", turnUnknown},
+		{"entries without a message are skipped", assistant(`"end_turn"`) + "\n" + system + "\n\n", turnComplete},
+		{"malformed last line", assistant(`"end_turn"`) + "\n" + `{"type":"assistant",` + "\n", turnComplete},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := turnStatus([]byte(tt.log)); got != tt.want {
+				t.Errorf("turnStatus = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,484 @@
+package imagechat
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// FileEvent represents a change detected in a JSONL file.
+type FileEvent struct {
+	Path    string
+	NewData []byte
+	// Reset is set when the file was truncated or replaced: NewData is read
+	// from its start, and anything received for Path before is stale.
+	Reset bool
+}
+
+// Watcher monitors JSONL files under the Claude projects directory.
+type Watcher struct {
+	dir       string
+	debounce  time.Duration
+	statePath string
+	tailOnly  bool
+	fileCh    chan FileEvent
+	offsets   map[string]int64
+	clock     Clock
+	mu        sync.Mutex
+	// timers holds the pending debounce timer of each file; an entry is
+	// removed when its timer fires.
+	timers map[string]Timer
+
+	// stateMu serializes writes of the offset state file; saveTimer is the
+	// pending coalesced write, if any. Guarded by stateMu.
+	stateMu   sync.Mutex
+	saveTimer Timer
+
+	// queued holds data read but not yet delivered on fileCh, per file in
+	// queue order, so a stalled consumer never blocks a read: data read
+	// while a file is still queued is appended to its entry. deliver sends
+	// the entries; resets marks the entries read after a truncation.
+	// Guarded by queueMu.
+	queueMu sync.Mutex
+	queue   []string
+	queued  map[string][]byte
+	resets  map[string]bool
+	wake    chan struct{}
+}
+
+// defaultWatcherEventBuffer is the default capacity of Watcher.Events.
+const defaultWatcherEventBuffer = 16
+
+type WatcherConfig struct {
+	Dir      string
+	Debounce time.Duration
+	// OffsetStatePath, when set, persists read offsets to this file so a
+	// restart resumes where the previous run stopped.
+	OffsetStatePath string
+	// Clock schedules debounce timers; nil means the wall clock.
+	Clock Clock
+	// TailOnly starts session files that already exist when Run starts at
+	// their current end, so only content written afterwards is delivered.
+	// Offsets restored from OffsetStatePath take precedence.
+	TailOnly bool
+	// EventBuffer is the capacity of the Events channel; 0 means
+	// defaultWatcherEventBuffer. When it is full, further data is merged
+	// per file until the consumer catches up.
+	EventBuffer int
+}
+
+func NewWatcher(wCfg WatcherConfig) *Watcher {
+	w := &Watcher{
+		dir:       wCfg.Dir,
+		debounce:  wCfg.Debounce,
+		statePath: wCfg.OffsetStatePath,
+		tailOnly:  wCfg.TailOnly,
+		fileCh:    make(chan FileEvent, cmp.Or(wCfg.EventBuffer, defaultWatcherEventBuffer)),
+		offsets:   make(map[string]int64),
+		timers:    make(map[string]Timer),
+		clock:     wCfg.Clock,
+		queued:    make(map[string][]byte),
+		resets:    make(map[string]bool),
+		wake:      make(chan struct{}, 1),
+	}
+	if w.clock == nil {
+		w.clock = realClock{}
+	}
+	if w.statePath != "" {
+		w.loadOffsets()
+	}
+	return w
+}
+
+// loadOffsets restores persisted offsets, dropping entries for files that no
+// longer exist.
+func (w *Watcher) loadOffsets() {
+	data, err := os.ReadFile(w.statePath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			Warnf("warning: could not read offset state %s: %v", w.statePath, err)
+		}
+		return
+	}
+	var offsets map[string]int64
+	if err := json.Unmarshal(data, &offsets); err != nil {
+		Warnf("warning: ignoring corrupt offset state %s: %v", w.statePath, err)
+		return
+	}
+	for path, off := range offsets {
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		w.offsets[path] = off
+	}
+	Infof("restored read offsets for %d file(s) from %s", len(w.offsets), w.statePath)
+}
+
+// offsetSaveDelay is how long offset updates are collected before the state
+// file is rewritten, so a burst of reads costs one write.
+const offsetSaveDelay = time.Second
+
+// scheduleSave arranges for the offsets to be written within
+// offsetSaveDelay, unless a write is already pending.
+func (w *Watcher) scheduleSave() {
+	w.stateMu.Lock()
+	defer w.stateMu.Unlock()
+	if w.saveTimer == nil {
+		w.saveTimer = w.clock.AfterFunc(offsetSaveDelay, w.saveOffsets)
+	}
+}
+
+// saveOffsets writes the current offsets to the state file, cancelling any
+// pending coalesced write.
+func (w *Watcher) saveOffsets() {
+	w.stateMu.Lock()
+	defer w.stateMu.Unlock()
+	if w.saveTimer != nil {
+		w.saveTimer.Stop()
+		w.saveTimer = nil
+	}
+	w.writeOffsetsLocked()
+}
+
+// writeOffsetsLocked writes the current offsets to the state file
+// atomically. The caller holds stateMu, so a snapshot is never written after
+// a newer one.
+func (w *Watcher) writeOffsetsLocked() {
+	w.mu.Lock()
+	data, err := json.Marshal(w.offsets)
+	w.mu.Unlock()
+	if err != nil {
+		Warnf("warning: could not encode offset state: %v", err)
+		return
+	}
+
+	tmp := w.statePath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		Warnf("warning: could not write offset state: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, w.statePath); err != nil {
+		Warnf("warning: could not replace offset state: %v", err)
+	}
+}
+
+// Events returns the channel on which file events are delivered.
+func (w *Watcher) Events() <-chan FileEvent {
+	return w.fileCh
+}
+
+// Run starts watching. It blocks until ctx is done or an unrecoverable error occurs.
+func (w *Watcher) Run(done <-chan struct{}) error {
+	fsw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer fsw.Close()
+	if w.statePath != "" {
+		// Don't lose the offsets of the last reads to the save delay.
+		defer w.saveOffsets()
+	}
+
+	// The projects directory may not exist until the first Claude session.
+	waited, ok := w.waitForDir(done)
+	if !ok {
+		return nil
+	}
+
+	// Walk existing subdirectories and add them.
+	if err := w.addDirs(fsw, w.dir); err != nil {
+		Warnf("warning: could not walk %s: %v", w.dir, err)
+	}
+	// Files in a directory that appeared after startup are all new.
+	if w.tailOnly && !waited {
+		w.skipExisting()
+	}
+
+	go w.deliver(done)
+
+	for {
+		select {
+		case <-done:
+			return nil
+		case ev, ok := <-fsw.Events:
+			if !ok {
+				return nil
+			}
+			// If a new directory is created, add it to the watcher.
+			if ev.Has(fsnotify.Create) {
+				if info, err := os.Stat(ev.Name); err == nil && info.IsDir() {
+					_ = w.addDirs(fsw, ev.Name)
+				}
+			}
+			if ev.Has(fsnotify.Write) && strings.HasSuffix(ev.Name, ".jsonl") &&
+				!strings.HasPrefix(filepath.Base(ev.Name), "agent-") {
+				w.scheduleRead(ev.Name)
+			}
+		case err, ok := <-fsw.Errors:
+			if !ok {
+				return nil
+			}
+			Errorf("watcher error: %v", err)
+		}
+	}
+}
+
+// Retry delays while waiting for the watched directory to be created.
+const (
+	dirRetryMin = time.Second
+	dirRetryMax = 30 * time.Second
+)
+
+// waitForDir blocks until the watched directory exists, checking again with
+// exponential backoff. waited reports whether it was missing at first; ok is
+// false if done was closed first.
+func (w *Watcher) waitForDir(done <-chan struct{}) (waited, ok bool) {
+	delay := dirRetryMin
+	for {
+		info, err := os.Stat(w.dir)
+		if err == nil && info.IsDir() {
+			if waited {
+				Infof("%s now exists, watching it", w.dir)
+			}
+			return waited, true
+		}
+		if !waited {
+			Warnf("warning: %s does not exist yet, waiting for it to be created", w.dir)
+			waited = true
+		}
+
+		ch := make(chan struct{})
+		t := w.clock.AfterFunc(delay, func() { close(ch) })
+		select {
+		case <-ch:
+		case <-done:
+			t.Stop()
+			return waited, false
+		}
+		delay = min(delay*2, dirRetryMax)
+	}
+}
+
+func (w *Watcher) addDirs(fsw *fsnotify.Watcher, root string) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil // skip inaccessible entries
+		}
+		if info.IsDir() {
+			if addErr := fsw.Add(path); addErr != nil {
+				Warnf("warning: cannot watch %s: %v", path, addErr)
+			}
+		}
+		return nil
+	})
+}
+
+// skipExisting sets the offset of every existing session file without a
+// known offset to the file's current size.
+func (w *Watcher) skipExisting() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	skipped := 0
+	filepath.Walk(w.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || !strings.HasSuffix(path, ".jsonl") {
+			return nil
+		}
+		if _, ok := w.offsets[path]; !ok {
+			w.offsets[path] = info.Size()
+			skipped++
+		}
+		return nil
+	})
+	Debugf("tail-only: skipping existing content of %d session file(s)", skipped)
+}
+
+func (w *Watcher) scheduleRead(path string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if t, ok := w.timers[path]; ok {
+		t.Stop()
+	}
+	var t Timer
+	t = w.clock.AfterFunc(w.debounce, func() {
+		w.mu.Lock()
+		if w.timers[path] == t {
+			delete(w.timers, path)
+		}
+		w.mu.Unlock()
+		w.readNewData(path)
+	})
+	w.timers[path] = t
+}
+
+// WatcherDebugInfo is the watcher's section of /api/debug.
+type WatcherDebugInfo struct {
+	Debounce string `json:"debounce"`
+	// PendingReads are the files whose debounce timer is running: they were
+	// written to recently and will be read when the writes settle.
+	PendingReads []string `json:"pendingReads"`
+	// QueuedFiles are the files whose data was read but not yet taken by
+	// the pipeline, because the event buffer is full.
+	QueuedFiles []string `json:"queuedFiles"`
+}
+
+// DebugInfo reports the debounce interval, the files with a pending read and
+// the files with data waiting for the pipeline.
+func (w *Watcher) DebugInfo() WatcherDebugInfo {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	pending := make([]string, 0, len(w.timers))
+	for path := range w.timers {
+		pending = append(pending, path)
+	}
+	sort.Strings(pending)
+
+	w.queueMu.Lock()
+	queued := slices.Clone(w.queue)
+	w.queueMu.Unlock()
+	if queued == nil {
+		queued = []string{}
+	}
+	return WatcherDebugInfo{Debounce: w.debounce.String(), PendingReads: pending, QueuedFiles: queued}
+}
+
+func (w *Watcher) readNewData(path string) {
+	w.mu.Lock()
+	offset := w.offsets[path]
+	w.mu.Unlock()
+
+	f, err := os.Open(path)
+	if err != nil {
+		Errorf("cannot open %s: %v", path, err)
+		return
+	}
+	defer f.Close()
+
+	// A session file smaller than our offset was truncated or replaced
+	// (possibly while we were not running); start over from the beginning.
+	reset := false
+	if info, err := f.Stat(); err == nil && info.Size() < offset {
+		Warnf("warning: %s shrank below the last read offset, re-reading from start", path)
+		offset = 0
+		reset = true
+	}
+
+	// Seek to the last known offset.
+	if offset > 0 {
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			Errorf("seek error for %s: %v", path, err)
+			return
+		}
+	}
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		Errorf("read error for %s: %v", path, err)
+		return
+	}
+
+	// Hold back a trailing line that is still being written; it will be
+	// picked up in full on the next read.
+	data = completeLines(data)
+	if len(data) == 0 && !reset {
+		return
+	}
+
+	newOffset := offset + int64(len(data))
+	w.mu.Lock()
+	w.offsets[path] = newOffset
+	w.mu.Unlock()
+
+	if w.statePath != "" {
+		w.scheduleSave()
+	}
+
+	w.enqueue(path, data, reset)
+}
+
+// enqueue queues data read from path for delivery without blocking. If
+// earlier data from path is still queued, data is appended to it, or
+// replaces it when reset says the file was read again from its start.
+func (w *Watcher) enqueue(path string, data []byte, reset bool) {
+	w.queueMu.Lock()
+	if pending, ok := w.queued[path]; ok {
+		if reset {
+			pending = nil
+		}
+		w.queued[path] = append(pending, data...)
+		Debugf("event queue full, merging new data for %s", path)
+	} else {
+		w.queue = append(w.queue, path)
+		w.queued[path] = data
+	}
+	if reset {
+		w.resets[path] = true
+	}
+	w.queueMu.Unlock()
+
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// deliver sends queued data on fileCh, oldest file first, until done is
+// closed. It is the only sender, so a file's data is delivered in order.
+func (w *Watcher) deliver(done <-chan struct{}) {
+	for {
+		w.queueMu.Lock()
+		if len(w.queue) == 0 {
+			w.queueMu.Unlock()
+			select {
+			case <-w.wake:
+				continue
+			case <-done:
+				return
+			}
+		}
+		path := w.queue[0]
+		w.queue = w.queue[1:]
+		data := w.queued[path]
+		reset := w.resets[path]
+		delete(w.queued, path)
+		delete(w.resets, path)
+		w.queueMu.Unlock()
+
+		select {
+		case w.fileCh <- FileEvent{Path: path, NewData: data, Reset: reset}:
+		case <-done:
+			return
+		}
+	}
+}
+
+// completeLines returns the prefix of data up to and including the last
+// newline. A trailing unterminated line is kept only if it is a complete
+// JSON object, so a writer that never emits a final newline does not stall
+// the reader. Every session entry is an object, and an object cut short is
+// never valid, whereas a line cut inside a number or after a bare value can
+// be; anything but an object is therefore held back.
+func completeLines(data []byte) []byte {
+	if len(data) == 0 || data[len(data)-1] == '\n' {
+		return data
+	}
+	cut := bytes.LastIndexByte(data, '\n') + 1
+	tail := bytes.TrimSpace(data[cut:])
+	if len(tail) > 0 && tail[0] == '{' && json.Valid(tail) {
+		return data
+	}
+	if cut < len(data) {
+		Debugf("deferring incomplete trailing line (%d bytes)", len(data)-cut)
+	}
+	return data[:cut]
+}
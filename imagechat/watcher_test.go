@@ -0,0 +1,318 @@
+package imagechat
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCompleteLines(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want string
+	}{
+		{"empty", "", ""},
+		{"terminated", "{\"a\":1}\n", "{\"a\":1}\n"},
+		{"partial object", "{\"a\":1}\n{\"b\":", "{\"a\":1}\n"},
+		{"complete unterminated object", "{\"a\":1}\n{\"b\":2}", "{\"a\":1}\n{\"b\":2}"},
+		{"truncated number", "{\"a\":1}\n12", "{\"a\":1}\n"},
+		{"bare string", "\"abc\"", ""},
+		{"only partial", "{\"a\"", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(completeLines([]byte(tt.data))); got != tt.want {
+				t.Errorf("completeLines(%q) = %q, want %q", tt.data, got, tt.want)
+			}
+		})
+	}
+}
+
+// newTestWatcher returns a watcher delivering events until the test ends.
+func newTestWatcher(t *testing.T, wCfg WatcherConfig) *Watcher {
+	t.Helper()
+	w := NewWatcher(wCfg)
+	done := make(chan struct{})
+	t.Cleanup(func() { close(done) })
+	go w.deliver(done)
+	return w
+}
+
+func appendFile(t *testing.T, path, data string) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func nextEvent(t *testing.T, w *Watcher) FileEvent {
+	t.Helper()
+	select {
+	case ev := <-w.Events():
+		return ev
+	case <-time.After(2 * time.Second):
+		t.Fatal("no event delivered")
+		return FileEvent{}
+	}
+}
+
+func noEvent(t *testing.T, w *Watcher) {
+	t.Helper()
+	select {
+	case ev := <-w.Events():
+		t.Fatalf("unexpected event with %q", ev.NewData)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestWatcherDefersLineSplitAcrossReads(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "session.jsonl")
+	w := newTestWatcher(t, WatcherConfig{})
+
+	first := `{"type":"user","message":{"role":"user","content":"hel`
+	appendFile(t, path, first)
+	w.readNewData(path)
+	noEvent(t, w)
+
+	rest := `lo"}}` + "\n"
+	appendFile(t, path, rest)
+	w.readNewData(path)
+	ev := nextEvent(t, w)
+	if got, want := string(ev.NewData), first+rest; got != want {
+		t.Fatalf("NewData = %q, want %q", got, want)
+	}
+	if msgs := ParseJSONL(ev.NewData); len(msgs) != 1 || msgs[0].Content != "hello" {
+		t.Fatalf("parsed %+v, want one message \"hello\"", msgs)
+	}
+}
+
+func TestWatcherResetsAfterTruncation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "session.jsonl")
+	w := newTestWatcher(t, WatcherConfig{})
+
+	appendFile(t, path, `{"type":"user","message":{"role":"user","content":"a long first message"}}`+"\n")
+	w.readNewData(path)
+	if ev := nextEvent(t, w); ev.Reset {
+		t.Fatal("first read reported a reset")
+	}
+
+	rewritten := `{"type":"user","message":{"role":"user","content":"new"}}` + "\n"
+	if err := os.WriteFile(path, []byte(rewritten), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	w.readNewData(path)
+	ev := nextEvent(t, w)
+	if !ev.Reset {
+		t.Fatal("read after truncation did not report a reset")
+	}
+	if got := string(ev.NewData); got != rewritten {
+		t.Fatalf("NewData = %q, want %q", got, rewritten)
+	}
+
+	appendFile(t, path, `{"type":"user","message":{"role":"user","content":"more"}}`+"\n")
+	w.readNewData(path)
+	if ev := nextEvent(t, w); ev.Reset {
+		t.Fatal("append after the rewrite reported a reset")
+	}
+}
+
+func TestWatcherTailOnly(t *testing.T) {
+	var history strings.Builder
+	for i := range 20000 {
+		fmt.Fprintf(&history, `{"type":"user","message":{"role":"user","content":"old message %d"}}`+"\n", i)
+	}
+	newLine := `{"type":"user","message":{"role":"user","content":"new"}}` + "\n"
+
+	for _, tailOnly := range []bool{false, true} {
+		t.Run(fmt.Sprint("tailOnly=", tailOnly), func(t *testing.T) {
+			dir := t.TempDir()
+			project := filepath.Join(dir, "-home-me-app")
+			if err := os.Mkdir(project, 0o755); err != nil {
+				t.Fatal(err)
+			}
+			existing := filepath.Join(project, "old.jsonl")
+			appendFile(t, existing, history.String())
+
+			w := NewWatcher(WatcherConfig{Dir: dir, Debounce: 10 * time.Millisecond, TailOnly: tailOnly})
+			done := make(chan struct{})
+			defer close(done)
+			go w.Run(done)
+			time.Sleep(100 * time.Millisecond) // let Run add its watches
+
+			appendFile(t, existing, newLine)
+			ev := nextEvent(t, w)
+			want := history.String() + newLine
+			if tailOnly {
+				want = newLine
+			}
+			if string(ev.NewData) != want {
+				t.Errorf("read %d bytes of the existing file, want %d", len(ev.NewData), len(want))
+			}
+
+			// A session started after startup is read from its start.
+			created := filepath.Join(project, "new.jsonl")
+			appendFile(t, created, newLine+newLine)
+			if ev := nextEvent(t, w); string(ev.NewData) != newLine+newLine {
+				t.Errorf("new file read as %q, want both lines", ev.NewData)
+			}
+		})
+	}
+}
+
+func TestWatcherSlowConsumer(t *testing.T) {
+	dir := t.TempDir()
+	paths := []string{filepath.Join(dir, "a.jsonl"), filepath.Join(dir, "b.jsonl")}
+	w := newTestWatcher(t, WatcherConfig{EventBuffer: 1})
+
+	read := func(path string) {
+		t.Helper()
+		done := make(chan struct{})
+		go func() {
+			w.readNewData(path)
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("reading %s blocked on the full event buffer", path)
+		}
+	}
+
+	// A burst of writes while nothing consumes the events.
+	want := make(map[string]string)
+	for i := range 50 {
+		for _, path := range paths {
+			line := fmt.Sprintf(`{"type":"user","message":{"role":"user","content":"%s %d"}}`+"\n", filepath.Base(path), i)
+			appendFile(t, path, line)
+			want[path] += line
+			read(path)
+		}
+	}
+
+	got := make(map[string]string)
+	events := 0
+drain:
+	for {
+		select {
+		case ev := <-w.Events():
+			got[ev.Path] += string(ev.NewData)
+			events++
+		case <-time.After(100 * time.Millisecond):
+			break drain
+		}
+	}
+	for _, path := range paths {
+		if got[path] != want[path] {
+			t.Errorf("%s: delivered %q, want every line in order", filepath.Base(path), got[path])
+		}
+	}
+	// The buffered event, the one deliver was blocked on and one merged
+	// event per file.
+	if events > 4 {
+		t.Errorf("got %d events, want the burst merged into at most 4", events)
+	}
+}
+
+// manualClock is a Clock whose timers fire only when the test says so.
+type manualClock struct {
+	mu     sync.Mutex
+	timers []*manualTimer
+}
+
+type manualTimer struct {
+	f       func()
+	stopped bool
+}
+
+func (t *manualTimer) Stop() bool {
+	was := !t.stopped
+	t.stopped = true
+	return was
+}
+
+func (c *manualClock) Now() time.Time { return time.Time{} }
+
+func (c *manualClock) AfterFunc(d time.Duration, f func()) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &manualTimer{f: f}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// pending returns the timers neither fired nor stopped.
+func (c *manualClock) pending() []*manualTimer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var p []*manualTimer
+	for _, t := range c.timers {
+		if !t.stopped {
+			p = append(p, t)
+		}
+	}
+	return p
+}
+
+func TestWatcherCoalescesOffsetSaves(t *testing.T) {
+	dir := t.TempDir()
+	statePath := filepath.Join(dir, "offsets.json")
+	clock := &manualClock{}
+	w := newTestWatcher(t, WatcherConfig{OffsetStatePath: statePath, Clock: clock})
+
+	readState := func() map[string]int64 {
+		t.Helper()
+		data, err := os.ReadFile(statePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var offsets map[string]int64
+		if err := json.Unmarshal(data, &offsets); err != nil {
+			t.Fatal(err)
+		}
+		return offsets
+	}
+
+	line := `{"type":"user","message":{"role":"user","content":"hi"}}` + "\n"
+	a, b := filepath.Join(dir, "a.jsonl"), filepath.Join(dir, "b.jsonl")
+	for _, path := range []string{a, b, a} {
+		appendFile(t, path, line)
+		w.readNewData(path)
+	}
+	if _, err := os.Stat(statePath); !os.IsNotExist(err) {
+		t.Fatalf("state written before the save delay: %v", err)
+	}
+	pending := clock.pending()
+	if len(pending) != 1 {
+		t.Fatalf("%d saves pending, want the reads coalesced into 1", len(pending))
+	}
+	pending[0].stopped = true
+	pending[0].f()
+	want := map[string]int64{a: int64(2 * len(line)), b: int64(len(line))}
+	if got := readState(); !maps.Equal(got, want) {
+		t.Errorf("state = %v, want %v", got, want)
+	}
+
+	// A flush, as on shutdown, writes at once and cancels the pending save.
+	appendFile(t, b, line)
+	w.readNewData(b)
+	w.saveOffsets()
+	want[b] = int64(2 * len(line))
+	if got := readState(); !maps.Equal(got, want) {
+		t.Errorf("state after flush = %v, want %v", got, want)
+	}
+	if p := clock.pending(); len(p) != 0 {
+		t.Errorf("%d saves still pending after the flush", len(p))
+	}
+}
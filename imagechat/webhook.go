@@ -0,0 +1,84 @@
+package imagechat
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// webhookTimeout bounds each webhook delivery.
+const webhookTimeout = 5 * time.Second
+
+// WebhookPayload is the JSON body POSTed to IMGCHAT_WEBHOOK_URL for each new
+// image: the SessionImage sent to browsers plus a URL to fetch the image.
+type WebhookPayload struct {
+	SessionImage
+	ImageURL string `json:"imageUrl"`
+}
+
+// Webhook notifies an external URL of every new image. Delivery is
+// best-effort: each POST runs in its own goroutine, is not retried, and a
+// failure is only logged.
+type Webhook struct {
+	cfg       *Config
+	url       string
+	imageBase string
+	client    *http.Client
+}
+
+// NewWebhook returns a Webhook posting to cfg.WebhookURL, or nil if none is
+// configured. Image URLs point at the local web UI.
+func NewWebhook(cfg *Config) *Webhook {
+	if cfg.WebhookURL == "" {
+		return nil
+	}
+	return &Webhook{
+		cfg:       cfg,
+		url:       cfg.WebhookURL,
+		imageBase: "http://localhost:" + cfg.ServerPort + cfg.BasePath + "/images/",
+		client:    &http.Client{Timeout: webhookTimeout},
+	}
+}
+
+// Notify sends si to the webhook in the background. A nil Webhook is a no-op.
+func (wh *Webhook) Notify(si SessionImage) {
+	if wh == nil {
+		return
+	}
+	payload := WebhookPayload{
+		SessionImage: si,
+		ImageURL:     wh.imageBase + url.PathEscape(si.Filename),
+	}
+	go func() {
+		if err := wh.post(payload); err != nil {
+			Errorf("webhook delivery failed for %s: %s", si.Filename, wh.cfg.redactSecrets(err.Error()))
+		}
+	}()
+}
+
+func (wh *Webhook) post(payload WebhookPayload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to encode payload: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, wh.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := wh.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
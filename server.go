@@ -1,185 +0,0 @@
-package main
-
-import (
-	"context"
-	"embed"
-	"encoding/json"
-	"log"
-	"net/http"
-	"sync"
-	"time"
-
-	"github.com/gorilla/websocket"
-)
-
-//go:embed static/index.html
-var staticFS embed.FS
-
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool { return true },
-}
-
-type Server struct {
-	port     string
-	imageDir string
-	cfg      *Config
-	clients  map[*websocket.Conn]struct{}
-	mu       sync.RWMutex
-	done     <-chan struct{}
-}
-
-func NewServer(port, imageDir string, cfg *Config, done <-chan struct{}) *Server {
-	return &Server{
-		port:     port,
-		imageDir: imageDir,
-		cfg:      cfg,
-		clients:  make(map[*websocket.Conn]struct{}),
-		done:     done,
-	}
-}
-
-// HasClients returns true if at least one WebSocket client is connected.
-func (s *Server) HasClients() bool {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-	return len(s.clients) > 0
-}
-
-// BroadcastSessionImage sends a SessionImage as JSON to all connected WebSocket clients.
-func (s *Server) BroadcastSessionImage(si SessionImage) {
-	data, err := json.Marshal(si)
-	if err != nil {
-		log.Printf("json marshal error: %v", err)
-		return
-	}
-
-	// Snapshot connections under lock, then release before I/O
-	s.mu.RLock()
-	conns := make([]*websocket.Conn, 0, len(s.clients))
-	for conn := range s.clients {
-		conns = append(conns, conn)
-	}
-	s.mu.RUnlock()
-
-	for _, conn := range conns {
-		if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
-			log.Printf("websocket write error: %v", err)
-		}
-	}
-}
-
-// Start begins serving HTTP and WebSocket connections. It blocks until
-// the done channel is closed, then gracefully shuts down the HTTP server.
-func (s *Server) Start() error {
-	mux := http.NewServeMux()
-
-	// Serve index.html
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		if r.URL.Path != "/" {
-			http.NotFound(w, r)
-			return
-		}
-		data, err := staticFS.ReadFile("static/index.html")
-		if err != nil {
-			http.Error(w, "not found", http.StatusNotFound)
-			return
-		}
-		w.Header().Set("Content-Type", "text/html; charset=utf-8")
-		w.Write(data)
-	})
-
-	// Serve generated images
-	mux.Handle("/images/", http.StripPrefix("/images/", http.FileServer(http.Dir(s.imageDir))))
-
-	// WebSocket endpoint
-	mux.HandleFunc("/ws", s.handleWS)
-
-	// Config API endpoints
-	mux.HandleFunc("/api/config", s.handleConfig)
-
-	httpServer := &http.Server{
-		Addr:    ":" + s.port,
-		Handler: mux,
-	}
-
-	// Shut down the HTTP server when done is closed.
-	go func() {
-		<-s.done
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
-		if err := httpServer.Shutdown(ctx); err != nil {
-			log.Printf("http server shutdown error: %v", err)
-		}
-	}()
-
-	log.Printf("server listening on :%s", s.port)
-	if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
-		return err
-	}
-	return nil
-}
-
-func (s *Server) handleWS(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Printf("websocket upgrade error: %v", err)
-		return
-	}
-
-	s.mu.Lock()
-	s.clients[conn] = struct{}{}
-	s.mu.Unlock()
-
-	log.Printf("WebSocket client connected (total: %d)", len(s.clients))
-
-	// Keep connection alive; remove on close.
-	defer func() {
-		s.mu.Lock()
-		delete(s.clients, conn)
-		s.mu.Unlock()
-		conn.Close()
-		log.Printf("WebSocket client disconnected (total: %d)", len(s.clients))
-	}()
-
-	// Close the connection when done is signaled so ReadMessage unblocks.
-	go func() {
-		<-s.done
-		conn.Close()
-	}()
-
-	for {
-		if _, _, err := conn.ReadMessage(); err != nil {
-			break
-		}
-	}
-}
-
-func (s *Server) handleConfig(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case http.MethodGet:
-		rc := s.cfg.GetRuntimeConfig()
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(rc)
-
-	case http.MethodPut:
-		var rc RuntimeConfig
-		if err := json.NewDecoder(r.Body).Decode(&rc); err != nil {
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(map[string]string{"error": "invalid JSON"})
-			return
-		}
-		if err := s.cfg.SetRuntimeConfig(rc); err != nil {
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
-			return
-		}
-		log.Printf("runtime config updated: %+v", rc)
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(s.cfg.GetRuntimeConfig())
-
-	default:
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-	}
-}